@@ -3,9 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/formeo/go-audio-converter/pkg/converter"
+	"github.com/formeo/go-audio-converter/pkg/flacenc"
 )
 
 const version = "0.3.0"
@@ -27,13 +32,24 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(os.Args) < 3 {
+	if os.Args[1] == "--formats" {
+		printFormats()
+		os.Exit(0)
+	}
+
+	opts, args, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	input := os.Args[1]
-	output := os.Args[2]
+	input := args[0]
+	output := args[1]
 
 	// Validate input exists
 	if _, err := os.Stat(input); os.IsNotExist(err) {
@@ -41,32 +57,64 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Detect and show formats
-	inputFmt := converter.DetectFormat(input)
+	// Detect and show formats: input by content, output by extension
+	inputFmt, err := detectInput(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	outputFmt := converter.DetectFormat(output)
 
 	if inputFmt == converter.FormatUnknown {
 		fmt.Fprintf(os.Stderr, "Error: unsupported input format: %s\n", input)
-		fmt.Fprintln(os.Stderr, "Supported: wav, mp3, flac, ogg")
+		fmt.Fprintf(os.Stderr, "Supported: %s\n", decodable())
 		os.Exit(1)
 	}
 
 	if outputFmt == converter.FormatUnknown {
 		fmt.Fprintf(os.Stderr, "Error: unsupported output format: %s\n", output)
-		fmt.Fprintln(os.Stderr, "Supported: wav, mp3, flac")
+		fmt.Fprintf(os.Stderr, "Supported: %s\n", encodable())
 		os.Exit(1)
 	}
 
 	// Warn about encoding limitations
-	if outputFmt == converter.FormatOGG {
-		fmt.Fprintln(os.Stderr, "Error: OGG encoding not supported (no pure Go encoder)")
-		fmt.Fprintln(os.Stderr, "Tip: convert to WAV, MP3, or FLAC instead")
+	if _, ok := converter.LookupEncoder(outputFmt); !ok {
+		fmt.Fprintf(os.Stderr, "Error: %s encoding not supported (no pure Go encoder)\n", outputFmt)
+		fmt.Fprintf(os.Stderr, "Tip: convert to %s instead\n", encodable())
 		os.Exit(1)
 	}
 
 	fmt.Printf("Converting: %s (%s) -> %s (%s)\n", input, inputFmt, output, outputFmt)
 
 	conv := converter.New()
+	conv.Warn = func(msg string) {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+	}
+	if opts.flacLevel >= 0 {
+		conv.FLACLevel = opts.flacLevel
+	}
+	conv.BitDepth = opts.bitDepth
+	conv.Float = opts.float
+	conv.TargetSampleRate = opts.sampleRate
+	conv.Channels = opts.channels
+	if opts.resample != "" {
+		conv.ResampleQuality = opts.resample
+	}
+	if opts.dither != "" {
+		conv.Dither = opts.dither
+	}
+	if opts.wavContainer != "" {
+		conv.WAVContainer = opts.wavContainer
+	}
+	if opts.mp3Mode != "" {
+		conv.MP3Mode = opts.mp3Mode
+	}
+	if opts.bitrate > 0 {
+		conv.Bitrate = opts.bitrate
+	}
+	if opts.vbrQuality >= 0 {
+		conv.VBRQuality = opts.vbrQuality
+	}
 
 	start := time.Now()
 	if err := conv.ConvertFile(input, output); err != nil {
@@ -81,23 +129,271 @@ func main() {
 	fmt.Printf("Done in %v (%s)\n", time.Since(start).Round(time.Millisecond), size)
 }
 
+// detectInput returns the input's format from its content, or from its
+// extension if the content isn't recognized
+func detectInput(path string) (converter.Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return converter.FormatUnknown, err
+	}
+	defer f.Close()
+
+	format, err := converter.DetectFormatFromReader(f)
+	if err != nil {
+		return converter.FormatUnknown, fmt.Errorf("%s: %w", path, err)
+	}
+	if format == converter.FormatUnknown {
+		format = converter.DetectFormat(path)
+	}
+	return format, nil
+}
+
 func printUsage() {
 	fmt.Printf("audioconv %s - Pure Go audio converter\n\n", version)
-	fmt.Println("Usage: audioconv <input> <output>")
+	fmt.Println("Usage: audioconv [options] <input> <output>")
 	fmt.Println("")
 	fmt.Println("Supported formats:")
-	fmt.Println("  Decode: wav, mp3, flac, ogg")
-	fmt.Println("  Encode: wav, mp3, flac")
+	fmt.Printf("  Decode: %s\n", decodable())
+	fmt.Printf("  Encode: %s\n", encodable())
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  audioconv input.wav output.mp3")
 	fmt.Println("  audioconv input.flac output.wav")
+	fmt.Println("  audioconv input.aif output.flac")
 	fmt.Println("  audioconv input.ogg output.flac")
 	fmt.Println("  audioconv input.mp3 output.flac")
+	fmt.Println("  audioconv --flac-level 8 input.wav output.flac")
+	fmt.Println("  audioconv --bits 16 --dither shaped input.flac output.wav")
+	fmt.Println("  audioconv --float input.flac output.wav")
+	fmt.Println("  audioconv --wav bw64 input.w64 output.wav")
+	fmt.Println("  audioconv --rate 8000 input.wav output.wav")
+	fmt.Println("  audioconv --channels 2 surround.flac stereo.mp3")
+	fmt.Println("  audioconv --vbr 2 input.flac output.mp3")
 	fmt.Println("")
 	fmt.Println("Options:")
-	fmt.Println("  -h, --help     Show this help")
-	fmt.Println("  -v, --version  Show version")
+	fmt.Printf("  --flac-level N  FLAC compression level 0-%d (default %d)\n", flacenc.MaxLevel, flacenc.DefaultLevel)
+	fmt.Println("  --bits N        Output bit depth 16, 24 or 32, or 64 with --float (default: input's)")
+	fmt.Println("  --float         Write IEEE float WAV, 32-bit unless --bits 64")
+	fmt.Println("  --dither TYPE   none, rect, tpdf or shaped (default tpdf)")
+	fmt.Println("  --wav TYPE      WAV header: auto, rf64 or bw64 (default auto: RF64 past 4 GB)")
+	fmt.Println("  --rate HZ       Output sample rate (default: input's)")
+	fmt.Println("  --resample Q    Resampler: linear, low, medium or high (default medium)")
+	fmt.Println("  --channels N    Output channels; 1 or 2 mix down (default: input's)")
+	fmt.Println("  --bitrate KBPS  Constant MP3 bitrate (default 192)")
+	fmt.Printf("  --vbr Q         Variable MP3 bitrate, quality 0 (best) to %d\n", converter.MaxVBRQuality)
+	fmt.Println("  --abr KBPS      Average MP3 bitrate")
+	fmt.Println("  --formats       List formats and codec capabilities")
+	fmt.Println("  -h, --help      Show this help")
+	fmt.Println("  -v, --version   Show version")
+}
+
+// decodable lists the formats registered decoders read
+func decodable() string {
+	var names []string
+	for _, d := range converter.Decoders() {
+		names = append(names, string(d.Format))
+	}
+	return strings.Join(names, ", ")
+}
+
+// encodable lists the formats registered encoders write
+func encodable() string {
+	var names []string
+	for _, e := range converter.Encoders() {
+		names = append(names, string(e.Format))
+	}
+	return strings.Join(names, ", ")
+}
+
+// printFormats prints a table of the registered codecs
+func printFormats() {
+	type row struct {
+		dec *converter.DecoderInfo
+		enc *converter.EncoderInfo
+	}
+	rows := map[converter.Format]*row{}
+	var order []converter.Format
+	get := func(f converter.Format) *row {
+		if rows[f] == nil {
+			rows[f] = &row{}
+			order = append(order, f)
+		}
+		return rows[f]
+	}
+	for _, d := range converter.Decoders() {
+		get(d.Format).dec = &d
+	}
+	for _, e := range converter.Encoders() {
+		get(e.Format).enc = &e
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FORMAT\tNAME\tEXTENSIONS\tDECODE\tENCODE\tDETAILS")
+	for _, f := range order {
+		r := rows[f]
+		name, exts := "", []string(nil)
+		var details []string
+		var tags, pictures []string
+		if r.dec != nil {
+			name, exts = r.dec.Name, r.dec.Extensions
+			if r.dec.Tags {
+				tags = append(tags, "read")
+			}
+			if r.dec.Pictures {
+				pictures = append(pictures, "read")
+			}
+		}
+		if r.enc != nil {
+			name, exts = r.enc.Name, r.enc.Extensions
+			if r.enc.Lossy {
+				details = append(details, "lossy")
+			}
+			if len(r.enc.BitDepths) > 0 {
+				bits := make([]string, len(r.enc.BitDepths))
+				for i, b := range r.enc.BitDepths {
+					bits[i] = strconv.Itoa(b)
+				}
+				details = append(details, strings.Join(bits, "/")+"-bit")
+			}
+			if r.enc.Float {
+				details = append(details, "32/64-bit float")
+			}
+			if r.enc.MaxChannels > 0 {
+				details = append(details, fmt.Sprintf("up to %d channels", r.enc.MaxChannels))
+			}
+			if r.enc.Tags {
+				tags = append(tags, "write")
+			}
+			if r.enc.Pictures {
+				pictures = append(pictures, "write")
+			}
+		}
+		if tags != nil {
+			details = append(details, "tags "+strings.Join(tags, "/"))
+		}
+		if pictures != nil {
+			details = append(details, "pictures "+strings.Join(pictures, "/"))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", f, name, strings.Join(exts, ", "),
+			yesNo(r.dec != nil), yesNo(r.enc != nil), strings.Join(details, ", "))
+	}
+	tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// options holds command line flags
+type options struct {
+	flacLevel    int // -1 = converter default
+	bitDepth     int // 0 = keep the input's
+	float        bool
+	dither       converter.Dither
+	wavContainer converter.WAVContainer
+	sampleRate   int // 0 = keep the input's
+	resample     converter.ResampleQuality
+	channels     int // 0 = keep the input's
+	mp3Mode      converter.MP3Mode
+	bitrate      int // 0 = converter default
+	vbrQuality   int // -1 = converter default
+}
+
+// parseArgs separates flags from positional arguments. Flags may appear
+// anywhere and take their value as "--flag N" or "--flag=N"; --float takes
+// none.
+func parseArgs(args []string) (*options, []string, error) {
+	opts := &options{flacLevel: -1, vbrQuality: -1}
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		if arg == "--float" {
+			opts.float = true
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "--flac-level":
+			level, err := strconv.Atoi(value)
+			if err != nil || level < 0 || level > flacenc.MaxLevel {
+				return nil, nil, fmt.Errorf("invalid --flac-level %q (0-%d)", value, flacenc.MaxLevel)
+			}
+			opts.flacLevel = level
+		case "--bits":
+			bits, err := strconv.Atoi(value)
+			if err != nil || (bits != 16 && bits != 24 && bits != 32 && bits != 64) {
+				return nil, nil, fmt.Errorf("invalid --bits %q (16, 24, 32 or 64)", value)
+			}
+			opts.bitDepth = bits
+		case "--dither":
+			dither, err := converter.ParseDither(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --dither: %w", err)
+			}
+			opts.dither = dither
+		case "--wav":
+			container, err := converter.ParseWAVContainer(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --wav: %w", err)
+			}
+			opts.wavContainer = container
+		case "--rate":
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate <= 0 {
+				return nil, nil, fmt.Errorf("invalid --rate %q", value)
+			}
+			opts.sampleRate = rate
+		case "--resample":
+			quality, err := converter.ParseResampleQuality(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --resample: %w", err)
+			}
+			opts.resample = quality
+		case "--channels":
+			channels, err := strconv.Atoi(value)
+			if err != nil || channels < 1 || channels > 8 {
+				return nil, nil, fmt.Errorf("invalid --channels %q (1-8)", value)
+			}
+			opts.channels = channels
+		case "--bitrate", "--abr":
+			kbps, err := strconv.Atoi(value)
+			if err != nil || kbps <= 0 {
+				return nil, nil, fmt.Errorf("invalid %s %q", name, value)
+			}
+			opts.mp3Mode, opts.bitrate = converter.MP3CBR, kbps
+			if name == "--abr" {
+				opts.mp3Mode = converter.MP3ABR
+			}
+		case "--vbr":
+			quality, err := strconv.Atoi(value)
+			if err != nil || quality < 0 || quality > converter.MaxVBRQuality {
+				return nil, nil, fmt.Errorf("invalid --vbr %q (0-%d)", value, converter.MaxVBRQuality)
+			}
+			opts.mp3Mode, opts.vbrQuality = converter.MP3VBR, quality
+		default:
+			return nil, nil, fmt.Errorf("unknown option: %s", name)
+		}
+	}
+
+	return opts, positional, nil
 }
 
 func formatSize(bytes int64) string {
@@ -0,0 +1,325 @@
+package converter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+func init() {
+	RegisterDecoder(DecoderInfo{
+		Format:     FormatAIFF,
+		Name:       "AIFF",
+		Extensions: []string{"aiff", "aif", "aifc"},
+		Probe:      probeAIFF,
+		New:        func(r io.Reader) (Decoder, error) { return newAIFFDecoder(r) },
+	})
+	RegisterEncoder(EncoderInfo{
+		Format:     FormatAIFF,
+		Name:       "AIFF",
+		Extensions: []string{"aiff", "aif", "aifc"},
+		BitDepths:  []int{8, 16, 24, 32},
+		New: func(w io.Writer, cfg EncoderConfig) (Encoder, error) {
+			return newAIFFEncoder(w, cfg.SampleRate, cfg.Channels, cfg.BitDepth)
+		},
+	})
+}
+
+// probeAIFF matches an AIFF or AIFF-C FORM header
+func probeAIFF(b []byte) bool {
+	return len(b) >= 12 && string(b[0:4]) == "FORM" && (string(b[8:12]) == "AIFF" || string(b[8:12]) == "AIFC")
+}
+
+const (
+	// aiffHeaderSize is the FORM header, an 18-byte COMM chunk and the
+	// SSND chunk header with its offset and block size fields
+	aiffHeaderSize = 12 + 8 + 18 + 8 + 8
+	// aiffUnknownSize is written as FORM/SSND size when the output can't
+	// be seeked back to patch the header; the decoder reads until EOF
+	aiffUnknownSize = 0xFFFFFFFF
+)
+
+// aiffDecoder reads PCM from an AIFF or AIFF-C stream chunk by chunk.
+// AIFF-C is read uncompressed only: big-endian "NONE" and "twos", and
+// little-endian "sowt". Samples narrower than their byte width are left
+// justified, so they are returned at the byte width with the low bits
+// zero.
+type aiffDecoder struct {
+	r            io.Reader
+	sampleRate   int
+	channels     int
+	bitDepth     int
+	littleEndian bool
+	buf          []byte
+}
+
+func newAIFFDecoder(r io.Reader) (*aiffDecoder, error) {
+	var form [12]byte
+	if _, err := io.ReadFull(r, form[:]); err != nil {
+		return nil, fmt.Errorf("invalid AIFF file")
+	}
+	if string(form[0:4]) != "FORM" || (string(form[8:12]) != "AIFF" && string(form[8:12]) != "AIFC") {
+		return nil, fmt.Errorf("invalid AIFF file")
+	}
+	aifc := string(form[8:12]) == "AIFC"
+
+	d := &aiffDecoder{}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("invalid AIFF file: no SSND chunk")
+		}
+		id := string(hdr[0:4])
+		size := binary.BigEndian.Uint32(hdr[4:8])
+
+		switch id {
+		case "COMM":
+			if size < 18 || (aifc && size < 22) {
+				return nil, fmt.Errorf("invalid AIFF COMM chunk")
+			}
+			comm := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, comm); err != nil {
+				return nil, fmt.Errorf("read COMM chunk: %w", err)
+			}
+			d.channels = int(binary.BigEndian.Uint16(comm[0:2]))
+			d.bitDepth = (int(binary.BigEndian.Uint16(comm[6:8])) + 7) / 8 * 8
+			d.sampleRate = int(math.Round(parseExtended(comm[8:18])))
+			if aifc {
+				switch compression := string(comm[18:22]); compression {
+				case "NONE", "twos":
+				case "sowt":
+					d.littleEndian = true
+				default:
+					return nil, fmt.Errorf("unsupported AIFF-C compression %q", compression)
+				}
+			}
+			if d.channels < 1 || d.sampleRate <= 0 {
+				return nil, fmt.Errorf("invalid AIFF COMM chunk")
+			}
+
+		case "SSND":
+			if d.channels == 0 {
+				return nil, fmt.Errorf("invalid AIFF file: SSND before COMM chunk")
+			}
+			if err := checkAIFFBitDepth(d.bitDepth); err != nil {
+				return nil, err
+			}
+			var fields [8]byte
+			if _, err := io.ReadFull(r, fields[:]); err != nil {
+				return nil, fmt.Errorf("read SSND chunk: %w", err)
+			}
+			// Sample data starts offset bytes in, for block alignment
+			offset := binary.BigEndian.Uint32(fields[0:4])
+			if _, err := io.CopyN(io.Discard, r, int64(offset)); err != nil {
+				return nil, fmt.Errorf("read SSND chunk: %w", err)
+			}
+			d.r = r
+			if size != aiffUnknownSize && size >= 8+offset {
+				d.r = io.LimitReader(r, int64(size-8-offset))
+			}
+			d.buf = make([]byte, chunkFrames*d.channels*d.bitDepth/8)
+			return d, nil
+
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return nil, fmt.Errorf("skip %q chunk: %w", id, err)
+			}
+		}
+	}
+}
+
+func (d *aiffDecoder) SampleRate() int { return d.sampleRate }
+func (d *aiffDecoder) Channels() int   { return d.channels }
+func (d *aiffDecoder) BitDepth() int   { return d.bitDepth }
+
+func (d *aiffDecoder) ReadChunk() (*PCMData, error) {
+	n, err := io.ReadFull(d.r, d.buf)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	bytesPerSample := d.bitDepth / 8
+	frameSize := bytesPerSample * d.channels
+	n -= n % frameSize
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	data := d.buf[:n]
+	samples := make([]int32, n/bytesPerSample)
+	for i := range samples {
+		b := data[i*bytesPerSample:]
+		var u uint32
+		for j := 0; j < bytesPerSample; j++ {
+			if d.littleEndian {
+				u |= uint32(b[j]) << (8 * j)
+			} else {
+				u = u<<8 | uint32(b[j])
+			}
+		}
+		// Sign-extend from the sample's width; 8-bit AIFF is signed
+		shift := 32 - d.bitDepth
+		samples[i] = int32(u<<shift) >> shift
+	}
+
+	return &PCMData{
+		Samples:    samples,
+		SampleRate: d.sampleRate,
+		Channels:   d.channels,
+		BitDepth:   d.bitDepth,
+	}, nil
+}
+
+// aiffEncoder writes big-endian PCM AIFF. The header is written up front
+// with placeholder sizes, which are patched on Close if the writer can
+// seek.
+type aiffEncoder struct {
+	w        io.Writer
+	channels int
+	bitDepth int
+	start    int64
+	seekable bool
+	dataSize int64
+}
+
+func newAIFFEncoder(w io.Writer, sampleRate, channels, bitDepth int) (*aiffEncoder, error) {
+	if err := checkAIFFBitDepth(bitDepth); err != nil {
+		return nil, err
+	}
+	e := &aiffEncoder{w: w, channels: channels, bitDepth: bitDepth}
+
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			e.start = pos
+			e.seekable = true
+		}
+	}
+
+	if err := writeAIFFHeader(w, sampleRate, channels, bitDepth, aiffUnknownSize); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *aiffEncoder) WriteChunk(pcm *PCMData) error {
+	samples := convertBitDepth(pcm.Samples, pcm.bits(), e.bitDepth)
+	bytesPerSample := e.bitDepth / 8
+	buf := make([]byte, len(samples)*bytesPerSample)
+	for i, s := range samples {
+		b := buf[i*bytesPerSample:]
+		for j := 0; j < bytesPerSample; j++ {
+			b[j] = byte(s >> (8 * (bytesPerSample - 1 - j)))
+		}
+	}
+	if _, err := e.w.Write(buf); err != nil {
+		return err
+	}
+	e.dataSize += int64(len(buf))
+	return nil
+}
+
+func (e *aiffEncoder) Close() error {
+	if err := writePadding(e.w, e.dataSize%2); err != nil {
+		return err
+	}
+	if !e.seekable {
+		return nil
+	}
+	ws := e.w.(io.WriteSeeker)
+
+	patches := []struct {
+		offset int64
+		value  uint32
+	}{
+		{4, uint32(aiffHeaderSize - 8 + e.dataSize + e.dataSize%2)}, // FORM
+		{22, uint32(e.dataSize / int64(e.channels*e.bitDepth/8))},   // COMM sample frames
+		{42, uint32(8 + e.dataSize)},                                // SSND
+	}
+	var b [4]byte
+	for _, p := range patches {
+		binary.BigEndian.PutUint32(b[:], p.value)
+		if _, err := ws.Seek(e.start+p.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := ws.Write(b[:]); err != nil {
+			return err
+		}
+	}
+
+	_, err := ws.Seek(e.start+aiffHeaderSize+e.dataSize+e.dataSize%2, io.SeekStart)
+	return err
+}
+
+// checkAIFFBitDepth rejects sample sizes the PCM reader and writer don't
+// handle
+func checkAIFFBitDepth(bitDepth int) error {
+	switch bitDepth {
+	case 8, 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("unsupported AIFF bit depth: %d", bitDepth)
+	}
+}
+
+// writeAIFFHeader writes the FORM header, COMM chunk and SSND chunk
+// header. dataSize is the SSND sample data length, or aiffUnknownSize.
+func writeAIFFHeader(w io.Writer, sampleRate, channels, bitDepth int, dataSize uint32) error {
+	formSize, ssndSize, frames := uint32(aiffUnknownSize), uint32(aiffUnknownSize), uint32(0)
+	if dataSize != aiffUnknownSize {
+		formSize = aiffHeaderSize - 8 + dataSize + dataSize%2
+		ssndSize = 8 + dataSize
+		frames = dataSize / uint32(channels*bitDepth/8)
+	}
+
+	hdr := make([]byte, aiffHeaderSize)
+	copy(hdr[0:4], "FORM")
+	binary.BigEndian.PutUint32(hdr[4:8], formSize)
+	copy(hdr[8:12], "AIFF")
+
+	copy(hdr[12:16], "COMM")
+	binary.BigEndian.PutUint32(hdr[16:20], 18)
+	binary.BigEndian.PutUint16(hdr[20:22], uint16(channels))
+	binary.BigEndian.PutUint32(hdr[22:26], frames)
+	binary.BigEndian.PutUint16(hdr[26:28], uint16(bitDepth))
+	putExtended(hdr[28:38], float64(sampleRate))
+
+	copy(hdr[38:42], "SSND")
+	binary.BigEndian.PutUint32(hdr[42:46], ssndSize)
+	// Offset and block size stay zero
+
+	_, err := w.Write(hdr)
+	return err
+}
+
+// parseExtended decodes an 80-bit IEEE 754 extended precision number, as
+// AIFF stores sample rates: a sign bit, 15-bit exponent and a 64-bit
+// mantissa with an explicit integer bit
+func parseExtended(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mant := binary.BigEndian.Uint64(b[2:10])
+	if exp == 0 && mant == 0 {
+		return 0
+	}
+	v := math.Ldexp(float64(mant), exp-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// putExtended encodes a positive v as an 80-bit extended precision number
+func putExtended(b []byte, v float64) {
+	for i := range b[:10] {
+		b[i] = 0
+	}
+	if v <= 0 {
+		return
+	}
+	frac, exp := math.Frexp(v) // v = frac * 2^exp, frac in [0.5, 1)
+	binary.BigEndian.PutUint16(b[0:2], uint16(exp-1+16383))
+	binary.BigEndian.PutUint64(b[2:10], uint64(math.Ldexp(frac, 64)))
+}
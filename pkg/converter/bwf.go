@@ -0,0 +1,251 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// WAVMetadata is the production metadata of a WAV file: the Broadcast WAV
+// bext chunk, an iXML document and the LIST/INFO fields
+type WAVMetadata struct {
+	Bext *Bext // nil if the file has no bext chunk
+	// IXML is the iXML chunk's document, copied as is
+	IXML string
+	// Info holds the LIST/INFO fields under their Vorbis comment names
+	// (INAM is TITLE, IART ARTIST, ...); IDs without one keep the ID
+	Info Tags
+}
+
+// Bext is a Broadcast WAV bext chunk (EBU Tech 3285). Text fields are
+// cut to their fixed widths when written, at the last whole UTF-8
+// character that fits.
+type Bext struct {
+	Description         string // up to 256 bytes
+	Originator          string // up to 32
+	OriginatorReference string // up to 32
+	OriginationDate     string // yyyy-mm-dd
+	OriginationTime     string // hh:mm:ss
+	// TimeReference is the position of the first sample, in samples since
+	// midnight at the file's sample rate
+	TimeReference uint64
+	Version       int
+	UMID          [64]byte
+	// Loudness (version 2) is given in hundredths: LUFS for the integrated
+	// and maximum loudness, LU for the range, dBTP for the true peak
+	LoudnessValue        int16
+	LoudnessRange        int16
+	MaxTruePeakLevel     int16
+	MaxMomentaryLoudness int16
+	MaxShortTermLoudness int16
+	CodingHistory        string
+}
+
+// ReadWAVMetadata returns the metadata of the WAV, RF64/BW64 or Wave64
+// file in r. Chunks after the audio are only found if r is an
+// io.ReadSeeker.
+func ReadWAVMetadata(r io.Reader) (*WAVMetadata, error) {
+	d, err := newWAVDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	if m := d.WAVMetadata(); m != nil {
+		return m, nil
+	}
+	return &WAVMetadata{}, nil
+}
+
+// wavMetadataReader is implemented by decoders that found WAV metadata
+// chunks in their input
+type wavMetadataReader interface {
+	WAVMetadata() *WAVMetadata
+}
+
+// wavMetadataWriter is implemented by encoders that can store bext and
+// iXML chunks. LIST/INFO comes from SetTags, so m.Info is ignored.
+// SetWAVMetadata must be called before the first WriteChunk.
+type wavMetadataWriter interface {
+	SetWAVMetadata(m *WAVMetadata)
+}
+
+// copyWAVMetadata passes WAV metadata from dec to enc, with the bext time
+// reference moved to the output's sample rate
+func copyWAVMetadata(dec Decoder, enc Encoder, sampleRate int) {
+	mr, ok := dec.(wavMetadataReader)
+	if !ok {
+		return
+	}
+	mw, ok := enc.(wavMetadataWriter)
+	if !ok {
+		return
+	}
+	m := mr.WAVMetadata()
+	if m == nil {
+		return
+	}
+
+	out := *m
+	if m.Bext != nil && sampleRate != dec.SampleRate() {
+		bext := *m.Bext
+		bext.TimeReference = uint64(math.Round(float64(bext.TimeReference) * float64(sampleRate) / float64(dec.SampleRate())))
+		out.Bext = &bext
+	}
+	mw.SetWAVMetadata(&out)
+}
+
+// bextSize is the size of a bext chunk without coding history
+const bextSize = 602
+
+// parseBext decodes a bext chunk, returning nil if it's too short
+func parseBext(b []byte) *Bext {
+	if len(b) < bextSize {
+		return nil
+	}
+	bext := &Bext{
+		Description:          wavText(b[0:256]),
+		Originator:           wavText(b[256:288]),
+		OriginatorReference:  wavText(b[288:320]),
+		OriginationDate:      wavText(b[320:330]),
+		OriginationTime:      wavText(b[330:338]),
+		TimeReference:        binary.LittleEndian.Uint64(b[338:346]),
+		Version:              int(binary.LittleEndian.Uint16(b[346:348])),
+		LoudnessValue:        int16(binary.LittleEndian.Uint16(b[412:414])),
+		LoudnessRange:        int16(binary.LittleEndian.Uint16(b[414:416])),
+		MaxTruePeakLevel:     int16(binary.LittleEndian.Uint16(b[416:418])),
+		MaxMomentaryLoudness: int16(binary.LittleEndian.Uint16(b[418:420])),
+		MaxShortTermLoudness: int16(binary.LittleEndian.Uint16(b[420:422])),
+		CodingHistory:        wavText(b[bextSize:]),
+	}
+	copy(bext.UMID[:], b[348:412])
+	return bext
+}
+
+// marshal encodes the chunk's payload
+func (bext *Bext) marshal() []byte {
+	b := make([]byte, bextSize, bextSize+len(bext.CodingHistory))
+	putWAVText(b[0:256], bext.Description)
+	putWAVText(b[256:288], bext.Originator)
+	putWAVText(b[288:320], bext.OriginatorReference)
+	putWAVText(b[320:330], bext.OriginationDate)
+	putWAVText(b[330:338], bext.OriginationTime)
+	binary.LittleEndian.PutUint64(b[338:346], bext.TimeReference)
+	binary.LittleEndian.PutUint16(b[346:348], uint16(bext.Version))
+	copy(b[348:412], bext.UMID[:])
+	binary.LittleEndian.PutUint16(b[412:414], uint16(bext.LoudnessValue))
+	binary.LittleEndian.PutUint16(b[414:416], uint16(bext.LoudnessRange))
+	binary.LittleEndian.PutUint16(b[416:418], uint16(bext.MaxTruePeakLevel))
+	binary.LittleEndian.PutUint16(b[418:420], uint16(bext.MaxMomentaryLoudness))
+	binary.LittleEndian.PutUint16(b[420:422], uint16(bext.MaxShortTermLoudness))
+	return append(b, bext.CodingHistory...)
+}
+
+// infoNames maps LIST/INFO IDs to Vorbis comment names
+var infoNames = map[string]string{
+	"INAM": "TITLE",
+	"IART": "ARTIST",
+	"IPRD": "ALBUM",
+	"ICMT": "COMMENT",
+	"ICRD": "DATE",
+	"IGNR": "GENRE",
+	"ITRK": "TRACKNUMBER",
+	"ICOP": "COPYRIGHT",
+	"ISFT": "ENCODER",
+	"IENG": "ENGINEER",
+	"IKEY": "KEYWORDS",
+	"ISRC": "SOURCE",
+}
+
+// parseInfoList returns the fields of a LIST chunk of type INFO, nil for
+// other lists
+func parseInfoList(b []byte) Tags {
+	if len(b) < 4 || string(b[0:4]) != "INFO" {
+		return nil
+	}
+	var tags Tags
+	for b = b[4:]; len(b) >= 8; {
+		id := string(b[0:4])
+		size := int(binary.LittleEndian.Uint32(b[4:8]))
+		if size > len(b)-8 {
+			break
+		}
+		name, ok := infoNames[id]
+		if !ok {
+			name = id
+		}
+		tags.add(name, wavText(b[8:8+size]))
+		b = b[min(8+size+size%2, len(b)):]
+	}
+	return tags
+}
+
+// infoList encodes tags as a LIST/INFO payload. Tags without an INFO ID
+// are dropped; it returns nil if none are left.
+func infoList(tags Tags) []byte {
+	ids := make(map[string]string, len(infoNames))
+	for id, name := range infoNames {
+		ids[name] = id
+	}
+
+	b := []byte("INFO")
+	for _, tag := range tags {
+		id, ok := ids[tag[0]]
+		if !ok && isInfoID(tag[0]) {
+			id, ok = tag[0], true
+		}
+		if !ok || tag[1] == "" {
+			continue
+		}
+		// Values are NUL-terminated
+		size := len(tag[1]) + 1
+		b = appendChunkHeader(b, id, uint32(size))
+		b = append(b, tag[1]...)
+		b = append(b, make([]byte, 1+size%2)...)
+	}
+	if len(b) == 4 {
+		return nil
+	}
+	return b
+}
+
+// isInfoID reports whether a tag name is itself a LIST/INFO ID, such as
+// ISBJ or ITCH, that it can be written under. ISRC isn't: as a Vorbis
+// comment it's a recording code, not INFO's source.
+func isInfoID(name string) bool {
+	if len(name) != 4 || name[0] != 'I' {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return name != "ISRC"
+}
+
+// wavText decodes a NUL-padded text field: UTF-8 if it's valid, otherwise
+// Latin-1
+func wavText(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if utf8.Valid(b) {
+		return strings.TrimRight(string(b), " ")
+	}
+	return strings.TrimRight(decodeID3Text(id3Latin1, b), " ")
+}
+
+// putWAVText copies s into the fixed-width field b, stopping before a
+// UTF-8 character that doesn't fit whole
+func putWAVText(b []byte, s string) {
+	n := len(s)
+	if n > len(b) {
+		n = len(b)
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+	}
+	copy(b, s[:n])
+}
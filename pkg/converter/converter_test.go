@@ -1,11 +1,20 @@
 package converter
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/formeo/go-audio-converter/pkg/flacenc"
 )
 
 func TestDetectFormat(t *testing.T) {
@@ -17,6 +26,10 @@ func TestDetectFormat(t *testing.T) {
 		{"test.WAV", FormatWAV},
 		{"test.wave", FormatWAV},
 		{"path/to/file.wav", FormatWAV},
+		{"test.aif", FormatAIFF},
+		{"test.AIFF", FormatAIFF},
+		{"test.aifc", FormatAIFF},
+		{"test.w64", FormatW64},
 		{"test.mp3", FormatMP3},
 		{"test.MP3", FormatMP3},
 		{"test.flac", FormatFLAC},
@@ -51,6 +64,9 @@ func TestNew(t *testing.T) {
 	if c.OGGQuality != 0.4 {
 		t.Errorf("OGGQuality = %f, want 0.4", c.OGGQuality)
 	}
+	if c.FLACLevel != 5 {
+		t.Errorf("FLACLevel = %d, want 5", c.FLACLevel)
+	}
 }
 
 // generateTestWAV creates a valid WAV file with a sine wave
@@ -165,9 +181,116 @@ func TestDecodeWAV_Invalid(t *testing.T) {
 	}
 }
 
+// extensibleWAV builds a 16-bit stereo WAVE_FORMAT_EXTENSIBLE file with the
+// given SubFormat GUID and two frames of samples
+func extensibleWAV(subFormat [16]byte) []byte {
+	fmtChunk := make([]byte, 40)
+	binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatExtensible)
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], 2)
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], 44100)
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], 44100*4)
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], 4)
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], 16)
+	binary.LittleEndian.PutUint16(fmtChunk[16:18], 22)
+	binary.LittleEndian.PutUint16(fmtChunk[18:20], 16)
+	binary.LittleEndian.PutUint32(fmtChunk[20:24], 0x3)
+	copy(fmtChunk[24:40], subFormat[:])
+
+	data := []byte{0x10, 0x00, 0xF0, 0xFF, 0x00, 0x01, 0x00, 0xFF}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+8+len(fmtChunk)+8+len(data)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(fmtChunk)))
+	buf.Write(fmtChunk)
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestDecodeWAV_Extensible(t *testing.T) {
+	pcm, err := decodeWAV(bytes.NewReader(extensibleWAV(wavSubFormatPCM)))
+	if err != nil {
+		t.Fatalf("decodeWAV() error: %v", err)
+	}
+	if want := []int32{16, -16, 256, -256}; !reflect.DeepEqual(pcm.Samples, want) {
+		t.Errorf("Samples = %v, want %v", pcm.Samples, want)
+	}
+
+	// A-law sub-format
+	alaw := wavSubFormatPCM
+	alaw[0] = 0x06
+	if _, err := decodeWAV(bytes.NewReader(extensibleWAV(alaw))); err == nil {
+		t.Error("decodeWAV() should reject an A-law EXTENSIBLE sub-format")
+	}
+
+	// 16-bit float isn't a thing
+	if _, err := decodeWAV(bytes.NewReader(extensibleWAV(wavSubFormatFloat))); err == nil {
+		t.Error("decodeWAV() should reject 16-bit float")
+	}
+}
+
+// floatWAV returns a plain format 3 WAV holding samples as bits-wide floats
+func floatWAV(bits int, samples []float64) []byte {
+	var data bytes.Buffer
+	for _, f := range samples {
+		if bits == 32 {
+			binary.Write(&data, binary.LittleEndian, float32(f))
+		} else {
+			binary.Write(&data, binary.LittleEndian, f)
+		}
+	}
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatFloat)
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], 48000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], uint32(48000*bits/8))
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], uint16(bits/8))
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], uint16(bits))
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+8+len(fmtChunk)+12+8+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(fmtChunk)))
+	buf.Write(fmtChunk)
+	buf.WriteString("fact")
+	binary.Write(&buf, binary.LittleEndian, uint32(4))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(samples)))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestDecodeWAV_Float(t *testing.T) {
+	// Out of range samples clip, NaN is silence
+	in := []float64{0, 0.5, -1, 1.5, -2, math.NaN()}
+	want := []int32{0, 1 << 30, math.MinInt32, math.MaxInt32, math.MinInt32, 0}
+
+	for _, bits := range []int{32, 64} {
+		dec, err := newWAVDecoder(bytes.NewReader(floatWAV(bits, in)))
+		if err != nil {
+			t.Fatalf("%d-bit: newWAVDecoder() error: %v", bits, err)
+		}
+		if dec.BitDepth() != 32 || dec.FloatBits() != bits {
+			t.Errorf("%d-bit: BitDepth() = %d, FloatBits() = %d", bits, dec.BitDepth(), dec.FloatBits())
+		}
+		pcm, err := readAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pcm.Samples, want) {
+			t.Errorf("%d-bit: Samples = %v, want %v", bits, pcm.Samples, want)
+		}
+	}
+}
+
 func TestEncodeWAV(t *testing.T) {
 	pcm := &PCMData{
-		Samples:    []int16{0, 1000, 2000, 3000, -1000, -2000},
+		Samples:    []int32{0, 1000, 2000, 3000, -1000, -2000},
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -193,14 +316,14 @@ func TestEncodeWAV(t *testing.T) {
 
 func TestWAVRoundtrip(t *testing.T) {
 	original := &PCMData{
-		Samples:    make([]int16, 4410), // 50ms at 44100Hz stereo
+		Samples:    make([]int32, 4410), // 50ms at 44100Hz stereo
 		SampleRate: 44100,
 		Channels:   2,
 	}
 
 	// Fill with test pattern
 	for i := range original.Samples {
-		original.Samples[i] = int16(i % 32767)
+		original.Samples[i] = int32(i % 32767)
 	}
 
 	// Encode
@@ -237,7 +360,7 @@ func TestWAVRoundtrip(t *testing.T) {
 
 func TestEncodeWAV_EmptySamples(t *testing.T) {
 	pcm := &PCMData{
-		Samples:    []int16{},
+		Samples:    []int32{},
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -251,7 +374,7 @@ func TestEncodeWAV_EmptySamples(t *testing.T) {
 
 func TestEncodeMP3_EmptySamples(t *testing.T) {
 	pcm := &PCMData{
-		Samples:    []int16{},
+		Samples:    []int32{},
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -266,7 +389,7 @@ func TestEncodeMP3_EmptySamples(t *testing.T) {
 func TestEncodeOGG_NotImplemented(t *testing.T) {
 	c := New()
 	pcm := &PCMData{
-		Samples:    []int16{1, 2, 3, 4},
+		Samples:    []int32{1, 2, 3, 4},
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -280,7 +403,7 @@ func TestEncodeOGG_NotImplemented(t *testing.T) {
 
 func TestEncodeFLAC_NotImplemented(t *testing.T) {
 	pcm := &PCMData{
-		Samples:    []int16{1, 2, 3},
+		Samples:    []int32{1, 2, 3},
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -347,9 +470,334 @@ func TestConvertFile_WAVtoWAV(t *testing.T) {
 	}
 }
 
+func TestConvert_WAVtoWAV_Stream(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 300)
+
+	var out bytes.Buffer
+	c := New()
+	err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatWAV)
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	// Non-seekable output: sizes are left as "unknown" but the stream must still decode
+	if got := binary.LittleEndian.Uint32(out.Bytes()[40:44]); got != wavUnknownSize {
+		t.Errorf("data size = %#x, want %#x", got, wavUnknownSize)
+	}
+
+	original, err := decodeWAV(bytes.NewReader(wavData))
+	if err != nil {
+		t.Fatalf("decodeWAV(original) error: %v", err)
+	}
+	decoded, err := decodeWAV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeWAV(output) error: %v", err)
+	}
+	if len(decoded.Samples) != len(original.Samples) {
+		t.Fatalf("len(Samples) = %d, want %d", len(decoded.Samples), len(original.Samples))
+	}
+	for i := range original.Samples {
+		if decoded.Samples[i] != original.Samples[i] {
+			t.Fatalf("Sample[%d] = %d, want %d", i, decoded.Samples[i], original.Samples[i])
+		}
+	}
+}
+
+func TestConvert_WAVtoWAV_SeekableHeader(t *testing.T) {
+	wavData := generateTestWAV(22050, 1, 500)
+	outputPath := filepath.Join(t.TempDir(), "output.wav")
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, f, FormatWAV); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	f.Close()
+
+	outputData, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(withoutJUNK(t, outputData), wavData) {
+		t.Error("seekable output should have patched sizes and match the input byte for byte")
+	}
+}
+
+// withoutJUNK removes the JUNK chunk that seekable WAV output reserves for
+// a ds64 chunk, giving the canonical file
+func withoutJUNK(t *testing.T, data []byte) []byte {
+	t.Helper()
+	if len(data) < 48 || string(data[12:16]) != "JUNK" || binary.LittleEndian.Uint32(data[16:20]) != wavDS64Size {
+		t.Fatal("WAV has no JUNK chunk reserving space for ds64")
+	}
+	out := append(append([]byte(nil), data[:12]...), data[48:]...)
+	binary.LittleEndian.PutUint32(out[4:8], binary.LittleEndian.Uint32(data[4:8])-8-wavDS64Size)
+	return out
+}
+
+func TestConvert_WAVtoFLAC(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 200)
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatFLAC); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	original, _ := decodeWAV(bytes.NewReader(wavData))
+	decoded, err := decodeFLAC(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeFLAC() error: %v", err)
+	}
+	if len(decoded.Samples) != len(original.Samples) {
+		t.Fatalf("len(Samples) = %d, want %d", len(decoded.Samples), len(original.Samples))
+	}
+	for i := range original.Samples {
+		if decoded.Samples[i] != original.Samples[i] {
+			t.Fatalf("Sample[%d] = %d, want %d", i, decoded.Samples[i], original.Samples[i])
+		}
+	}
+}
+
+func TestConvert_FLACLevel(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 300)
+
+	sizes := map[int]int{}
+	for _, level := range []int{0, 8} {
+		var out bytes.Buffer
+		c := New()
+		c.FLACLevel = level
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatFLAC); err != nil {
+			t.Fatalf("level %d: Convert() error: %v", level, err)
+		}
+		sizes[level] = out.Len()
+	}
+	if sizes[8] >= sizes[0] {
+		t.Errorf("level 8 (%d bytes) should be smaller than level 0 (%d bytes)", sizes[8], sizes[0])
+	}
+
+	c := New()
+	c.FLACLevel = 9
+	err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatFLAC)
+	if err == nil {
+		t.Error("Convert() should reject FLAC level 9")
+	}
+}
+
+func TestConvert_FLACTags(t *testing.T) {
+	pcm, _ := decodeWAV(bytes.NewReader(generateTestWAV(44100, 2, 100)))
+	samples := pcm.Samples
+
+	enc := flacenc.NewEncoder(44100, 2, 16)
+	enc.VorbisComment = &flacenc.VorbisComment{
+		Vendor: "source encoder",
+		Tags:   [][2]string{{"title", "Tone"}, {"ARTIST", "A"}, {"ARTIST", "B"}},
+	}
+	var in bytes.Buffer
+	if err := enc.Encode(&in, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), &in, FormatFLAC, &out, FormatFLAC); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	dec, err := newFLACDecoder(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tags{{"TITLE", "Tone"}, {"ARTIST", "A"}, {"ARTIST", "B"}}
+	if !reflect.DeepEqual(dec.Tags(), want) {
+		t.Errorf("Tags() = %q, want %q", dec.Tags(), want)
+	}
+}
+
+func TestParseVorbisComments(t *testing.T) {
+	got := parseVorbisComments([]string{"Title=A=B", "no separator", "=empty", "ALBUM=", "BAD\x01=x"})
+	want := Tags{{"TITLE", "A=B"}, {"ALBUM", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseVorbisComments() = %q, want %q", got, want)
+	}
+}
+
+// hiResPCM returns a stereo tone using the full range of bitDepth, with
+// the low bits varying so nothing survives truncation to 16 bits
+func hiResPCM(bitDepth, frames int) *PCMData {
+	peak := float64(int64(1)<<(bitDepth-1) - 1)
+	samples := make([]int32, frames*2)
+	for i := range samples {
+		samples[i] = int32(peak*0.9*sinApprox(float64(i/2)*0.05)) + int32(i%7)
+	}
+	return &PCMData{Samples: samples, SampleRate: 96000, Channels: 2, BitDepth: bitDepth}
+}
+
+func TestConvert_HiResWAVtoFLAC(t *testing.T) {
+	original := hiResPCM(24, 5000)
+	var wavData bytes.Buffer
+	if err := encodeWAV(&wavData, original); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), &wavData, FormatWAV, &out, FormatFLAC); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	decoded, err := decodeFLAC(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeFLAC() error: %v", err)
+	}
+	if decoded.BitDepth != 24 {
+		t.Errorf("BitDepth = %d, want 24", decoded.BitDepth)
+	}
+	if !reflect.DeepEqual(decoded.Samples, original.Samples) {
+		t.Error("24-bit samples changed going through FLAC")
+	}
+}
+
+func TestConvert_32BitWAVtoFLAC(t *testing.T) {
+	original := hiResPCM(32, 3000)
+	var wavData bytes.Buffer
+	if err := encodeWAV(&wavData, original); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	c := New()
+	c.Dither = DitherNone
+	if err := c.Convert(context.Background(), &wavData, FormatWAV, &out, FormatFLAC); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	// The FLAC must be readable by this tool's own decoder
+	decoded, err := decodeFLAC(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeFLAC() error: %v", err)
+	}
+	if decoded.BitDepth != 24 {
+		t.Errorf("BitDepth = %d, want 24", decoded.BitDepth)
+	}
+	if !reflect.DeepEqual(decoded.Samples, convertBitDepth(original.Samples, 32, 24)) {
+		t.Error("FLAC samples aren't the 32-bit input truncated to 24 bits")
+	}
+}
+
+func TestConvert_HiResWAVtoWAV(t *testing.T) {
+	for _, bitDepth := range []int{8, 16, 24, 32} {
+		original := hiResPCM(bitDepth, 1001)
+		var wavData bytes.Buffer
+		if err := encodeWAV(&wavData, original); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "out.wav")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := New()
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData.Bytes()), FormatWAV, f, FormatWAV); err != nil {
+			t.Fatalf("%d bits: Convert() error: %v", bitDepth, err)
+		}
+		f.Close()
+
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(withoutJUNK(t, out), wavData.Bytes()) {
+			t.Errorf("%d bits: converted WAV differs from the input", bitDepth)
+		}
+
+		decoded, err := decodeWAV(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%d bits: decodeWAV() error: %v", bitDepth, err)
+		}
+		if decoded.BitDepth != bitDepth || !reflect.DeepEqual(decoded.Samples, original.Samples) {
+			t.Errorf("%d bits: samples changed in WAV roundtrip", bitDepth)
+		}
+	}
+}
+
+func TestConvert_HiResWAVtoMP3(t *testing.T) {
+	pcm := hiResPCM(24, 5000)
+	pcm.SampleRate = 48000
+	var wavData bytes.Buffer
+	if err := encodeWAV(&wavData, pcm); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), &wavData, FormatWAV, &out, FormatMP3); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if out.Len() == 0 {
+		t.Error("empty MP3 output")
+	}
+}
+
+func TestConvertBitDepth(t *testing.T) {
+	samples := []int32{-8388608, -1, 0, 256, 8388607}
+	narrow := convertBitDepth(samples, 24, 16)
+	if want := []int32{-32768, -1, 0, 1, 32767}; !reflect.DeepEqual(narrow, want) {
+		t.Errorf("24->16 = %v, want %v", narrow, want)
+	}
+	if wide := convertBitDepth(narrow, 16, 24); wide[4] != 32767<<8 {
+		t.Errorf("16->24 = %v", wide)
+	}
+}
+
+func TestConvert_WAVtoMP3(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 200)
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatMP3); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	decoded, err := decodeMP3(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeMP3() error: %v", err)
+	}
+	if len(decoded.Samples) == 0 {
+		t.Error("decoded MP3 has no samples")
+	}
+}
+
+func TestConvert_Canceled(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var out bytes.Buffer
+	c := New()
+	err := c.Convert(ctx, bytes.NewReader(wavData), FormatWAV, &out, FormatWAV)
+	if err != context.Canceled {
+		t.Errorf("Convert() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestConvert_OGGOutput(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 100)
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatOGG); err == nil {
+		t.Error("Convert() should fail for OGG output")
+	}
+}
+
 func TestPCMData(t *testing.T) {
 	pcm := &PCMData{
-		Samples:    []int16{1, 2, 3, 4},
+		Samples:    []int32{1, 2, 3, 4},
 		SampleRate: 48000,
 		Channels:   2,
 	}
@@ -365,13 +813,6 @@ func TestPCMData(t *testing.T) {
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // Benchmarks
 func BenchmarkDecodeWAV(b *testing.B) {
 	wavData := generateTestWAV(44100, 2, 1000) // 1 second
@@ -388,7 +829,7 @@ func BenchmarkDecodeWAV(b *testing.B) {
 
 func BenchmarkEncodeWAV(b *testing.B) {
 	pcm := &PCMData{
-		Samples:    make([]int16, 44100*2), // 1 second stereo
+		Samples:    make([]int32, 44100*2), // 1 second stereo
 		SampleRate: 44100,
 		Channels:   2,
 	}
@@ -401,3 +842,2012 @@ func BenchmarkEncodeWAV(b *testing.B) {
 		}
 	}
 }
+
+// ditherAll reduces samples from 24 to 16 bits in one chunk
+func ditherAll(t *testing.T, kind Dither, seed uint64, samples []int32) []int32 {
+	t.Helper()
+	d, err := newDitherer(kind, seed, 44100, 1, 24, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Process(&PCMData{Samples: samples, SampleRate: 44100, Channels: 1, BitDepth: 24}).Samples
+}
+
+func TestDither_Deterministic(t *testing.T) {
+	samples := hiResPCM(24, 2000).Samples[:2000]
+	for _, kind := range []Dither{DitherRectangular, DitherTriangular, DitherNoiseShaped} {
+		a := ditherAll(t, kind, 1, samples)
+		b := ditherAll(t, kind, 1, samples)
+		c := ditherAll(t, kind, 2, samples)
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: same seed gave different output", kind)
+		}
+		if reflect.DeepEqual(a, c) {
+			t.Errorf("%s: different seeds gave identical output", kind)
+		}
+	}
+}
+
+func TestDither_ErrorBounds(t *testing.T) {
+	// A constant between two 16-bit steps: truncation always rounds down,
+	// dither averages out to the true value
+	samples := make([]int32, 20000)
+	for i := range samples {
+		samples[i] = 1000<<8 + 64 // 1000.25 in 16-bit units
+	}
+
+	tests := []struct {
+		kind    Dither
+		maxErr  float64
+		meanErr float64
+	}{
+		{DitherNone, 0.25, 0.25},
+		{DitherRectangular, 0.75, 0.02},
+		{DitherTriangular, 1.25, 0.02},
+	}
+	for _, tt := range tests {
+		var sum float64
+		for _, s := range ditherAll(t, tt.kind, 7, samples) {
+			err := float64(s) - 1000.25
+			if math.Abs(err) > tt.maxErr {
+				t.Fatalf("%s: error %v exceeds %v LSB", tt.kind, err, tt.maxErr)
+			}
+			sum += err
+		}
+		if mean := math.Abs(sum / float64(len(samples))); mean > tt.meanErr {
+			t.Errorf("%s: mean error %v LSB, want <= %v", tt.kind, mean, tt.meanErr)
+		}
+	}
+}
+
+// lowPassPower returns the power of x below cutoff (a fraction of the
+// sample rate), measured through a Blackman-windowed sinc filter whose
+// sidelobes stay under -70 dB
+func lowPassPower(x []float64, cutoff float64) float64 {
+	const taps = 255
+	h := make([]float64, taps)
+	for i := range h {
+		n := float64(i - taps/2)
+		sinc := 2 * cutoff
+		if n != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*n) / (math.Pi * n)
+		}
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/(taps-1)) + 0.08*math.Cos(4*math.Pi*float64(i)/(taps-1))
+		h[i] = sinc * w
+	}
+
+	var power float64
+	for i := taps; i < len(x); i++ {
+		var y float64
+		for j, c := range h {
+			y += c * x[i-j]
+		}
+		power += y * y
+	}
+	return power / float64(len(x)-taps)
+}
+
+func TestDither_NoiseShaping(t *testing.T) {
+	// Quiet tone so the requantization error dominates
+	samples := make([]int32, 32768)
+	for i := range samples {
+		samples[i] = int32(2000 * sinApprox(float64(i)*0.01))
+	}
+
+	errPower := func(out []int32) float64 {
+		errs := make([]float64, len(out))
+		for i, s := range out {
+			errs[i] = float64(s) - float64(samples[i])/256
+		}
+		// The E-weighted filter lowers the noise by ~16 dB up to 5 kHz
+		return lowPassPower(errs, 5000.0/44100)
+	}
+
+	tpdf := errPower(ditherAll(t, DitherTriangular, 3, samples))
+	shaped := errPower(ditherAll(t, DitherNoiseShaped, 3, samples))
+	if shaped >= tpdf/10 {
+		t.Errorf("noise shaping left error power %.4f below 5 kHz, TPDF %.4f", shaped, tpdf)
+	}
+
+	// At rates the filter isn't designed for, noise-shaped is plain TPDF
+	d, _ := newDitherer(DitherNoiseShaped, 3, 96000, 1, 24, 16)
+	out := d.Process(&PCMData{Samples: samples, SampleRate: 96000, Channels: 1, BitDepth: 24}).Samples
+	if !reflect.DeepEqual(out, ditherAll(t, DitherTriangular, 3, samples)) {
+		t.Error("noise shaping at 96 kHz should fall back to TPDF")
+	}
+}
+
+func TestParseDither(t *testing.T) {
+	for name, want := range map[string]Dither{
+		"none": DitherNone, "rect": DitherRectangular, "tpdf": DitherTriangular,
+		"triangular": DitherTriangular, "shaped": DitherNoiseShaped, "noise-shaped": DitherNoiseShaped,
+	} {
+		if got, err := ParseDither(name); err != nil || got != want {
+			t.Errorf("ParseDither(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseDither("gaussian"); err == nil {
+		t.Error("ParseDither should reject unknown names")
+	}
+}
+
+func TestConvert_BitDepth(t *testing.T) {
+	original := hiResPCM(24, 3000)
+	var wavData bytes.Buffer
+	if err := encodeWAV(&wavData, original); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func(c *Converter, outFmt Format) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData.Bytes()), FormatWAV, &out, outFmt); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		return out.Bytes()
+	}
+
+	c := New()
+	c.BitDepth = 16
+	first := convert(c, FormatWAV)
+	if !bytes.Equal(first, convert(c, FormatWAV)) {
+		t.Error("dithered output isn't reproducible")
+	}
+
+	decoded, err := decodeWAV(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BitDepth != 16 {
+		t.Errorf("BitDepth = %d, want 16", decoded.BitDepth)
+	}
+	for i, s := range decoded.Samples {
+		if diff := s - original.Samples[i]>>8; diff < -1 || diff > 2 {
+			t.Fatalf("sample %d = %d, 24-bit source %d", i, s, original.Samples[i])
+		}
+	}
+
+	// Without dither, reduction is plain truncation
+	c.Dither = DitherNone
+	decoded, _ = decodeWAV(bytes.NewReader(convert(c, FormatWAV)))
+	if !reflect.DeepEqual(decoded.Samples, convertBitDepth(original.Samples, 24, 16)) {
+		t.Error("DitherNone should truncate")
+	}
+
+	// A zero-value Converter dithers too, like New()
+	zero := &Converter{BitDepth: 16}
+	if !bytes.Equal(convert(zero, FormatWAV), first) {
+		t.Error("zero-value Dither should be triangular")
+	}
+
+	// Widening is lossless
+	c.BitDepth = 32
+	decoded, _ = decodeWAV(bytes.NewReader(convert(c, FormatWAV)))
+	if !reflect.DeepEqual(decoded.Samples, convertBitDepth(original.Samples, 24, 32)) {
+		t.Error("32-bit WAV output should hold the 24-bit samples shifted up")
+	}
+	c.BitDepth = 24
+	flacOut, _ := decodeFLAC(bytes.NewReader(convert(c, FormatFLAC)))
+	if !reflect.DeepEqual(flacOut.Samples, original.Samples) {
+		t.Error("24-bit FLAC output changed the samples")
+	}
+
+	c.BitDepth = 12
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData.Bytes()), FormatWAV, io.Discard, FormatWAV); err == nil {
+		t.Error("Convert() should reject a 12-bit output")
+	}
+}
+
+// resampleTone resamples a 24-bit mono sine of the given frequency and
+// amplitude in uneven chunks, so state is carried across chunk borders
+func resampleTone(t *testing.T, quality ResampleQuality, from, to int, freq, amp float64, frames int) []int32 {
+	t.Helper()
+	r, err := newResampler(quality, from, to, 1, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make([]int32, frames)
+	for i := range samples {
+		samples[i] = int32(math.Round(amp * math.Sin(2*math.Pi*freq*float64(i)/float64(from))))
+	}
+
+	var out []int32
+	for len(samples) > 0 {
+		n := min(len(samples), 777)
+		out = append(out, r.Process(&PCMData{Samples: samples[:n], SampleRate: from, Channels: 1, BitDepth: 24}).Samples...)
+		samples = samples[n:]
+	}
+	return append(out, r.Flush().Samples...)
+}
+
+// toneAmplitude measures the amplitude of freq in the middle half of x,
+// through a Blackman window so other frequencies don't leak in
+func toneAmplitude(x []int32, freq float64, rate int) float64 {
+	var re, im, wsum float64
+	lo, hi := len(x)/4, len(x)*3/4
+	for i := lo; i < hi; i++ {
+		pos := float64(i-lo) / float64(hi-lo-1)
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*pos) + 0.08*math.Cos(4*math.Pi*pos)
+		phase := 2 * math.Pi * freq * float64(i) / float64(rate)
+		re += w * float64(x[i]) * math.Cos(phase)
+		im += w * float64(x[i]) * math.Sin(phase)
+		wsum += w
+	}
+	return 2 * math.Hypot(re, im) / wsum
+}
+
+// rmsAmplitude is the amplitude of a sine with the same power as the
+// middle half of x
+func rmsAmplitude(x []int32) float64 {
+	var sum float64
+	lo, hi := len(x)/4, len(x)*3/4
+	for _, s := range x[lo:hi] {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(2 * sum / float64(hi-lo))
+}
+
+func TestResample_PassbandAndAliasing(t *testing.T) {
+	const amp = 1 << 22
+
+	tests := []struct {
+		quality  ResampleQuality
+		passband float64 // fraction of the output Nyquist frequency
+		rippleDB float64
+		rejectDB float64
+	}{
+		{ResampleLow, 0.6, 0.02, 57},
+		{ResampleMedium, 0.8, 0.002, 77},
+		{ResampleHigh, 0.9, 0.0005, 97},
+	}
+	for _, rates := range [][2]int{{48000, 16000}, {44100, 8000}, {44100, 48000}} {
+		from, to := rates[0], rates[1]
+		nyquist := float64(min(from, to)) / 2
+
+		for _, tt := range tests {
+			// Stepped sweep through the passband
+			for f := 0.05; f <= tt.passband; f += 0.05 {
+				freq := f * nyquist
+				out := resampleTone(t, tt.quality, from, to, freq, amp, from/2)
+				gain := 20 * math.Log10(toneAmplitude(out, freq, to)/amp)
+				if math.Abs(gain) > tt.rippleDB {
+					t.Errorf("%s %d->%d: %.0f Hz gain %.4f dB, want within ±%v dB", tt.quality, from, to, freq, gain, tt.rippleDB)
+				}
+			}
+
+			// Sweep above the output Nyquist frequency: whatever comes
+			// out is aliased
+			if to > from {
+				continue
+			}
+			for f := 1.0; f < float64(from)/2*0.98; f += float64(from) / 2 / 40 {
+				freq := nyquist + f
+				out := resampleTone(t, tt.quality, from, to, freq, amp, from/2)
+				level := 20 * math.Log10(rmsAmplitude(out)/amp)
+				if level > -tt.rejectDB {
+					t.Errorf("%s %d->%d: %.0f Hz aliased at %.1f dB, want below -%v dB", tt.quality, from, to, freq, level, tt.rejectDB)
+				}
+			}
+		}
+	}
+}
+
+func TestResample_Upsampling(t *testing.T) {
+	// A 3 kHz tone at 8 kHz, upsampled: the image at 5 kHz must be gone
+	const amp = 1 << 22
+	out := resampleTone(t, ResampleMedium, 8000, 44100, 3000, amp, 8000)
+	if gain := toneAmplitude(out, 3000, 44100) / amp; math.Abs(20*math.Log10(gain)) > 0.01 {
+		t.Errorf("3 kHz gain %.4f, want 1", gain)
+	}
+	if image := 20 * math.Log10(toneAmplitude(out, 5000, 44100)/amp); image > -75 {
+		t.Errorf("5 kHz image at %.1f dB", image)
+	}
+}
+
+func TestResample_Length(t *testing.T) {
+	for _, quality := range []ResampleQuality{ResampleLinear, ResampleLow, ResampleHigh} {
+		for _, rates := range [][2]int{{44100, 8000}, {8000, 44100}, {44100, 44101}, {48000, 48000}} {
+			out := resampleTone(t, quality, rates[0], rates[1], 440, 1000, 10001)
+			want := (10001*rates[1] + rates[0] - 1) / rates[0]
+			if len(out) != want {
+				t.Errorf("%s %d->%d: %d frames, want %d", quality, rates[0], rates[1], len(out), want)
+			}
+		}
+	}
+}
+
+func TestResample_Linear(t *testing.T) {
+	// Upsampling by 4 places three interpolated samples between each pair
+	r, _ := newResampler(ResampleLinear, 1000, 4000, 1, 16)
+	out := r.Process(&PCMData{Samples: []int32{0, 400, -400}, SampleRate: 1000, Channels: 1, BitDepth: 16}).Samples
+	out = append(out, r.Flush().Samples...)
+	want := []int32{0, 100, 200, 300, 400, 200, 0, -200, -400, -300, -200, -100}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %v, want %v", out, want)
+	}
+}
+
+func TestParseResampleQuality(t *testing.T) {
+	for _, name := range []string{"linear", "low", "medium", "high"} {
+		if q, err := ParseResampleQuality(name); err != nil || string(q) != name {
+			t.Errorf("ParseResampleQuality(%q) = %q, %v", name, q, err)
+		}
+	}
+	if _, err := ParseResampleQuality("best"); err == nil {
+		t.Error("ParseResampleQuality should reject unknown names")
+	}
+}
+
+func TestConvert_SampleRate(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 500)
+
+	for _, outFmt := range []Format{FormatWAV, FormatFLAC, FormatMP3} {
+		c := New()
+		c.TargetSampleRate = 16000
+		c.Bitrate = 64 // 192 kbps is MPEG-1 only
+		var out bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, outFmt); err != nil {
+			t.Fatalf("%s: Convert() error: %v", outFmt, err)
+		}
+
+		if outFmt == FormatMP3 {
+			if _, err := decodeMP3(bytes.NewReader(out.Bytes())); err != nil {
+				t.Errorf("decodeMP3() error: %v", err)
+			}
+			continue
+		}
+		dec, err := newDecoder(bytes.NewReader(out.Bytes()), outFmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcm, err := readAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pcm.SampleRate != 16000 || len(pcm.Samples) != 8000*2 {
+			t.Errorf("%s: %d Hz, %d samples; want 16000 Hz, 16000 samples", outFmt, pcm.SampleRate, len(pcm.Samples))
+		}
+		// The 440 Hz tone survives
+		left := make([]int32, len(pcm.Samples)/2)
+		for i := range left {
+			left[i] = pcm.Samples[2*i]
+		}
+		if amp := toneAmplitude(left, 440, 16000); amp < 15000 || amp > 17000 {
+			t.Errorf("%s: 440 Hz amplitude %.0f, want ~16000", outFmt, amp)
+		}
+	}
+
+	c := New()
+	c.TargetSampleRate = 100
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatWAV); err == nil {
+		t.Error("Convert() should reject a 100 Hz output")
+	}
+}
+
+func TestStandardMix(t *testing.T) {
+	const g = math.Sqrt2 / 2
+	n := 1 / (1 + 2*g) // 5.1 rows sum to 1+2g before scaling
+
+	tests := []struct {
+		in, out int
+		want    [][]float64
+	}{
+		{2, 2, nil},
+		{1, 2, [][]float64{{1}, {1}}},
+		{2, 1, [][]float64{{0.5, 0.5}}},
+		{6, 2, [][]float64{
+			{n, 0, g * n, 0, g * n, 0},
+			{0, n, g * n, 0, 0, g * n},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := standardMix(tt.in, tt.out)
+		if err != nil {
+			t.Fatalf("%d->%d: %v", tt.in, tt.out, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%d->%d: %d rows, want %d", tt.in, tt.out, len(got), len(tt.want))
+		}
+		for o := range got {
+			for i := range got[o] {
+				if math.Abs(got[o][i]-tt.want[o][i]) > 1e-9 {
+					t.Errorf("%d->%d: matrix %v, want %v", tt.in, tt.out, got, tt.want)
+				}
+			}
+		}
+	}
+
+	if _, err := standardMix(2, 6); err == nil {
+		t.Error("standardMix should have no stereo to 5.1 upmix")
+	}
+}
+
+// surroundWAV returns a 16-bit 5.1 WAV where every channel holds its own
+// constant, and those constants
+func surroundWAV(t *testing.T, frames int) ([]byte, []int32) {
+	t.Helper()
+	levels := []int32{1000, -2000, 3000, 30000, 4000, -5000}
+	pcm := &PCMData{SampleRate: 48000, Channels: 6, BitDepth: 16}
+	for i := 0; i < frames; i++ {
+		pcm.Samples = append(pcm.Samples, levels...)
+	}
+	var buf bytes.Buffer
+	if err := encodeWAV(&buf, pcm); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), levels
+}
+
+func TestConvert_Channels(t *testing.T) {
+	wavData, levels := surroundWAV(t, 1000)
+	g := math.Sqrt2 / 2
+	n := 1 / (1 + 2*g)
+	wantL := int32(math.Round(n * (float64(levels[0]) + g*float64(levels[2]) + g*float64(levels[4]))))
+	wantR := int32(math.Round(n * (float64(levels[1]) + g*float64(levels[2]) + g*float64(levels[5]))))
+
+	convert := func(c *Converter, outFmt Format) *PCMData {
+		t.Helper()
+		var out bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, outFmt); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		dec, err := newDecoder(bytes.NewReader(out.Bytes()), outFmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcm, err := readAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pcm
+	}
+
+	// 5.1 to stereo FLAC with the standard downmix; the LFE is dropped
+	c := New()
+	c.Channels = 2
+	pcm := convert(c, FormatFLAC)
+	if pcm.Channels != 2 || len(pcm.Samples) != 2000 {
+		t.Fatalf("got %d channels, %d samples; want 2, 2000", pcm.Channels, len(pcm.Samples))
+	}
+	if pcm.Samples[0] != wantL || pcm.Samples[1] != wantR {
+		t.Errorf("downmix = %d, %d; want %d, %d", pcm.Samples[0], pcm.Samples[1], wantL, wantR)
+	}
+
+	// MP3 can't hold 5.1, so it's folded to stereo without asking
+	if mp3 := convert(New(), FormatMP3); mp3.Channels != 2 {
+		t.Errorf("MP3 from 5.1 has %d channels, want 2", mp3.Channels)
+	}
+
+	// A custom matrix: centre only, and front left/right swapped
+	c = New()
+	c.ChannelMatrix = [][]float64{{0, 0, 1, 0, 0, 0}, {0, 1, 0, 0, 0, 0}, {1, 0, 0, 0, 0, 0}}
+	pcm = convert(c, FormatWAV)
+	if want := []int32{levels[2], levels[1], levels[0]}; pcm.Channels != 3 || !reflect.DeepEqual(pcm.Samples[:3], want) {
+		t.Errorf("custom mix = %d channels %v, want 3 channels %v", pcm.Channels, pcm.Samples[:3], want)
+	}
+
+	for _, bad := range []*Converter{
+		{ChannelMatrix: [][]float64{{1, 0}}},
+		{ChannelMatrix: [][]float64{{1, 0, 0, 0, 0, 0}}, Channels: 2},
+		{Channels: 3},
+		{Channels: 9},
+	} {
+		if err := bad.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatWAV); err == nil {
+			t.Errorf("Convert() accepted Channels %d, matrix %v", bad.Channels, bad.ChannelMatrix)
+		}
+	}
+}
+
+// wavChunks returns the chunks of a RIFF/WAVE file by ID
+func wavChunks(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	chunks := map[string][]byte{}
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := min(pos+8+size, len(data))
+		chunks[id] = data[pos+8 : end]
+		pos = end + size%2
+	}
+	return chunks
+}
+
+func TestConvert_FloatWAV(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 200)
+	original, _ := decodeWAV(bytes.NewReader(wavData))
+
+	for _, bits := range []int{32, 64} {
+		path := filepath.Join(t.TempDir(), "float.wav")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := New()
+		c.Float = true
+		if bits == 64 {
+			c.BitDepth = 64
+		}
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, f, FormatWAV); err != nil {
+			t.Fatalf("%d-bit: Convert() error: %v", bits, err)
+		}
+		f.Close()
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunks := wavChunks(t, out)
+		frames := len(original.Samples) / 2
+		if tag := binary.LittleEndian.Uint16(chunks["fmt "]); tag != wavFormatFloat {
+			t.Errorf("%d-bit: format tag = %d, want %d", bits, tag, wavFormatFloat)
+		}
+		if got := binary.LittleEndian.Uint32(chunks["fact"]); got != uint32(frames) {
+			t.Errorf("%d-bit: fact frames = %d, want %d", bits, got, frames)
+		}
+		if got := binary.LittleEndian.Uint32(out[4:8]); got != uint32(len(out)-8) {
+			t.Errorf("%d-bit: RIFF size = %d, want %d", bits, got, len(out)-8)
+		}
+
+		// 16-bit samples are exact in float, so they come back shifted up
+		dec, err := newWAVDecoder(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec.FloatBits() != bits {
+			t.Errorf("FloatBits() = %d, want %d", dec.FloatBits(), bits)
+		}
+		pcm, err := readAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pcm.Samples, convertBitDepth(original.Samples, 16, 32)) {
+			t.Errorf("%d-bit: float samples don't match the 16-bit input", bits)
+		}
+
+		// Float input stays float without asking; FLAC gets 24-bit
+		// integers, exact without dither
+		var again bytes.Buffer
+		if err := New().Convert(context.Background(), bytes.NewReader(out), FormatWAV, &again, FormatWAV); err != nil {
+			t.Fatal(err)
+		}
+		if tag := binary.LittleEndian.Uint16(wavChunks(t, again.Bytes())["fmt "]); tag != wavFormatFloat {
+			t.Errorf("%d-bit float WAV to WAV gave format tag %d", bits, tag)
+		}
+		var flacOut bytes.Buffer
+		c = New()
+		c.Dither = DitherNone
+		if err := c.Convert(context.Background(), bytes.NewReader(out), FormatWAV, &flacOut, FormatFLAC); err != nil {
+			t.Fatal(err)
+		}
+		flacPCM, err := decodeFLAC(bytes.NewReader(flacOut.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flacPCM.BitDepth != 24 || !reflect.DeepEqual(flacPCM.Samples, convertBitDepth(original.Samples, 16, 24)) {
+			t.Errorf("%d-bit float WAV to FLAC: %d bits, or samples differ", bits, flacPCM.BitDepth)
+		}
+	}
+
+	for _, bad := range []*Converter{
+		{Float: true, BitDepth: 16},
+		{BitDepth: 64},
+	} {
+		if err := bad.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatWAV); err == nil {
+			t.Errorf("Convert() accepted Float %v, BitDepth %d", bad.Float, bad.BitDepth)
+		}
+	}
+	c := New()
+	c.Float = true
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatFLAC); err == nil {
+		t.Error("Convert() should refuse float FLAC")
+	}
+}
+
+// maskedWAV returns a 16-bit WAV with the given channel mask, where every
+// channel holds its own constant
+func maskedWAV(t *testing.T, mask uint32, levels []int32, frames int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := newWAVEncoder(&buf, wavFormat{sampleRate: 48000, channels: len(levels), bitDepth: 16, channelMask: mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := &PCMData{SampleRate: 48000, Channels: len(levels), BitDepth: 16}
+	for i := 0; i < frames; i++ {
+		pcm.Samples = append(pcm.Samples, levels...)
+	}
+	if err := encodeAll(enc, pcm); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert_ChannelMask(t *testing.T) {
+	// 5.1 with side rather than back surrounds
+	const sideMask = 0x60F
+	levels := []int32{1000, -2000, 3000, 30000, 4000, -5000}
+	wavData := maskedWAV(t, sideMask, levels, 500)
+
+	fmtChunk := wavChunks(t, wavData)["fmt "]
+	if tag := binary.LittleEndian.Uint16(fmtChunk); tag != wavFormatExtensible || len(fmtChunk) != 40 {
+		t.Fatalf("format tag %#x, fmt size %d; want EXTENSIBLE", tag, len(fmtChunk))
+	}
+
+	convert := func(data []byte, inFmt, outFmt Format) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := New().Convert(context.Background(), bytes.NewReader(data), inFmt, &out, outFmt); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		return out.Bytes()
+	}
+
+	// WAV to WAV, and through FLAC and back
+	flacData := convert(wavData, FormatWAV, FormatFLAC)
+	flacDec, err := newFLACDecoder(bytes.NewReader(flacData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flacDec.ChannelMask() != sideMask || len(flacDec.Tags()) != 0 {
+		t.Errorf("FLAC ChannelMask() = %#x, tags %v", flacDec.ChannelMask(), flacDec.Tags())
+	}
+	for _, out := range [][]byte{convert(wavData, FormatWAV, FormatWAV), convert(flacData, FormatFLAC, FormatWAV)} {
+		dec, err := newWAVDecoder(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec.ChannelMask() != sideMask {
+			t.Errorf("ChannelMask() = %#x, want %#x", dec.ChannelMask(), sideMask)
+		}
+		pcm, err := readAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pcm.Samples[:6], levels) {
+			t.Errorf("samples = %v, want %v", pcm.Samples[:6], levels)
+		}
+	}
+
+	// The default layout gets no tag
+	defaultFLAC := convert(maskedWAV(t, 0, levels, 10), FormatWAV, FormatFLAC)
+	if dec, err := newFLACDecoder(bytes.NewReader(defaultFLAC)); err != nil || dec.ChannelMask() != 0 {
+		t.Errorf("default layout FLAC: ChannelMask() = %#x, err %v", dec.ChannelMask(), err)
+	}
+
+	// Downmixes follow the mask: a back centre third channel goes to both
+	// sides at -6 dB, not -3 dB like the default layout's centre
+	c := New()
+	c.Channels = 2
+	var out bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(maskedWAV(t, 0x103, levels[:3], 100)), FormatWAV, &out, FormatWAV); err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := decodeWAV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantL := int32(math.Round((float64(levels[0]) + 0.5*float64(levels[2])) / 1.5))
+	wantR := int32(math.Round((float64(levels[1]) + 0.5*float64(levels[2])) / 1.5))
+	if pcm.Channels != 2 || pcm.Samples[0] != wantL || pcm.Samples[1] != wantR {
+		t.Errorf("downmix = %d channels %v, want %d, %d", pcm.Channels, pcm.Samples[:2], wantL, wantR)
+	}
+	if tag := binary.LittleEndian.Uint16(wavChunks(t, out.Bytes())["fmt "]); tag != wavFormatPCM {
+		t.Errorf("stereo downmix format tag = %#x, want plain PCM", tag)
+	}
+}
+
+func TestWAVHeader_RF64(t *testing.T) {
+	f := wavFormat{sampleRate: 48000, channels: 2, bitDepth: 24}
+	const big = 5 << 30
+
+	// Small files stay RIFF, with room kept for ds64 when asked
+	if hdr := f.header(1000, false, nil); string(hdr[0:4]) != "RIFF" || len(hdr) != 44 {
+		t.Errorf("small header: %q, %d bytes; want canonical RIFF", hdr[0:4], len(hdr))
+	}
+	reserved := f.header(-1, true, nil)
+	if string(reserved[0:4]) != "RIFF" || string(reserved[12:16]) != "JUNK" {
+		t.Errorf("reserved header starts %q, JUNK missing", reserved[0:16])
+	}
+
+	for _, reserve := range []bool{false, true} {
+		hdr := f.header(big, reserve, nil)
+		if string(hdr[0:4]) != "RF64" || string(hdr[12:16]) != "ds64" {
+			t.Fatalf("reserve %v: header starts %q, want RF64 with ds64", reserve, hdr[0:16])
+		}
+		if reserve && len(hdr) != len(reserved) {
+			t.Errorf("RF64 header is %d bytes, the reserved RIFF one %d", len(hdr), len(reserved))
+		}
+		ds64 := hdr[20:48]
+		if got, want := binary.LittleEndian.Uint64(ds64[0:8]), uint64(len(hdr)-8+big); got != want {
+			t.Errorf("reserve %v: ds64 RIFF size = %d, want %d", reserve, got, want)
+		}
+		if got := binary.LittleEndian.Uint64(ds64[8:16]); got != big {
+			t.Errorf("reserve %v: ds64 data size = %d, want %d", reserve, got, uint64(big))
+		}
+		if got := binary.LittleEndian.Uint64(ds64[16:24]); got != big/6 {
+			t.Errorf("reserve %v: ds64 sample count = %d, want %d", reserve, got, big/6)
+		}
+		if binary.LittleEndian.Uint32(hdr[4:8]) != wavUnknownSize || binary.LittleEndian.Uint32(hdr[len(hdr)-4:]) != wavUnknownSize {
+			t.Errorf("reserve %v: 32-bit sizes should be 0xFFFFFFFF", reserve)
+		}
+	}
+}
+
+func TestConvert_RF64(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 200)
+	original, _ := decodeWAV(bytes.NewReader(wavData))
+
+	for _, container := range []WAVContainer{WAVRF64, WAVBW64} {
+		c := New()
+		c.WAVContainer = container
+		path := filepath.Join(t.TempDir(), "out.wav")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, f, FormatWAV); err != nil {
+			t.Fatalf("%s: Convert() error: %v", container, err)
+		}
+		f.Close()
+		seekable, _ := os.ReadFile(path)
+
+		var streamed bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &streamed, FormatWAV); err != nil {
+			t.Fatalf("%s: Convert() error: %v", container, err)
+		}
+
+		// Trailing bytes show the sizes are used: the seekable output's
+		// ds64 says where the data ends, the streamed one's reads to EOF
+		for _, tc := range []struct {
+			out   []byte
+			extra int
+		}{{seekable, 0}, {streamed.Bytes(), 2}} {
+			if id := strings.ToLower(string(tc.out[0:4])); id != string(container) {
+				t.Errorf("file starts %q, want %s", tc.out[0:4], container)
+			}
+			if format, err := DetectFormatFromReader(bytes.NewReader(tc.out)); err != nil || format != FormatWAV {
+				t.Errorf("%s detected as %q, %v", container, format, err)
+			}
+			pcm, err := decodeWAV(bytes.NewReader(append(tc.out, 1, 2, 3, 4)))
+			if err != nil {
+				t.Fatalf("%s: decodeWAV() error: %v", container, err)
+			}
+			if len(pcm.Samples) != len(original.Samples)+tc.extra || !reflect.DeepEqual(pcm.Samples[:len(original.Samples)], original.Samples) {
+				t.Errorf("%s: decoded %d samples, want %d", container, len(pcm.Samples), len(original.Samples)+tc.extra)
+			}
+		}
+	}
+
+	if _, err := ParseWAVContainer("rf64"); err != nil {
+		t.Errorf("ParseWAVContainer(rf64) error: %v", err)
+	}
+	if _, err := ParseWAVContainer("w64"); err == nil {
+		t.Error("ParseWAVContainer(w64) should fail; Wave64 is an output format")
+	}
+}
+
+func TestConvert_W64(t *testing.T) {
+	// An odd frame count, so the data chunk needs padding
+	original := hiResPCM(16, 1001)
+	var wavBuf bytes.Buffer
+	if err := encodeWAV(&wavBuf, original); err != nil {
+		t.Fatal(err)
+	}
+	wavData := wavBuf.Bytes()
+
+	dir := t.TempDir()
+	wavPath := filepath.Join(dir, "in.wav")
+	if err := os.WriteFile(wavPath, wavData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w64Path := filepath.Join(dir, "out.w64")
+	c := New()
+	if err := c.ConvertFile(wavPath, w64Path); err != nil {
+		t.Fatalf("ConvertFile(wav, w64) error: %v", err)
+	}
+	out, _ := os.ReadFile(w64Path)
+
+	if !probeW64(out) {
+		t.Fatal("output has no Wave64 header")
+	}
+	if len(out)%8 != 0 {
+		t.Errorf("Wave64 output is %d bytes, not padded to a multiple of 8", len(out))
+	}
+	if got := binary.LittleEndian.Uint64(out[16:24]); got != uint64(len(out)) {
+		t.Errorf("riff size = %d, want the file's %d", got, len(out))
+	}
+	if format, err := DetectFormatFromReader(bytes.NewReader(out)); err != nil || format != FormatW64 {
+		t.Errorf("detected as %q, %v; want w64", format, err)
+	}
+	pcm, err := decodeWAV(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decodeWAV() error: %v", err)
+	}
+	if !reflect.DeepEqual(pcm.Samples, original.Samples) {
+		t.Error("Wave64 samples differ from the WAV input")
+	}
+
+	// Float mono, streamed and back
+	c.Float = true
+	c.Channels = 1
+	var streamed bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &streamed, FormatW64); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	var back bytes.Buffer
+	c = New()
+	c.Dither = DitherNone
+	c.BitDepth = 16
+	if err := c.Convert(context.Background(), bytes.NewReader(streamed.Bytes()), FormatW64, &back, FormatWAV); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	mono, err := decodeWAV(bytes.NewReader(back.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mono.Channels != 1 || len(mono.Samples) != 1001 {
+		t.Errorf("float Wave64 decoded as %d channels, %d samples", mono.Channels, len(mono.Samples))
+	}
+}
+
+func testBext() *Bext {
+	bext := &Bext{
+		Description:          "Scene 12, take 3",
+		Originator:           "Field recorder",
+		OriginatorReference:  "REF0001",
+		OriginationDate:      "2026-03-14",
+		OriginationTime:      "09:26:53",
+		TimeReference:        48000 * 3600,
+		Version:              2,
+		LoudnessValue:        -2310,
+		LoudnessRange:        450,
+		MaxTruePeakLevel:     -120,
+		MaxMomentaryLoudness: -1800,
+		MaxShortTermLoudness: -2000,
+		CodingHistory:        "A=PCM,F=48000,W=24,M=stereo,T=original\r\n",
+	}
+	copy(bext.UMID[:], "umid")
+	return bext
+}
+
+func TestBext(t *testing.T) {
+	bext := testBext()
+	b := bext.marshal()
+	if len(b) != bextSize+len(bext.CodingHistory) {
+		t.Fatalf("bext chunk is %d bytes, want %d", len(b), bextSize+len(bext.CodingHistory))
+	}
+	if got := parseBext(b); !reflect.DeepEqual(got, bext) {
+		t.Errorf("parseBext(marshal()) = %+v, want %+v", got, bext)
+	}
+	if parseBext(b[:bextSize-1]) != nil {
+		t.Error("parseBext() should reject a truncated chunk")
+	}
+
+	// A two-byte character straddling the end of a field is dropped whole
+	long := &Bext{
+		Description: strings.Repeat("a", 255) + "é",
+		Originator:  strings.Repeat("b", 30) + "ñø",
+	}
+	got := parseBext(long.marshal())
+	if want := strings.Repeat("a", 255); got.Description != want {
+		t.Errorf("Description = %q, want %q", got.Description, want)
+	}
+	if want := strings.Repeat("b", 30) + "ñ"; got.Originator != want {
+		t.Errorf("Originator = %q, want %q", got.Originator, want)
+	}
+}
+
+func TestInfoList(t *testing.T) {
+	tags := Tags{
+		{"TITLE", "Odd"},
+		{"ARTIST", "Even"},
+		{"ISBJ", "Subject"},
+		{"ISRC", "USRC17607839"}, // a recording code, which INFO has no field for
+		{"REPLAYGAIN_TRACK_GAIN", "-6.5 dB"},
+	}
+	b := infoList(tags)
+	// "Odd" and its NUL need no padding, "Even" and its NUL need a byte
+	if want := 4 + (8 + 4) + (8 + 6) + (8 + 8); len(b) != want {
+		t.Errorf("INFO list is %d bytes, want %d", len(b), want)
+	}
+	if got, want := parseInfoList(b), tags[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseInfoList() = %v, want %v", got, want)
+	}
+	if infoList(Tags{{"REPLAYGAIN_TRACK_GAIN", "-6.5 dB"}}) != nil {
+		t.Error("infoList() should be nil without INFO fields")
+	}
+	if parseInfoList([]byte("adtl")) != nil {
+		t.Error("parseInfoList() should skip other list types")
+	}
+}
+
+// bwfFile returns a 48 kHz WAV with a bext chunk and iXML before the audio
+// and a LIST/INFO chunk after it
+func bwfFile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := newWAVEncoder(&buf, wavFormat{sampleRate: 48000, channels: 2, bitDepth: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetWAVMetadata(&WAVMetadata{Bext: testBext(), IXML: "<BWFXML><PROJECT>Test</PROJECT></BWFXML>"})
+	pcm := hiResPCM(16, 4800)
+	pcm.SampleRate = 48000
+	if err := encodeAll(enc, pcm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed sizes are unknown; fill them in and add the trailing list
+	data := buf.Bytes()
+	dataSize := uint32(len(pcm.Samples) * 2)
+	binary.LittleEndian.PutUint32(data[len(data)-int(dataSize)-4:], dataSize)
+	info := infoList(Tags{{"TITLE", "Take 3"}, {"ENGINEER", "Sam"}})
+	data = appendChunkHeader(data, "LIST", uint32(len(info)))
+	data = append(data, info...)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
+
+func TestConvert_BWF(t *testing.T) {
+	in := bwfFile(t)
+
+	meta, err := ReadWAVMetadata(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("ReadWAVMetadata() error: %v", err)
+	}
+	want := &WAVMetadata{
+		Bext: testBext(),
+		IXML: "<BWFXML><PROJECT>Test</PROJECT></BWFXML>",
+		Info: Tags{{"TITLE", "Take 3"}, {"ENGINEER", "Sam"}},
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("ReadWAVMetadata() = %+v, want %+v", meta, want)
+	}
+	// Without seeking, the list after the audio isn't reached
+	if meta, err := ReadWAVMetadata(bufio.NewReader(bytes.NewReader(in))); err != nil || meta.Info != nil || meta.Bext == nil {
+		t.Errorf("ReadWAVMetadata(unseekable) = %+v, %v", meta, err)
+	}
+
+	// Resampled to 44.1 kHz: everything kept, the time reference rescaled
+	c := New()
+	c.TargetSampleRate = 44100
+	path := filepath.Join(t.TempDir(), "out.wav")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Convert(context.Background(), bytes.NewReader(in), FormatWAV, f, FormatWAV); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	f.Close()
+	out, _ := os.ReadFile(path)
+
+	meta, err = ReadWAVMetadata(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("ReadWAVMetadata() error: %v", err)
+	}
+	want.Bext.TimeReference = 44100 * 3600
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("converted metadata = %+v, want %+v", meta, want)
+	}
+	pcm, err := decodeWAV(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcm.SampleRate != 44100 || len(pcm.Samples) != 4410*2 {
+		t.Errorf("converted audio: %d Hz, %d samples", pcm.SampleRate, len(pcm.Samples))
+	}
+
+	// INFO fields are tags, so they reach FLAC and come back
+	var flacOut, back bytes.Buffer
+	if err := New().Convert(context.Background(), bytes.NewReader(in), FormatWAV, &flacOut, FormatFLAC); err != nil {
+		t.Fatal(err)
+	}
+	if err := New().Convert(context.Background(), bytes.NewReader(flacOut.Bytes()), FormatFLAC, &back, FormatWAV); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = ReadWAVMetadata(bytes.NewReader(back.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Bext != nil || !reflect.DeepEqual(meta.Info, want.Info) {
+		t.Errorf("WAV -> FLAC -> WAV metadata = %+v, want only INFO %v", meta, want.Info)
+	}
+
+	// Wave64 keeps bext alone
+	var w64 bytes.Buffer
+	if err := New().Convert(context.Background(), bytes.NewReader(in), FormatWAV, &w64, FormatW64); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = ReadWAVMetadata(bytes.NewReader(w64.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testBext(); !reflect.DeepEqual(meta, &WAVMetadata{Bext: want}) {
+		t.Errorf("Wave64 metadata = %+v, want bext only", meta)
+	}
+}
+
+func TestConvert_MonoMP3(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 300)
+
+	c := New()
+	c.Channels = 1
+	var mp3 bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &mp3, FormatMP3); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+
+	// go-mp3 decodes to stereo; the decoder reports the stream's one channel
+	decoded, err := decodeMP3(bytes.NewReader(mp3.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeMP3() error: %v", err)
+	}
+	if decoded.Channels != 1 {
+		t.Errorf("Channels = %d, want 1", decoded.Channels)
+	}
+	if amp := toneAmplitude(decoded.Samples, 440, 44100); amp < 12000 {
+		t.Errorf("440 Hz amplitude %.0f, want ~16000", amp)
+	}
+
+	// Back up to stereo by copying
+	c.Channels = 2
+	var wav bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(mp3.Bytes()), FormatMP3, &wav, FormatWAV); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	stereo, _ := decodeWAV(bytes.NewReader(wav.Bytes()))
+	if stereo.Channels != 2 || len(stereo.Samples) != 2*len(decoded.Samples) {
+		t.Fatalf("got %d channels, %d samples", stereo.Channels, len(stereo.Samples))
+	}
+	for i, s := range decoded.Samples {
+		if stereo.Samples[2*i] != s || stereo.Samples[2*i+1] != s {
+			t.Fatalf("frame %d = %d, %d; want %d in both", i, stereo.Samples[2*i], stereo.Samples[2*i+1], s)
+		}
+	}
+}
+
+// mp3FrameBitrates walks an MP3's audio frames, after the Xing frame, and
+// returns their bitrates
+func mp3FrameBitrates(t *testing.T, data []byte) []int {
+	t.Helper()
+	var rates []int
+	for pos := 0; pos < len(data); {
+		h, ok := parseMPEGHeader(data[pos:])
+		if !ok {
+			t.Fatalf("no frame header at byte %d of %d", pos, len(data))
+		}
+		if _, xing := parseXing(data[pos : pos+h.frameSize()]); !xing {
+			rates = append(rates, h.bitrate)
+		} else if pos != 0 {
+			t.Errorf("Xing frame at byte %d", pos)
+		}
+		pos += h.frameSize()
+	}
+	return rates
+}
+
+// mixedContentWAV is a second each of silence, a quiet tone and loud noise
+func mixedContentWAV(t *testing.T) []byte {
+	t.Helper()
+	pcm := &PCMData{SampleRate: 44100, Channels: 2, BitDepth: 16}
+	rng := uint32(1)
+	for i := 0; i < 3*44100; i++ {
+		var s int32
+		switch i / 44100 {
+		case 1:
+			s = int32(3000 * math.Sin(2*math.Pi*440*float64(i)/44100))
+		case 2:
+			rng = rng*1664525 + 1013904223
+			s = int32(int16(rng>>16)) / 2
+		}
+		pcm.Samples = append(pcm.Samples, s, s)
+	}
+	var buf bytes.Buffer
+	if err := encodeWAV(&buf, pcm); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert_MP3Bitrate(t *testing.T) {
+	wavData := mixedContentWAV(t)
+	encode := func(c *Converter) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatMP3); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		if _, err := decodeMP3(bytes.NewReader(out.Bytes())); err != nil {
+			t.Fatalf("decodeMP3() error: %v", err)
+		}
+		return out.Bytes()
+	}
+	mean := func(rates []int) float64 {
+		var sum int
+		for _, r := range rates {
+			sum += r
+		}
+		return float64(sum) / float64(len(rates))
+	}
+
+	// CBR: every frame at Bitrate
+	for _, kbps := range []int{32, 128, 320} {
+		c := New()
+		c.Bitrate = kbps
+		for i, r := range mp3FrameBitrates(t, encode(c)) {
+			if r != kbps {
+				t.Fatalf("CBR %d: frame %d at %d kbps", kbps, i, r)
+			}
+		}
+	}
+
+	// VBR: silence cheap, noise expensive, lower quality smaller
+	c := New()
+	c.MP3Mode = MP3VBR
+	c.VBRQuality = 2
+	rates := mp3FrameBitrates(t, encode(c))
+	third := len(rates) / 3
+	silence, tone, noise := mean(rates[5:third-5]), mean(rates[third+5:2*third-5]), mean(rates[2*third+5:len(rates)-5])
+	if !(silence < tone && tone < noise) {
+		t.Errorf("VBR mean bitrates: silence %.0f, tone %.0f, noise %.0f; want increasing", silence, tone, noise)
+	}
+	c.VBRQuality = 8
+	if low := mean(mp3FrameBitrates(t, encode(c))); low >= mean(rates) {
+		t.Errorf("VBR quality 8 averages %.0f kbps, quality 2 %.0f", low, mean(rates))
+	}
+
+	// ABR: varies per frame, averages near the target
+	c = New()
+	c.MP3Mode = MP3ABR
+	c.Bitrate = 128
+	rates = mp3FrameBitrates(t, encode(c))
+	if avg := mean(rates); math.Abs(avg-128) > 128*0.1 {
+		t.Errorf("ABR 128 averages %.1f kbps", avg)
+	}
+	if mean(rates[:third]) >= mean(rates[2*third:]) {
+		t.Error("ABR should spend more on noise than on silence")
+	}
+}
+
+func TestConvert_MP3BitrateInvalid(t *testing.T) {
+	wavData := generateTestWAV(22050, 1, 100)
+	for _, c := range []*Converter{
+		{MP3Mode: MP3CBR, Bitrate: 192}, // MPEG-1 only
+		{MP3Mode: MP3CBR, Bitrate: 100},
+		{MP3Mode: MP3ABR, Bitrate: 0},
+		{MP3Mode: MP3VBR, VBRQuality: 10},
+		{MP3Mode: "crf", Bitrate: 64},
+	} {
+		if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatMP3); err == nil {
+			t.Errorf("Convert() accepted mode %q, bitrate %d, quality %d at 22050 Hz", c.MP3Mode, c.Bitrate, c.VBRQuality)
+		}
+	}
+
+	c := New()
+	c.Bitrate = 160
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, io.Discard, FormatMP3); err != nil {
+		t.Errorf("160 kbps at 22050 Hz: %v", err)
+	}
+}
+
+func TestParseMP3Mode(t *testing.T) {
+	for _, name := range []string{"cbr", "vbr", "abr"} {
+		if m, err := ParseMP3Mode(name); err != nil || string(m) != name {
+			t.Errorf("ParseMP3Mode(%q) = %q, %v", name, m, err)
+		}
+	}
+	if _, err := ParseMP3Mode("crf"); err == nil {
+		t.Error("ParseMP3Mode should reject unknown modes")
+	}
+}
+
+// id3v23Tag builds an ID3v2.3 tag the way older taggers write it: UTF-16
+// text, TYER, a "(n)" genre reference and tag-wide unsynchronisation
+func id3v23Tag() []byte {
+	utf16le := func(s string) []byte {
+		b := []byte{0xFF, 0xFE}
+		for _, r := range s {
+			b = append(b, byte(r), byte(r>>8))
+		}
+		return b
+	}
+	var body []byte
+	frame := func(id string, data []byte) {
+		hdr := make([]byte, 10)
+		copy(hdr, id)
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(data)))
+		body = append(append(body, hdr...), data...)
+	}
+	frame("TIT2", append([]byte{1}, utf16le("Ünïcode")...))
+	frame("TPE1", []byte("\x00Artist"))
+	frame("TRCK", []byte("\x007/12"))
+	frame("TYER", []byte("\x001999"))
+	frame("TCON", []byte("\x00(17)"))
+	frame("COMM", []byte("\x00engiTunNORM\x00 0000"))
+	frame("COMM", []byte("\x00eng\x00Nice"))
+	frame("TXXX", []byte("\x00replaygain_track_gain\x00-6.00 dB"))
+	frame("APIC", []byte("\x00image/png\x00\x03cover\x00\x89PNG\xFF\xE0"))
+	body = append(body, make([]byte, 16)...) // padding
+
+	// Unsynchronise: a zero after every 0xFF
+	var unsynced []byte
+	for _, b := range body {
+		unsynced = append(unsynced, b)
+		if b == 0xFF {
+			unsynced = append(unsynced, 0)
+		}
+	}
+	hdr := []byte{'I', 'D', '3', 3, 0, 0x80, 0, 0, 0, 0}
+	putSynchsafe(hdr[6:], len(unsynced))
+	return append(hdr, unsynced...)
+}
+
+func TestReadID3v2(t *testing.T) {
+	id3, err := readID3v2(bufio.NewReader(bytes.NewReader(append(id3v23Tag(), 0xFF, 0xFB))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tags{
+		{"TITLE", "Ünïcode"}, {"ARTIST", "Artist"}, {"TRACKNUMBER", "7"}, {"TRACKTOTAL", "12"},
+		{"DATE", "1999"}, {"GENRE", "Rock"}, {"COMMENT", "Nice"}, {"REPLAYGAIN_TRACK_GAIN", "-6.00 dB"},
+	}
+	if !reflect.DeepEqual(id3.tags, want) {
+		t.Errorf("tags = %q, want %q", id3.tags, want)
+	}
+	wantPic := []Picture{{Type: 3, MIME: "image/png", Description: "cover", Data: []byte("\x89PNG\xFF\xE0")}}
+	if !reflect.DeepEqual(id3.pictures, wantPic) {
+		t.Errorf("pictures = %+v, want %+v", id3.pictures, wantPic)
+	}
+}
+
+func TestID3v2_Roundtrip(t *testing.T) {
+	tags := Tags{
+		{"TITLE", "Tøne 🎵"}, {"ARTIST", "A"}, {"ARTIST", "B"}, {"TRACKNUMBER", "3"}, {"TRACKTOTAL", "9"},
+		{"DATE", "2024-05-01"}, {"COMMENT", "c"}, {"MOOD", "calm"},
+	}
+	pictures := []Picture{{Type: 3, MIME: "image/jpeg", Description: "front", Data: []byte{0xFF, 0xD8, 0, 0xFF}}}
+	var buf bytes.Buffer
+	if err := writeID3v2(&buf, tags, pictures); err != nil {
+		t.Fatal(err)
+	}
+	id3, err := readID3v2(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(id3.tags, tags) {
+		t.Errorf("tags = %q, want %q", id3.tags, tags)
+	}
+	if !reflect.DeepEqual(id3.pictures, pictures) {
+		t.Errorf("pictures = %+v, want %+v", id3.pictures, pictures)
+	}
+}
+
+func TestID3v1(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("audio")
+	tags := Tags{{"TITLE", "A title longer than the thirty bytes ID3v1 has"}, {"ARTIST", "Bjørk"}, {"DATE", "1997"}, {"TRACKNUMBER", "4/10"}, {"GENRE", "pop"}}
+	if err := writeID3v1(&buf, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	got, err := readID3v1(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tags{{"TITLE", "A title longer than the thirty"}, {"ARTIST", "Bjørk"}, {"DATE", "1997"}, {"TRACKNUMBER", "4"}, {"GENRE", "Pop"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readID3v1() = %q, want %q", got, want)
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Errorf("readID3v1 left the reader at %d", pos)
+	}
+	if got, _ := readID3v1(bytes.NewReader([]byte("short"))); got != nil {
+		t.Errorf("readID3v1() on a short file = %q", got)
+	}
+}
+
+func TestConvert_MP3Tags(t *testing.T) {
+	cover := Picture{Type: 3, MIME: "image/png", Description: "", Data: []byte("\x89PNG\r\n\x1a\nfake")}
+	pcm, _ := decodeWAV(bytes.NewReader(generateTestWAV(44100, 2, 300)))
+	enc := flacenc.NewEncoder(44100, 2, 16)
+	enc.VorbisComment = &flacenc.VorbisComment{Tags: [][2]string{
+		{"TITLE", "Tone"}, {"ARTIST", "A"}, {"ALBUM", "Tests"}, {"TRACKNUMBER", "2"}, {"TRACKTOTAL", "5"},
+	}}
+	enc.Pictures = []flacenc.Picture{{Type: flacenc.PictureFrontCover, MIME: cover.MIME, Data: cover.Data}}
+	var flacIn bytes.Buffer
+	if err := enc.Encode(&flacIn, pcm.Samples); err != nil {
+		t.Fatal(err)
+	}
+	want := Tags{{"TITLE", "Tone"}, {"ARTIST", "A"}, {"ALBUM", "Tests"}, {"TRACKNUMBER", "2"}, {"TRACKTOTAL", "5"}}
+
+	// FLAC -> MP3
+	var mp3Out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), &flacIn, FormatFLAC, &mp3Out, FormatMP3); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	mp3Dec, err := newMP3Decoder(bytes.NewReader(mp3Out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mp3Dec.Tags(), want) {
+		t.Errorf("MP3 tags = %q, want %q", mp3Dec.Tags(), want)
+	}
+	if !reflect.DeepEqual(mp3Dec.Pictures(), []Picture{cover}) {
+		t.Errorf("MP3 pictures = %+v", mp3Dec.Pictures())
+	}
+	if !bytes.Equal(mp3Out.Bytes()[mp3Out.Len()-id3v1Size:][:3], []byte("TAG")) {
+		t.Error("no ID3v1 tag at the end of the MP3")
+	}
+
+	// MP3 -> FLAC, decoding through both tags
+	var flacOut bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(mp3Out.Bytes()), FormatMP3, &flacOut, FormatFLAC); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	flacDec, err := newFLACDecoder(bytes.NewReader(flacOut.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(flacDec.Tags(), want) {
+		t.Errorf("FLAC tags = %q, want %q", flacDec.Tags(), want)
+	}
+	if !reflect.DeepEqual(flacDec.Pictures(), []Picture{cover}) {
+		t.Errorf("FLAC pictures = %+v", flacDec.Pictures())
+	}
+}
+
+func TestXingHeader(t *testing.T) {
+	model := []byte{0xFF, 0xFB, 0x90, 0x64} // MPEG-1 Layer III, 128 kbps, 44.1 kHz, joint stereo
+	x := xingHeader{vbr: true, method: lameVBR, bitrate: 32, delay: 528, padding: 1300}
+	sizes := make([]uint32, 250)
+	for i := range sizes {
+		sizes[i] = uint32(104 + i%3*313)
+	}
+
+	placeholder := x.marshal(model, 128, mpeg1Bitrates)
+	got, ok := parseXing(placeholder)
+	if !ok || !got.lame || got.flags != 0 || got.delay != 528 {
+		t.Fatalf("placeholder parsed as %+v, %v", got, ok)
+	}
+	if skip, keep := got.trimFrames(1152); skip != 528+mp3DecoderDelay || keep != -1 {
+		t.Errorf("placeholder trimFrames() = %d, %d", skip, keep)
+	}
+
+	x.setTOC(len(placeholder), sizes)
+	frame := x.marshal(model, 128, mpeg1Bitrates)
+	if len(frame) != len(placeholder) {
+		t.Fatalf("Xing frame size changed from %d to %d bytes", len(placeholder), len(frame))
+	}
+	got, ok = parseXing(frame)
+	if !ok {
+		t.Fatal("parseXing() rejected the frame")
+	}
+	want := x
+	want.flags = xingFrames | xingBytes | xingTOC
+	want.lame = true
+	if *got != want {
+		t.Errorf("parseXing() = %+v, want %+v", *got, want)
+	}
+	if got.toc[0] != byte(len(frame)*256/int(got.bytes)) || got.toc[99] < got.toc[50] {
+		t.Errorf("TOC = %v", got.toc)
+	}
+	if skip, keep := got.trimFrames(1152); skip != 528+mp3DecoderDelay || keep != 250*1152-528-1300 {
+		t.Errorf("trimFrames() = %d, %d", skip, keep)
+	}
+
+	// A corrupted LAME tag is ignored
+	h, _ := parseMPEGHeader(model)
+	frame[xingOffset(h)+8+108+21] ^= 0xFF // delay
+	if got, _ := parseXing(frame); got.lame {
+		t.Error("LAME tag with a bad CRC was trusted")
+	}
+	if _, ok := parseXing(append(model, make([]byte, 413)...)); ok {
+		t.Error("parseXing() accepted an audio frame")
+	}
+}
+
+// correlationLag returns the shift of got against want, within ±max
+// samples, that correlates best
+func correlationLag(want, got []int32, maxLag int) int {
+	best, bestLag := math.Inf(-1), 0
+	for lag := -maxLag; lag <= maxLag; lag++ {
+		var sum float64
+		for i := maxLag; i < len(want)-maxLag && i+lag < len(got); i++ {
+			sum += float64(want[i]) * float64(got[i+lag])
+		}
+		if sum > best {
+			best, bestLag = sum, lag
+		}
+	}
+	return bestLag
+}
+
+func TestConvert_MP3Gapless(t *testing.T) {
+	for _, tc := range []struct {
+		rate, channels, frames int
+		mode                   MP3Mode
+	}{
+		{44100, 2, 44100, MP3CBR},
+		{44100, 1, 1152 * 10, MP3VBR},
+		{22050, 2, 10000, MP3ABR},
+		{48000, 1, 100, MP3CBR},
+	} {
+		in := &PCMData{SampleRate: tc.rate, Channels: tc.channels, BitDepth: 16}
+		rng := uint32(1)
+		for i := 0; i < tc.frames*tc.channels; i++ {
+			rng = rng*1664525 + 1013904223
+			in.Samples = append(in.Samples, int32(int16(rng>>16))/4)
+		}
+		var wavIn bytes.Buffer
+		if err := encodeWAV(&wavIn, in); err != nil {
+			t.Fatal(err)
+		}
+
+		// Seekable output gets its Xing frame patched
+		path := filepath.Join(t.TempDir(), "out.mp3")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := New()
+		c.MP3Mode = tc.mode
+		c.Bitrate = 64
+		if err := c.Convert(context.Background(), &wavIn, FormatWAV, f, FormatMP3); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		f.Close()
+		mp3Data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, _ := parseMPEGHeader(mp3Data)
+		x, ok := parseXing(mp3Data[:h.frameSize()])
+		if !ok || !x.lame {
+			t.Fatalf("%+v: no Xing frame with a LAME tag", tc)
+		}
+		if x.vbr != (tc.mode != MP3CBR) {
+			t.Errorf("%+v: Xing tag vbr = %v", tc, x.vbr)
+		}
+		if audio := mp3FrameBitrates(t, mp3Data); x.frames != len(audio) || x.bytes != int64(len(mp3Data)) {
+			t.Errorf("%+v: Xing frames %d, bytes %d; stream has %d frames, %d bytes", tc, x.frames, x.bytes, len(audio), len(mp3Data))
+		}
+
+		var wavOut bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(mp3Data), FormatMP3, &wavOut, FormatWAV); err != nil {
+			t.Fatalf("Convert() error: %v", err)
+		}
+		out, err := decodeWAV(&wavOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Samples) != len(in.Samples) {
+			t.Errorf("%+v: decoded %d samples, want %d", tc, len(out.Samples), len(in.Samples))
+		}
+		if lag := correlationLag(in.Samples, out.Samples, 20*tc.channels); lag != 0 && tc.frames > 1000 {
+			t.Errorf("%+v: decoded audio is %d samples off", tc, lag/tc.channels)
+		}
+	}
+}
+
+func TestConvert_MP3GaplessUnseekable(t *testing.T) {
+	wavData := generateTestWAV(44100, 1, 500)
+	in, _ := decodeWAV(bytes.NewReader(wavData))
+	var mp3Out, wavOut bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &mp3Out, FormatMP3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Convert(context.Background(), &mp3Out, FormatMP3, &wavOut, FormatWAV); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := decodeWAV(&wavOut)
+
+	// The start is trimmed; without a frame count the padding stays
+	if len(out.Samples) < len(in.Samples) || len(out.Samples) > len(in.Samples)+2*1152 {
+		t.Errorf("decoded %d samples from %d", len(out.Samples), len(in.Samples))
+	}
+	if lag := correlationLag(in.Samples, out.Samples, 20); lag != 0 {
+		t.Errorf("decoded audio is %d samples off", lag)
+	}
+}
+
+func TestExtended(t *testing.T) {
+	for _, tt := range []struct {
+		rate float64
+		want []byte
+	}{
+		// Reference encodings from files written by macOS tools
+		{44100, []byte{0x40, 0x0E, 0xAC, 0x44, 0, 0, 0, 0, 0, 0}},
+		{48000, []byte{0x40, 0x0E, 0xBB, 0x80, 0, 0, 0, 0, 0, 0}},
+		{8000, []byte{0x40, 0x0B, 0xFA, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		b := make([]byte, 10)
+		putExtended(b, tt.rate)
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("putExtended(%v) = % x, want % x", tt.rate, b, tt.want)
+		}
+		if got := parseExtended(tt.want); got != tt.rate {
+			t.Errorf("parseExtended(% x) = %v, want %v", tt.want, got, tt.rate)
+		}
+	}
+	for _, rate := range []float64{1, 11025, 22050, 96000, 192000, 0.5, 2822400} {
+		b := make([]byte, 10)
+		putExtended(b, rate)
+		if got := parseExtended(b); got != rate {
+			t.Errorf("extended round trip of %v = %v", rate, got)
+		}
+	}
+}
+
+func TestConvert_WAVtoAIFF_Stream(t *testing.T) {
+	wavData := generateTestWAV(44100, 2, 300)
+
+	var out bytes.Buffer
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(wavData), FormatWAV, &out, FormatAIFF); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if string(out.Bytes()[0:4]) != "FORM" || string(out.Bytes()[8:12]) != "AIFF" {
+		t.Fatal("output is not an AIFF file")
+	}
+	// Non-seekable output: sizes are left as "unknown" but the stream must still decode
+	if got := binary.BigEndian.Uint32(out.Bytes()[42:46]); got != aiffUnknownSize {
+		t.Errorf("SSND size = %#x, want %#x", got, aiffUnknownSize)
+	}
+
+	original, _ := decodeWAV(bytes.NewReader(wavData))
+	decoded, err := decodeAIFF(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeAIFF() error: %v", err)
+	}
+	if decoded.SampleRate != 44100 || decoded.Channels != 2 || decoded.BitDepth != 16 {
+		t.Errorf("format = %d Hz, %d channels, %d bits", decoded.SampleRate, decoded.Channels, decoded.BitDepth)
+	}
+	if !reflect.DeepEqual(decoded.Samples, original.Samples) {
+		t.Error("AIFF samples differ from the WAV input")
+	}
+}
+
+func TestConvert_AIFF_SeekableHeader(t *testing.T) {
+	for _, bits := range []int{8, 16, 24, 32} {
+		pcm := hiResPCM(bits, 1001)
+		pcm.Channels = 1
+		var wavIn bytes.Buffer
+		if err := encodeWAV(&wavIn, pcm); err != nil {
+			t.Fatal(err)
+		}
+
+		aiffPath := filepath.Join(t.TempDir(), "output.aiff")
+		f, err := os.Create(aiffPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := New()
+		if err := c.Convert(context.Background(), bytes.NewReader(wavIn.Bytes()), FormatWAV, f, FormatAIFF); err != nil {
+			t.Fatalf("%d bits: Convert() error: %v", bits, err)
+		}
+		f.Close()
+
+		data, err := os.ReadFile(aiffPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataSize := len(pcm.Samples) * bits / 8
+		if want := aiffHeaderSize + dataSize + dataSize%2; len(data) != want {
+			t.Errorf("%d bits: file is %d bytes, want %d", bits, len(data), want)
+		}
+		if got := binary.BigEndian.Uint32(data[4:8]); int(got) != len(data)-8 {
+			t.Errorf("%d bits: FORM size = %d, want %d", bits, got, len(data)-8)
+		}
+		if got := binary.BigEndian.Uint32(data[22:26]); int(got) != len(pcm.Samples) {
+			t.Errorf("%d bits: sample frames = %d, want %d", bits, got, len(pcm.Samples))
+		}
+		if got := binary.BigEndian.Uint32(data[42:46]); int(got) != 8+dataSize {
+			t.Errorf("%d bits: SSND size = %d, want %d", bits, got, 8+dataSize)
+		}
+
+		// Back to WAV, unchanged
+		var wavOut bytes.Buffer
+		if err := c.Convert(context.Background(), bytes.NewReader(data), FormatAIFF, &wavOut, FormatWAV); err != nil {
+			t.Fatalf("%d bits: Convert() back error: %v", bits, err)
+		}
+		decoded, _ := decodeWAV(&wavOut)
+		if !reflect.DeepEqual(decoded.Samples, pcm.Samples) {
+			t.Errorf("%d bits: samples changed in the AIFF round trip", bits)
+		}
+	}
+}
+
+// aifcFile builds an AIFF-C file of 12-bit stereo samples with the given
+// compression type, an odd-sized chunk before COMM and an SSND offset
+func aifcFile(compression string, samples []int16, littleEndian bool) []byte {
+	var buf bytes.Buffer
+	chunk := func(id string, body []byte) {
+		buf.WriteString(id)
+		binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+		buf.Write(body)
+		if len(body)%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+
+	buf.WriteString("FORM\x00\x00\x00\x00AIFC")
+	chunk("ANNO", []byte("odd"))
+
+	// Ends with an empty, padded compression name
+	comm := make([]byte, 24)
+	binary.BigEndian.PutUint16(comm[0:2], 2)
+	binary.BigEndian.PutUint32(comm[2:6], uint32(len(samples)/2))
+	binary.BigEndian.PutUint16(comm[6:8], 12)
+	putExtended(comm[8:18], 32000)
+	copy(comm[18:22], compression)
+	chunk("COMM", comm)
+
+	ssnd := make([]byte, 8+4)
+	binary.BigEndian.PutUint32(ssnd[0:4], 4)
+	for _, s := range samples {
+		var b [2]byte
+		if littleEndian {
+			binary.LittleEndian.PutUint16(b[:], uint16(s))
+		} else {
+			binary.BigEndian.PutUint16(b[:], uint16(s))
+		}
+		ssnd = append(ssnd, b[:]...)
+	}
+	chunk("SSND", ssnd)
+
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
+
+func TestDecodeAIFF_AIFC(t *testing.T) {
+	// 12-bit samples are stored left-justified in 16
+	samples := []int16{0, 16, -16, 2047 << 4, -2048 << 4, 100 << 4}
+	want := []int32{0, 16, -16, 2047 << 4, -2048 << 4, 100 << 4}
+
+	for _, tt := range []struct {
+		compression  string
+		littleEndian bool
+	}{
+		{"NONE", false},
+		{"twos", false},
+		{"sowt", true},
+	} {
+		pcm, err := decodeAIFF(bytes.NewReader(aifcFile(tt.compression, samples, tt.littleEndian)))
+		if err != nil {
+			t.Fatalf("%s: decodeAIFF() error: %v", tt.compression, err)
+		}
+		if pcm.SampleRate != 32000 || pcm.Channels != 2 || pcm.BitDepth != 16 {
+			t.Errorf("%s: format = %d Hz, %d channels, %d bits", tt.compression, pcm.SampleRate, pcm.Channels, pcm.BitDepth)
+		}
+		if !reflect.DeepEqual(pcm.Samples, want) {
+			t.Errorf("%s: samples = %v, want %v", tt.compression, pcm.Samples, want)
+		}
+	}
+
+	if _, err := decodeAIFF(bytes.NewReader(aifcFile("ima4", samples, false))); err == nil {
+		t.Error("compressed AIFF-C should be rejected")
+	}
+	if _, err := decodeAIFF(bytes.NewReader(generateTestWAV(44100, 1, 10))); err == nil {
+		t.Error("WAV data should be rejected as AIFF")
+	}
+}
+
+func TestConvertFile_AIFF(t *testing.T) {
+	dir := t.TempDir()
+	wavPath := filepath.Join(dir, "input.wav")
+	if err := os.WriteFile(wavPath, generateTestWAV(48000, 1, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New()
+	aifPath := filepath.Join(dir, "mid.aif")
+	if err := c.ConvertFile(wavPath, aifPath); err != nil {
+		t.Fatalf("ConvertFile(wav, aif) error: %v", err)
+	}
+	backPath := filepath.Join(dir, "back.wav")
+	if err := c.ConvertFile(aifPath, backPath); err != nil {
+		t.Fatalf("ConvertFile(aif, wav) error: %v", err)
+	}
+
+	in, _ := os.ReadFile(wavPath)
+	back, _ := os.ReadFile(backPath)
+	if !bytes.Equal(in, withoutJUNK(t, back)) {
+		t.Error("WAV -> AIFF -> WAV should be lossless")
+	}
+}
+
+// oggPage builds the start of an Ogg stream whose first packet is packet
+func oggPage(packet string) []byte {
+	page := make([]byte, 27, 28+len(packet))
+	copy(page, "OggS")
+	page[26] = 1
+	page = append(page, byte(len(packet)))
+	return append(page, packet...)
+}
+
+// mpegFrames builds n silent frames with the given 4-byte header
+func mpegFrames(header []byte, n int) []byte {
+	h, _ := parseMPEGHeader(header)
+	var out []byte
+	for i := 0; i < n; i++ {
+		frame := make([]byte, h.frameSize())
+		copy(frame, header)
+		out = append(out, frame...)
+	}
+	return out
+}
+
+func TestDetectFormatFromReader(t *testing.T) {
+	pcm, _ := decodeWAV(bytes.NewReader(generateTestWAV(44100, 2, 100)))
+	var flacData, mp3Data, aiffData bytes.Buffer
+	if err := encodeFLAC(&flacData, pcm); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeMP3(&mp3Data, pcm); err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	if err := c.Convert(context.Background(), bytes.NewReader(generateTestWAV(44100, 2, 100)), FormatWAV, &aiffData, FormatAIFF); err != nil {
+		t.Fatal(err)
+	}
+
+	// An ID3v2 tag of 100 bytes, footer-less
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x64"), make([]byte, 100)...)
+	mp2 := mpegFrames([]byte{0xFF, 0xFD, 0x94, 0x00}, 3)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    Format
+		wantErr bool
+	}{
+		{"wav", generateTestWAV(8000, 1, 10), FormatWAV, false},
+		{"aiff", aiffData.Bytes(), FormatAIFF, false},
+		{"aifc", aifcFile("sowt", []int16{1, 2}, true), FormatAIFF, false},
+		{"flac", flacData.Bytes(), FormatFLAC, false},
+		{"id3 flac", bytes.Join([][]byte{id3, flacData.Bytes()}, nil), FormatFLAC, false},
+		{"mp3", mp3Data.Bytes(), FormatMP3, false},
+		{"id3 mp3", bytes.Join([][]byte{id3, mp3Data.Bytes()}, nil), FormatMP3, false},
+		{"ogg vorbis", oggPage("\x01vorbis\x00\x00\x00\x00"), FormatOGG, false},
+		{"ogg opus", oggPage("OpusHead\x01\x02"), FormatUnknown, true},
+		{"ogg flac", oggPage("\x7fFLAC\x01\x00"), FormatUnknown, true},
+		{"mp2", mp2, FormatUnknown, true},
+		{"adts", []byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F, 0xFC}, FormatUnknown, true},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), FormatUnknown, true},
+		{"false sync", append([]byte{0xFF, 0xFB, 0x90, 0x00}, bytes.Repeat([]byte{0x55}, 2000)...), FormatUnknown, false},
+		{"text", []byte("just some text, not audio"), FormatUnknown, false},
+		{"empty", nil, FormatUnknown, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Detection starts at, and returns to, the reader's position
+			r := bytes.NewReader(append([]byte("junk"), tt.data...))
+			r.Seek(4, io.SeekStart)
+
+			got, err := DetectFormatFromReader(r)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("DetectFormatFromReader() = %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 4 {
+				t.Errorf("reader left at %d, want 4", pos)
+			}
+		})
+	}
+}
+
+func TestConvertFile_DetectsContent(t *testing.T) {
+	dir := t.TempDir()
+	wavData := generateTestWAV(44100, 1, 100)
+
+	var warnings []string
+	c := New()
+	c.Warn = func(msg string) { warnings = append(warnings, msg) }
+
+	// A WAV misnamed as MP3 is decoded as WAV, with a warning
+	misnamed := filepath.Join(dir, "input.mp3")
+	if err := os.WriteFile(misnamed, wavData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConvertFile(misnamed, filepath.Join(dir, "out1.wav")); err != nil {
+		t.Fatalf("ConvertFile(misnamed) error: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "wav") {
+		t.Errorf("warnings = %q, want one about the WAV content", warnings)
+	}
+	out, _ := os.ReadFile(filepath.Join(dir, "out1.wav"))
+	if !bytes.Equal(withoutJUNK(t, out), wavData) {
+		t.Error("misnamed WAV should convert losslessly")
+	}
+
+	// No extension: detected silently
+	warnings = nil
+	bare := filepath.Join(dir, "upload")
+	if err := os.WriteFile(bare, wavData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConvertFile(bare, filepath.Join(dir, "out2.flac")); err != nil {
+		t.Fatalf("ConvertFile(no extension) error: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+
+	// Recognized but unsupported content fails with its name
+	m4a := filepath.Join(dir, "song.mp3")
+	if err := os.WriteFile(m4a, []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConvertFile(m4a, filepath.Join(dir, "out3.wav")); err == nil || !strings.Contains(err.Error(), "MP4") {
+		t.Errorf("ConvertFile(m4a) error = %v, want one naming MP4", err)
+	}
+}
+
+// rawDecoder and rawEncoder are a minimal format for exercising the
+// registry: "TRAW", the sample rate and channel count, then 16-bit
+// little-endian samples
+type rawDecoder struct {
+	r          io.Reader
+	sampleRate int
+	channels   int
+}
+
+func (d *rawDecoder) SampleRate() int { return d.sampleRate }
+func (d *rawDecoder) Channels() int   { return d.channels }
+func (d *rawDecoder) BitDepth() int   { return 16 }
+
+func (d *rawDecoder) ReadChunk() (*PCMData, error) {
+	buf := make([]byte, 1024*d.channels)
+	n, err := io.ReadFull(d.r, buf)
+	if n == 0 {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	samples := make([]int32, n/2)
+	for i := range samples {
+		samples[i] = int32(int16(binary.LittleEndian.Uint16(buf[2*i:])))
+	}
+	return &PCMData{Samples: samples, SampleRate: d.sampleRate, Channels: d.channels, BitDepth: 16}, nil
+}
+
+type rawEncoder struct {
+	w io.Writer
+}
+
+func (e *rawEncoder) WriteChunk(pcm *PCMData) error {
+	samples := convertBitDepth(pcm.Samples, pcm.bits(), 16)
+	buf := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(s))
+	}
+	_, err := e.w.Write(buf)
+	return err
+}
+
+func (e *rawEncoder) Close() error { return nil }
+
+const formatTestRaw Format = "testraw"
+
+func registerTestRaw() {
+	RegisterDecoder(DecoderInfo{
+		Format:     formatTestRaw,
+		Name:       "Test raw",
+		Extensions: []string{".TRAW"},
+		Probe:      func(b []byte) bool { return bytes.HasPrefix(b, []byte("TRAW")) },
+		New: func(r io.Reader) (Decoder, error) {
+			var hdr [10]byte
+			if _, err := io.ReadFull(r, hdr[:]); err != nil || string(hdr[0:4]) != "TRAW" {
+				return nil, fmt.Errorf("not a raw file")
+			}
+			return &rawDecoder{
+				r:          r,
+				sampleRate: int(binary.LittleEndian.Uint32(hdr[4:8])),
+				channels:   int(binary.LittleEndian.Uint16(hdr[8:10])),
+			}, nil
+		},
+	})
+	RegisterEncoder(EncoderInfo{
+		Format:      formatTestRaw,
+		Name:        "Test raw",
+		Extensions:  []string{"traw"},
+		BitDepths:   []int{16},
+		MaxChannels: 1,
+		New: func(w io.Writer, cfg EncoderConfig) (Encoder, error) {
+			hdr := []byte("TRAW\x00\x00\x00\x00\x00\x00")
+			binary.LittleEndian.PutUint32(hdr[4:8], uint32(cfg.SampleRate))
+			binary.LittleEndian.PutUint16(hdr[8:10], uint16(cfg.Channels))
+			if _, err := w.Write(hdr); err != nil {
+				return nil, err
+			}
+			return &rawEncoder{w: w}, nil
+		},
+	})
+}
+
+func TestRegistry_BuiltIns(t *testing.T) {
+	for _, f := range []Format{FormatWAV, FormatAIFF, FormatMP3, FormatFLAC, FormatOGG} {
+		if _, ok := LookupDecoder(f); !ok {
+			t.Errorf("no %s decoder registered", f)
+		}
+	}
+	for _, f := range []Format{FormatWAV, FormatAIFF, FormatMP3, FormatFLAC} {
+		if _, ok := LookupEncoder(f); !ok {
+			t.Errorf("no %s encoder registered", f)
+		}
+	}
+	if _, ok := LookupEncoder(FormatOGG); ok {
+		t.Error("OGG has no encoder, but one is registered")
+	}
+
+	mp3, _ := LookupEncoder(FormatMP3)
+	if !mp3.Lossy || !reflect.DeepEqual(mp3.BitDepths, []int{16}) || mp3.MaxChannels != 2 {
+		t.Errorf("MP3 encoder capabilities = %+v", mp3)
+	}
+}
+
+func TestRegistry_CustomCodec(t *testing.T) {
+	registerTestRaw()
+
+	if got := DetectFormat("song.traw"); got != formatTestRaw {
+		t.Errorf("DetectFormat(song.traw) = %q, want %q", got, formatTestRaw)
+	}
+	found := false
+	for _, d := range Decoders() {
+		found = found || d.Format == formatTestRaw
+	}
+	if !found {
+		t.Error("Decoders() doesn't list the registered codec")
+	}
+
+	// WAV -> raw: mono by the encoder's MaxChannels, 16 bits by its BitDepths
+	pcm := hiResPCM(24, 500)
+	var wavIn bytes.Buffer
+	if err := encodeWAV(&wavIn, pcm); err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	c.Dither = DitherNone
+	var raw bytes.Buffer
+	if err := c.Convert(context.Background(), &wavIn, FormatWAV, &raw, formatTestRaw); err != nil {
+		t.Fatalf("Convert(wav, raw) error: %v", err)
+	}
+	if got := binary.LittleEndian.Uint16(raw.Bytes()[8:10]); got != 1 {
+		t.Errorf("raw channels = %d, want 1", got)
+	}
+
+	// Detected by its probe, and back to WAV
+	format, err := DetectFormatFromReader(bytes.NewReader(raw.Bytes()))
+	if err != nil || format != formatTestRaw {
+		t.Fatalf("DetectFormatFromReader() = %q, %v; want %q", format, err, formatTestRaw)
+	}
+	var wavOut bytes.Buffer
+	if err := c.Convert(context.Background(), bytes.NewReader(raw.Bytes()), format, &wavOut, FormatWAV); err != nil {
+		t.Fatalf("Convert(raw, wav) error: %v", err)
+	}
+	decoded, err := decodeWAV(&wavOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Channels != 1 || decoded.BitDepth != 16 || len(decoded.Samples) != 500 {
+		t.Errorf("round trip = %d channels, %d bits, %d samples", decoded.Channels, decoded.BitDepth, len(decoded.Samples))
+	}
+
+	// Registering again replaces the codec
+	RegisterDecoder(DecoderInfo{
+		Format: formatTestRaw,
+		New:    func(r io.Reader) (Decoder, error) { return nil, fmt.Errorf("replaced") },
+	})
+	defer registerTestRaw()
+	if err := c.Convert(context.Background(), bytes.NewReader(raw.Bytes()), formatTestRaw, io.Discard, FormatWAV); err == nil || !strings.Contains(err.Error(), "replaced") {
+		t.Errorf("Convert() with replaced decoder error = %v", err)
+	}
+}
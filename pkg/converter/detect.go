@@ -0,0 +1,137 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// sniffSize is how much of a stream DetectFormatFromReader looks at
+const sniffSize = 4096
+
+// foreignMagic lists signatures of audio formats the converter can't
+// decode, so they get a clear error rather than a failed decode
+var foreignMagic = []struct {
+	offset int
+	magic  string
+	name   string
+}{
+	{0, "caff", "Core Audio (CAF)"},
+	{4, "ftyp", "MP4/M4A"},
+	{0, "MThd", "MIDI"},
+	{0, "wvpk", "WavPack"},
+	{0, "MAC ", "Monkey's Audio"},
+	{0, "TTA1", "TTA"},
+	{0, "MPCK", "Musepack"},
+	{0, "#!AMR", "AMR"},
+	{0, ".snd", "Sun/NeXT AU"},
+	{0, "\x30\x26\xB2\x75\x8E\x66\xCF\x11", "ASF/WMA"},
+}
+
+// oggCodecs maps the start of an Ogg stream's first packet to its codec
+var oggCodecs = []struct {
+	magic string
+	name  string
+}{
+	{"\x01vorbis", "Vorbis"},
+	{"OpusHead", "Opus"},
+	{"\x7fFLAC", "FLAC"},
+	{"Speex   ", "Speex"},
+	{"\x80theora", "Theora"},
+}
+
+// DetectFormatFromReader detects audio format from the start of a stream's
+// content, using the probes of registered decoders, and leaves r where it
+// was. It returns FormatUnknown with a nil error when nothing matches, and
+// FormatUnknown with an error naming the format when the content is audio
+// no registered decoder handles, such as Ogg Opus or AAC.
+func DetectFormatFromReader(r io.ReadSeeker) (Format, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	format, err := sniffFormat(r, start)
+	if _, serr := r.Seek(start, io.SeekStart); err == nil && serr != nil {
+		err = serr
+	}
+	return format, err
+}
+
+func sniffFormat(r io.ReadSeeker, start int64) (Format, error) {
+	buf, err := readSniff(r)
+	if err != nil {
+		return FormatUnknown, err
+	}
+
+	// ID3v2 tags front MP3s, and sometimes FLACs: probe what follows
+	id3 := len(buf) >= 10 && string(buf[0:3]) == "ID3"
+	if id3 {
+		size := int64(10 + synchsafe(buf[6:10]))
+		if buf[5]&0x10 != 0 {
+			size += 10 // footer
+		}
+		if _, err := r.Seek(start+size, io.SeekStart); err != nil {
+			return FormatUnknown, err
+		}
+		if buf, err = readSniff(r); err != nil {
+			return FormatUnknown, err
+		}
+	}
+
+	if format := probeFormat(buf); format != FormatUnknown {
+		return format, nil
+	}
+	if id3 {
+		// Audio after the tag may start with padding rather than a frame
+		if _, ok := LookupDecoder(FormatMP3); ok {
+			return FormatMP3, nil
+		}
+	}
+	return FormatUnknown, foreignFormat(buf)
+}
+
+// readSniff reads up to sniffSize bytes; short streams aren't an error
+func readSniff(r io.Reader) ([]byte, error) {
+	buf := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// foreignFormat returns an error naming the audio format in buf, if it's
+// one that was recognized but has no decoder
+func foreignFormat(buf []byte) error {
+	if codec := oggCodec(buf); codec != "" {
+		return fmt.Errorf("Ogg %s is not supported", codec)
+	}
+	for _, m := range foreignMagic {
+		if len(buf) >= m.offset+len(m.magic) && string(buf[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return fmt.Errorf("%s audio is not supported", m.name)
+		}
+	}
+	// ADTS AAC shares MPEG audio's sync word, with the layer bits zero
+	if len(buf) >= 2 && buf[0] == 0xFF && buf[1]&0xF6 == 0xF0 {
+		return fmt.Errorf("AAC (ADTS) audio is not supported")
+	}
+	if h, ok := parseMPEGHeader(buf); ok && h.layer != 3 {
+		return fmt.Errorf("MPEG layer %d audio is not supported", h.layer)
+	}
+	return nil
+}
+
+// oggCodec names the codec of an Ogg stream from the first packet of its
+// first page, or returns "" if buf isn't Ogg or the codec is unknown
+func oggCodec(buf []byte) string {
+	if len(buf) < 27 || string(buf[0:4]) != "OggS" || len(buf) < 27+int(buf[26]) {
+		return ""
+	}
+	packet := buf[27+int(buf[26]):]
+	for _, c := range oggCodecs {
+		if bytes.HasPrefix(packet, []byte(c.magic)) {
+			return c.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+)
+
+// Dither selects how samples are requantized to a lower bit depth
+type Dither string
+
+const (
+	// DitherNone truncates the dropped bits
+	DitherNone Dither = "none"
+	// DitherRectangular adds uniform noise of one LSB before rounding
+	DitherRectangular Dither = "rectangular"
+	// DitherTriangular adds triangular (TPDF) noise of two LSB, which
+	// makes the error independent of the signal
+	DitherTriangular Dither = "triangular"
+	// DitherNoiseShaped is TPDF dither with error feedback that moves the
+	// noise towards frequencies where hearing is less sensitive. It only
+	// shapes at 44.1 and 48 kHz and is plain TPDF at other rates.
+	DitherNoiseShaped Dither = "noise-shaped"
+)
+
+// noiseShapingCoeffs is Lipshitz et al.'s 5-tap E-weighted error filter.
+// It is designed for 44.1 kHz: the noise drops by about 16 dB below 6 kHz
+// and rises above 12 kHz. At other rates those bands move, so the filter
+// is only used where they stay put (see shapesNoise).
+var noiseShapingCoeffs = [...]float64{2.033, -2.165, 1.959, -1.590, 0.6149}
+
+// shapesNoise reports whether noise shaping applies at sampleRate
+func shapesNoise(sampleRate int) bool {
+	return sampleRate == 44100 || sampleRate == 48000
+}
+
+// ParseDither returns the Dither named s. "tpdf" and "shaped" are accepted
+// as short names.
+func ParseDither(s string) (Dither, error) {
+	switch Dither(s) {
+	case DitherNone, DitherRectangular, DitherTriangular, DitherNoiseShaped:
+		return Dither(s), nil
+	}
+	switch s {
+	case "rect":
+		return DitherRectangular, nil
+	case "tpdf":
+		return DitherTriangular, nil
+	case "shaped":
+		return DitherNoiseShaped, nil
+	}
+	return "", fmt.Errorf("unknown dither %q (none, rectangular, triangular, noise-shaped)", s)
+}
+
+// ditherer reduces the bit depth of a stream chunk by chunk. Noise comes
+// from a seeded generator and shaping keeps per-channel error history, so
+// the same input and seed always produce the same output.
+type ditherer struct {
+	kind     Dither
+	shaped   bool
+	from, to int
+	scale    float64 // input units per output LSB
+	min, max float64
+	rng      uint64
+	errs     [][len(noiseShapingCoeffs)]float64
+	channel  int
+}
+
+func newDitherer(kind Dither, seed uint64, sampleRate, channels, from, to int) (*ditherer, error) {
+	switch kind {
+	case DitherNone, DitherRectangular, DitherTriangular, DitherNoiseShaped:
+	default:
+		return nil, fmt.Errorf("unknown dither %q", kind)
+	}
+	return &ditherer{
+		kind:   kind,
+		shaped: kind == DitherNoiseShaped && shapesNoise(sampleRate),
+		from:   from,
+		to:     to,
+		scale:  float64(int64(1) << (from - to)),
+		min:    -float64(int64(1) << (to - 1)),
+		max:    float64(int64(1)<<(to-1) - 1),
+		// A zero state would stall the generator
+		rng:  seed ^ 0x9E3779B97F4A7C15,
+		errs: make([][len(noiseShapingCoeffs)]float64, channels),
+	}, nil
+}
+
+// Process requantizes a chunk to the target bit depth
+func (d *ditherer) Process(pcm *PCMData) *PCMData {
+	out := &PCMData{
+		SampleRate: pcm.SampleRate,
+		Channels:   pcm.Channels,
+		BitDepth:   d.to,
+	}
+	if d.kind == DitherNone {
+		out.Samples = convertBitDepth(pcm.Samples, pcm.bits(), d.to)
+		return out
+	}
+
+	out.Samples = make([]int32, len(pcm.Samples))
+	for i, s := range pcm.Samples {
+		out.Samples[i] = d.quantize(float64(s) / d.scale)
+		d.channel = (d.channel + 1) % len(d.errs)
+	}
+	return out
+}
+
+// quantize rounds x, in output LSB units, to an output sample
+func (d *ditherer) quantize(x float64) int32 {
+	var noise float64
+	switch d.kind {
+	case DitherRectangular:
+		noise = d.uniform()
+	case DitherTriangular, DitherNoiseShaped:
+		noise = d.uniform() + d.uniform()
+	}
+
+	if !d.shaped {
+		return int32(math.Max(d.min, math.Min(d.max, math.Round(x+noise))))
+	}
+
+	// Subtract the filtered past errors, then remember the new one
+	errs := &d.errs[d.channel]
+	v := x
+	for j, c := range noiseShapingCoeffs {
+		v -= c * errs[j]
+	}
+	y := math.Max(d.min, math.Min(d.max, math.Round(v+noise)))
+
+	copy(errs[1:], errs[:len(errs)-1])
+	// Clipped samples would feed back large errors and destabilize the filter
+	errs[0] = math.Max(-1.5, math.Min(1.5, y-v))
+	return int32(y)
+}
+
+// uniform returns a value in [-0.5, 0.5) from a xorshift64* generator
+func (d *ditherer) uniform() float64 {
+	d.rng ^= d.rng >> 12
+	d.rng ^= d.rng << 25
+	d.rng ^= d.rng >> 27
+	return float64((d.rng*0x2545F4914F6CDD1D)>>11)/(1<<53) - 0.5
+}
@@ -0,0 +1,197 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/formeo/go-audio-converter/pkg/flacenc"
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+func init() {
+	RegisterDecoder(DecoderInfo{
+		Format:     FormatFLAC,
+		Name:       "FLAC",
+		Extensions: []string{"flac"},
+		Probe:      func(b []byte) bool { return bytes.HasPrefix(b, []byte("fLaC")) },
+		Tags:       true,
+		Pictures:   true,
+		New:        func(r io.Reader) (Decoder, error) { return newFLACDecoder(r) },
+	})
+	RegisterEncoder(EncoderInfo{
+		Format:             FormatFLAC,
+		Name:               "FLAC",
+		Extensions:         []string{"flac"},
+		BitDepths:          []int{8, 12, 16, 20, 24, 32},
+		MaxDefaultBitDepth: flacMaxDefaultBitDepth,
+		Tags:               true,
+		Pictures:           true,
+		New: func(w io.Writer, cfg EncoderConfig) (Encoder, error) {
+			enc, err := newFLACEncoder(w, cfg.SampleRate, cfg.Channels, cfg.BitDepth, cfg.Converter.FLACLevel)
+			if err != nil {
+				return nil, err
+			}
+			if cfg.ChannelMask != 0 && cfg.ChannelMask != defaultChannelMasks[cfg.Channels] {
+				enc.enc.AddTag(flacChannelMaskTag, fmt.Sprintf("0x%04X", cfg.ChannelMask))
+			}
+			return enc, nil
+		},
+	})
+}
+
+// flacDecoder returns one FLAC frame per chunk
+type flacDecoder struct {
+	stream        *flac.Stream
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	channelMask   uint32
+	tags          Tags
+	pictures      []Picture
+}
+
+func newFLACDecoder(r io.Reader) (*flacDecoder, error) {
+	// Parse (unlike New) keeps the metadata blocks, so tags can be read
+	stream, err := flac.Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("open flac: %w", err)
+	}
+
+	d := &flacDecoder{
+		stream:        stream,
+		sampleRate:    int(stream.Info.SampleRate),
+		channels:      int(stream.Info.NChannels),
+		bitsPerSample: int(stream.Info.BitsPerSample),
+	}
+	for _, block := range stream.Blocks {
+		switch body := block.Body.(type) {
+		case *meta.VorbisComment:
+			for _, tag := range body.Tags {
+				if strings.EqualFold(tag[0], flacChannelMaskTag) {
+					if mask, err := strconv.ParseUint(tag[1], 0, 32); err == nil {
+						d.channelMask = uint32(mask)
+					}
+					continue
+				}
+				d.tags.add(tag[0], tag[1])
+			}
+		case *meta.Picture:
+			d.pictures = append(d.pictures, Picture{
+				Type:        int(body.Type),
+				MIME:        body.MIME,
+				Description: body.Desc,
+				Data:        body.Data,
+			})
+		}
+	}
+	return d, nil
+}
+
+func (d *flacDecoder) SampleRate() int { return d.sampleRate }
+func (d *flacDecoder) Channels() int   { return d.channels }
+func (d *flacDecoder) BitDepth() int   { return d.bitsPerSample }
+func (d *flacDecoder) Tags() Tags      { return d.tags }
+
+// ChannelMask is the layout a WAVEFORMATEXTENSIBLE_CHANNEL_MASK tag gives,
+// 0 if there's none
+func (d *flacDecoder) ChannelMask() uint32 { return d.channelMask }
+
+func (d *flacDecoder) Pictures() []Picture { return d.pictures }
+
+func (d *flacDecoder) ReadChunk() (*PCMData, error) {
+	frame, err := d.stream.ParseNext()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse frame: %w", err)
+	}
+
+	nSamples := int(frame.Subframes[0].NSamples)
+	samples := make([]int32, 0, nSamples*d.channels)
+	for i := 0; i < nSamples; i++ {
+		for ch := 0; ch < d.channels; ch++ {
+			samples = append(samples, frame.Subframes[ch].Samples[i])
+		}
+	}
+
+	return &PCMData{
+		Samples:    samples,
+		SampleRate: d.sampleRate,
+		Channels:   d.channels,
+		BitDepth:   d.bitsPerSample,
+	}, nil
+}
+
+// flacMaxDefaultBitDepth caps FLAC output that would otherwise keep a
+// deeper input's resolution. 32-bit FLAC is a recent addition to the
+// format that most decoders, mewkiz/flac included, can't read yet.
+const flacMaxDefaultBitDepth = 24
+
+// flacChannelMaskTag is the Vorbis comment FLAC tools keep a speaker
+// layout other than the channel count's default in, as a hex
+// WAVE_FORMAT_EXTENSIBLE mask
+const flacChannelMaskTag = "WAVEFORMATEXTENSIBLE_CHANNEL_MASK"
+
+// flacEncoder wraps flacenc.StreamEncoder. STREAMINFO totals and MD5 are
+// back-patched when the output is seekable.
+type flacEncoder struct {
+	enc      *flacenc.StreamEncoder
+	channels int
+	bitDepth int
+}
+
+func newFLACEncoder(w io.Writer, sampleRate, channels, bitDepth, level int) (*flacEncoder, error) {
+	if channels < 1 || channels > 8 {
+		return nil, fmt.Errorf("flac: unsupported channel count %d", channels)
+	}
+	if bitDepth < 4 || bitDepth > 32 {
+		return nil, fmt.Errorf("flac: unsupported bit depth %d", bitDepth)
+	}
+
+	enc := flacenc.NewStreamEncoder(w, sampleRate, channels, bitDepth)
+	if err := enc.SetLevel(level); err != nil {
+		return nil, fmt.Errorf("flac: %w", err)
+	}
+
+	return &flacEncoder{
+		enc:      enc,
+		channels: channels,
+		bitDepth: bitDepth,
+	}, nil
+}
+
+func (e *flacEncoder) WriteChunk(pcm *PCMData) error {
+	if len(pcm.Samples)%e.channels != 0 {
+		return fmt.Errorf("flac: %d samples is not a multiple of %d channels", len(pcm.Samples), e.channels)
+	}
+
+	return e.enc.Write(convertBitDepth(pcm.Samples, pcm.bits(), e.bitDepth))
+}
+
+// SetTags stores tags in a VORBIS_COMMENT block
+func (e *flacEncoder) SetTags(tags Tags) {
+	for _, tag := range tags {
+		e.enc.AddTag(tag[0], tag[1])
+	}
+}
+
+// SetPictures stores pictures in PICTURE blocks
+func (e *flacEncoder) SetPictures(pictures []Picture) {
+	for _, p := range pictures {
+		e.enc.Pictures = append(e.enc.Pictures, flacenc.Picture{
+			Type:        flacenc.PictureType(p.Type),
+			MIME:        p.MIME,
+			Description: p.Description,
+			Data:        p.Data,
+		})
+	}
+}
+
+func (e *flacEncoder) Close() error {
+	return e.enc.Close()
+}
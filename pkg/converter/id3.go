@@ -0,0 +1,513 @@
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3TextFrames maps ID3v2 text frames to the Vorbis comment names tags are
+// carried in. Frames not listed here, other than COMM, TXXX and APIC, are
+// dropped on input; tags not listed are written as TXXX frames.
+var id3TextFrames = []struct{ id, name string }{
+	{"TIT2", "TITLE"},
+	{"TPE1", "ARTIST"},
+	{"TALB", "ALBUM"},
+	{"TPE2", "ALBUMARTIST"},
+	{"TRCK", "TRACKNUMBER"},
+	{"TPOS", "DISCNUMBER"},
+	{"TDRC", "DATE"},
+	{"TCON", "GENRE"},
+	{"TCOM", "COMPOSER"},
+	{"TEXT", "LYRICIST"},
+	{"TPE3", "CONDUCTOR"},
+	{"TIT1", "GROUPING"},
+	{"TIT3", "SUBTITLE"},
+	{"TPUB", "ORGANIZATION"},
+	{"TCOP", "COPYRIGHT"},
+	{"TSRC", "ISRC"},
+	{"TBPM", "BPM"},
+	{"TENC", "ENCODED-BY"},
+	{"TLAN", "LANGUAGE"},
+	{"TSOA", "ALBUMSORT"},
+	{"TSOP", "ARTISTSORT"},
+	{"TSOT", "TITLESORT"},
+	{"TYER", "DATE"}, // ID3v2.3; read only
+}
+
+// id3v1Genres are the genres ID3v1 numbers, also used by "(n)" references
+// in ID3v2 TCON frames
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// ID3v2 text encodings
+const (
+	id3Latin1  = 0
+	id3UTF16   = 1 // with byte order mark
+	id3UTF16BE = 2
+	id3UTF8    = 3
+)
+
+// id3v1Size is the length of an ID3v1 tag at the end of a file
+const id3v1Size = 128
+
+// id3Tag is what was read from a file's ID3 tags
+type id3Tag struct {
+	tags     Tags
+	pictures []Picture
+}
+
+// readID3v2 reads an ID3v2 tag at the start of br, if there is one, and
+// parses its frames. Versions other than 2.3 and 2.4 are skipped.
+func readID3v2(br *bufio.Reader) (*id3Tag, error) {
+	hdr, err := br.Peek(10)
+	if err != nil || string(hdr[0:3]) != "ID3" {
+		return &id3Tag{}, nil
+	}
+	version, flags := hdr[3], hdr[5]
+	// Synchsafe size, excluding the header and optional footer
+	size := synchsafe(hdr[6:10])
+	if _, err := br.Discard(10); err != nil {
+		return nil, fmt.Errorf("read ID3v2 tag: %w", err)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, fmt.Errorf("read ID3v2 tag: %w", err)
+	}
+	if flags&0x10 != 0 {
+		if _, err := br.Discard(10); err != nil {
+			return nil, fmt.Errorf("read ID3v2 tag: %w", err)
+		}
+	}
+	if version != 3 && version != 4 {
+		return &id3Tag{}, nil
+	}
+
+	// ID3v2.3 unsynchronises the whole tag, ID3v2.4 each frame
+	if version == 3 && flags&0x80 != 0 {
+		body = resync(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		ext := synchsafe(body[0:4])
+		if version == 3 {
+			ext = int(binary.BigEndian.Uint32(body[0:4])) + 4
+		}
+		body = body[min(ext, len(body)):]
+	}
+
+	t := &id3Tag{}
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[0:4])
+		frameSize := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			frameSize = synchsafe(body[4:8])
+		}
+		format := body[9]
+		if frameSize > len(body)-10 {
+			break
+		}
+		data := body[10 : 10+frameSize]
+		body = body[10+frameSize:]
+
+		data, ok := id3FrameData(data, version, format)
+		if ok {
+			t.parseFrame(id, data)
+		}
+	}
+	return t, nil
+}
+
+// id3FrameData undoes a frame's grouping, unsynchronisation and
+// compression. Encrypted frames can't be read and report false.
+func id3FrameData(data []byte, version, format byte) ([]byte, bool) {
+	var grouped, compressed, encrypted, unsynced, lengthIndicator bool
+	if version == 3 {
+		compressed, encrypted, grouped = format&0x80 != 0, format&0x40 != 0, format&0x20 != 0
+		lengthIndicator = compressed
+	} else {
+		grouped, compressed, encrypted = format&0x40 != 0, format&0x08 != 0, format&0x04 != 0
+		unsynced, lengthIndicator = format&0x02 != 0, format&0x01 != 0
+	}
+	if encrypted {
+		return nil, false
+	}
+	if grouped && len(data) > 0 {
+		data = data[1:]
+	}
+	if lengthIndicator && len(data) >= 4 {
+		data = data[4:]
+	}
+	if unsynced {
+		data = resync(data)
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false
+		}
+		defer zr.Close()
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// parseFrame adds the tags or picture in one frame
+func (t *id3Tag) parseFrame(id string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	enc, data := data[0], data[1:]
+
+	switch id {
+	case "TXXX":
+		desc, value := splitID3String(enc, data)
+		t.tags.add(decodeID3Text(enc, desc), decodeID3Text(enc, value))
+		return
+	case "COMM":
+		if len(data) < 3 {
+			return
+		}
+		// Only plain comments; described ones are mostly player data
+		// (iTunNORM and the like)
+		desc, text := splitID3String(enc, data[3:])
+		if decodeID3Text(enc, desc) == "" {
+			t.tags.add("COMMENT", decodeID3Text(enc, text))
+		}
+		return
+	case "APIC":
+		mime, rest := splitID3String(id3Latin1, data)
+		if len(rest) < 1 {
+			return
+		}
+		picType := int(rest[0])
+		desc, image := splitID3String(enc, rest[1:])
+		t.pictures = append(t.pictures, Picture{
+			Type:        picType,
+			MIME:        decodeID3Text(id3Latin1, mime),
+			Description: decodeID3Text(enc, desc),
+			Data:        image,
+		})
+		return
+	}
+
+	var name string
+	for _, f := range id3TextFrames {
+		if f.id == id {
+			name = f.name
+			break
+		}
+	}
+	if name == "" {
+		return
+	}
+
+	// ID3v2.4 separates multiple values with NULs
+	for _, value := range strings.Split(strings.TrimRight(decodeID3Text(enc, data), "\x00"), "\x00") {
+		switch name {
+		case "TRACKNUMBER", "DISCNUMBER":
+			number, total, _ := strings.Cut(value, "/")
+			t.tags.add(name, number)
+			if total != "" {
+				t.tags.add(strings.TrimSuffix(name, "NUMBER")+"TOTAL", total)
+			}
+		case "GENRE":
+			t.tags.add(name, id3Genre(value))
+		default:
+			t.tags.add(name, value)
+		}
+	}
+}
+
+// id3Genre resolves ID3v1 genre numbers in a TCON value, written either
+// bare ("17") or as an ID3v2.3 reference ("(17)", "(17)Rock")
+func id3Genre(value string) string {
+	if strings.HasPrefix(value, "(") {
+		ref, rest, ok := strings.Cut(value[1:], ")")
+		if ok && rest != "" {
+			return rest
+		}
+		if ok {
+			value = ref
+		}
+	}
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return value
+}
+
+// readID3v1 returns the tags in an ID3v1 tag at the end of rs, leaving
+// the read position where it was. ID3v1.1 track numbers are read.
+func readID3v1(rs io.ReadSeeker) (Tags, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	var buf [id3v1Size]byte
+	_, err = rs.Seek(-id3v1Size, io.SeekEnd)
+	if err == nil {
+		_, err = io.ReadFull(rs, buf[:])
+	}
+	if _, serr := rs.Seek(pos, io.SeekStart); serr != nil {
+		return nil, serr
+	}
+	if err != nil || string(buf[0:3]) != "TAG" {
+		// Too short to have a tag
+		return nil, nil
+	}
+
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimRight(decodeID3Text(id3Latin1, b), " ")
+	}
+	var tags Tags
+	add := func(name, value string) {
+		if value != "" {
+			tags.add(name, value)
+		}
+	}
+	add("TITLE", field(buf[3:33]))
+	add("ARTIST", field(buf[33:63]))
+	add("ALBUM", field(buf[63:93]))
+	add("DATE", field(buf[93:97]))
+	add("COMMENT", field(buf[97:127]))
+	if buf[125] == 0 && buf[126] != 0 {
+		add("TRACKNUMBER", strconv.Itoa(int(buf[126])))
+	}
+	if int(buf[127]) < len(id3v1Genres) {
+		add("GENRE", id3v1Genres[buf[127]])
+	}
+	return tags, nil
+}
+
+// mergeID3v1 adds the ID3v1 tags whose names the ID3v2 tag doesn't have
+func (t *id3Tag) mergeID3v1(v1 Tags) {
+	have := make(map[string]bool)
+	for _, tag := range t.tags {
+		have[tag[0]] = true
+	}
+	for _, tag := range v1 {
+		if !have[tag[0]] {
+			t.tags = append(t.tags, tag)
+		}
+	}
+}
+
+// writeID3v2 writes tags and pictures as an ID3v2.4 tag with UTF-8 text.
+// Repeated names become one frame with NUL-separated values; TRACKTOTAL and
+// DISCTOTAL are folded into TRCK and TPOS as "n/total".
+func writeID3v2(w io.Writer, tags Tags, pictures []Picture) error {
+	values := make(map[string][]string)
+	var order []string
+	for _, tag := range tags {
+		if _, ok := values[tag[0]]; !ok {
+			order = append(order, tag[0])
+		}
+		values[tag[0]] = append(values[tag[0]], tag[1])
+	}
+
+	var body bytes.Buffer
+	frame := func(id string, data []byte) {
+		var hdr [10]byte
+		copy(hdr[0:4], id)
+		putSynchsafe(hdr[4:8], len(data))
+		body.Write(hdr[:])
+		body.Write(data)
+	}
+	text := func(s ...string) []byte {
+		return append([]byte{id3UTF8}, strings.Join(s, "\x00")...)
+	}
+
+	for _, name := range order {
+		vs := values[name]
+		switch name {
+		case "TRACKTOTAL", "DISCTOTAL":
+			continue
+		case "TRACKNUMBER", "DISCNUMBER":
+			if total := values[strings.TrimSuffix(name, "NUMBER")+"TOTAL"]; len(total) > 0 && !strings.Contains(vs[0], "/") {
+				vs = []string{vs[0] + "/" + total[0]}
+			}
+		case "COMMENT":
+			for _, v := range vs {
+				// Unknown language, empty description
+				frame("COMM", append([]byte{id3UTF8, 'X', 'X', 'X', 0}, v...))
+			}
+			continue
+		}
+
+		id := ""
+		for _, f := range id3TextFrames {
+			if f.name == name {
+				id = f.id
+				break
+			}
+		}
+		if id == "" {
+			for _, v := range vs {
+				frame("TXXX", text(name, v))
+			}
+			continue
+		}
+		frame(id, text(vs...))
+	}
+
+	for _, p := range pictures {
+		data := append([]byte{id3UTF8}, p.MIME...)
+		data = append(data, 0, byte(p.Type))
+		data = append(data, p.Description...)
+		data = append(data, 0)
+		frame("APIC", append(data, p.Data...))
+	}
+
+	if body.Len() > 1<<28-1 {
+		return fmt.Errorf("ID3v2 tag of %d bytes is too large", body.Len())
+	}
+	hdr := [10]byte{'I', 'D', '3', 4, 0, 0}
+	putSynchsafe(hdr[6:10], body.Len())
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// writeID3v1 writes the tags ID3v1.1 has room for, truncating long
+// values. Characters outside Latin-1 become '?'.
+func writeID3v1(w io.Writer, tags Tags) error {
+	var buf [id3v1Size]byte
+	copy(buf[0:3], "TAG")
+	buf[127] = 0xFF
+	get := func(name string) string {
+		for _, tag := range tags {
+			if tag[0] == name {
+				return tag[1]
+			}
+		}
+		return ""
+	}
+	put := func(b []byte, s string) {
+		i := 0
+		for _, r := range s {
+			if i == len(b) {
+				break
+			}
+			if r > 0xFF {
+				r = '?'
+			}
+			b[i] = byte(r)
+			i++
+		}
+	}
+
+	put(buf[3:33], get("TITLE"))
+	put(buf[33:63], get("ARTIST"))
+	put(buf[63:93], get("ALBUM"))
+	put(buf[93:97], get("DATE"))
+	put(buf[97:125], get("COMMENT"))
+	number, _, _ := strings.Cut(get("TRACKNUMBER"), "/")
+	if n, err := strconv.Atoi(number); err == nil && n > 0 && n < 256 {
+		buf[126] = byte(n)
+	}
+	if genre := get("GENRE"); genre != "" {
+		for i, g := range id3v1Genres {
+			if strings.EqualFold(g, genre) {
+				buf[127] = byte(i)
+			}
+		}
+	}
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// splitID3String splits a NUL-terminated string in the given encoding off
+// the front of b. UTF-16 terminators are two bytes on an even offset.
+func splitID3String(enc byte, b []byte) (s, rest []byte) {
+	if enc == id3UTF16 || enc == id3UTF16BE {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// decodeID3Text converts ID3 text in the given encoding to UTF-8. UTF-16
+// without a byte order mark is taken as big endian.
+func decodeID3Text(enc byte, b []byte) string {
+	switch enc {
+	case id3UTF16, id3UTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u := order.Uint16(b[i:])
+			// A BOM starts each string of a multi-valued frame
+			switch u {
+			case 0xFEFF:
+				continue
+			case 0xFFFE:
+				if order == binary.ByteOrder(binary.BigEndian) {
+					order = binary.LittleEndian
+				} else {
+					order = binary.BigEndian
+				}
+				continue
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	case id3UTF8:
+		return string(b)
+	default:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+}
+
+// synchsafe decodes a 4-byte integer that uses 7 bits per byte
+func synchsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+func putSynchsafe(b []byte, n int) {
+	b[0], b[1], b[2], b[3] = byte(n>>21&0x7F), byte(n>>14&0x7F), byte(n>>7&0x7F), byte(n&0x7F)
+}
+
+// resync removes the zero bytes unsynchronisation inserts after 0xFF
+func resync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
@@ -0,0 +1,213 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+)
+
+// maxChannels is the most channels a stream can have (FLAC's limit)
+const maxChannels = 8
+
+// Speaker positions of the default channel layouts, in the order WAV
+// (without a channel mask) and FLAC store them
+const (
+	spkL   = iota // front left
+	spkR          // front right
+	spkC          // front centre
+	spkLFE        // low frequency effects
+	spkLs         // side/surround left
+	spkRs         // side/surround right
+	spkLb         // back left
+	spkRb         // back right
+	spkCb         // back centre
+	spkLc         // front left of centre
+	spkRc         // front right of centre
+)
+
+var defaultLayouts = [maxChannels + 1][]int{
+	1: {spkC},
+	2: {spkL, spkR},
+	3: {spkL, spkR, spkC},
+	4: {spkL, spkR, spkLs, spkRs},
+	5: {spkL, spkR, spkC, spkLs, spkRs},
+	6: {spkL, spkR, spkC, spkLFE, spkLs, spkRs},
+	7: {spkL, spkR, spkC, spkLFE, spkCb, spkLs, spkRs},
+	8: {spkL, spkR, spkC, spkLFE, spkLb, spkRb, spkLs, spkRs},
+}
+
+// stereoDownmix holds each speaker's left and right gains when folding
+// down to stereo (ITU-R BS.775: centre and surrounds at -3 dB, LFE
+// dropped)
+var stereoDownmix = [...][2]float64{
+	spkL:   {1, 0},
+	spkR:   {0, 1},
+	spkC:   {math.Sqrt2 / 2, math.Sqrt2 / 2},
+	spkLFE: {0, 0},
+	spkLs:  {math.Sqrt2 / 2, 0},
+	spkRs:  {0, math.Sqrt2 / 2},
+	spkLb:  {math.Sqrt2 / 2, 0},
+	spkRb:  {0, math.Sqrt2 / 2},
+	spkCb:  {0.5, 0.5},
+	spkLc:  {1, 0},
+	spkRc:  {0, 1},
+}
+
+// maskSpeakers maps the bits of a WAVE_FORMAT_EXTENSIBLE dwChannelMask,
+// lowest first, to speaker positions. Height speakers fold onto the ones
+// below them.
+var maskSpeakers = [...]int{
+	spkL, spkR, spkC, spkLFE, spkLb, spkRb, spkLc, spkRc, spkCb, spkLs, spkRs,
+	spkC,             // top centre
+	spkL, spkC, spkR, // top front
+	spkLb, spkCb, spkRb, // top back
+}
+
+// defaultChannelMasks are the dwChannelMask values of the default
+// layouts, as the reference FLAC tools assume them
+var defaultChannelMasks = [maxChannels + 1]uint32{
+	1: 0x4,
+	2: 0x3,
+	3: 0x7,
+	4: 0x33,
+	5: 0x37,
+	6: 0x3F,
+	7: 0x70F,
+	8: 0x63F,
+}
+
+// channelMaskReader is implemented by decoders that know their input's
+// speaker layout, as WAVE_FORMAT_EXTENSIBLE dwChannelMask bits
+type channelMaskReader interface {
+	ChannelMask() uint32
+}
+
+// speakerLayout returns the speaker of each channel given a channel mask.
+// Channels are assigned to the mask's bits in ascending order; a zero mask,
+// or one with too few known bits, means the default layout. It returns nil
+// if there's no default either.
+func speakerLayout(mask uint32, channels int) []int {
+	var layout []int
+	for bit := 0; bit < len(maskSpeakers) && len(layout) < channels; bit++ {
+		if mask&(1<<bit) != 0 {
+			layout = append(layout, maskSpeakers[bit])
+		}
+	}
+	if len(layout) < channels {
+		if channels > maxChannels {
+			return nil
+		}
+		return defaultLayouts[channels]
+	}
+	return layout
+}
+
+// standardMix returns the matrix for folding the default layout of in
+// channels down to mono or stereo, or copying mono to stereo. Downmix rows
+// are scaled so a full-scale input can't clip. It returns nil when in and
+// out are equal.
+func standardMix(in, out int) ([][]float64, error) {
+	switch {
+	case in == out:
+		return nil, nil
+	case in < 1 || in > maxChannels:
+		return nil, fmt.Errorf("unsupported channel count %d", in)
+	}
+	return layoutMix(defaultLayouts[in], out)
+}
+
+// layoutMix is standardMix for channels in the given speaker layout
+func layoutMix(layout []int, out int) ([][]float64, error) {
+	in := len(layout)
+	switch {
+	case in == out:
+		return nil, nil
+	case in == 1 && out == 2:
+		return [][]float64{{1}, {1}}, nil
+	case out != 1 && out != 2:
+		return nil, fmt.Errorf("no standard mix from %d to %d channels; set ChannelMatrix", in, out)
+	}
+
+	stereo := [][]float64{make([]float64, in), make([]float64, in)}
+	for i, spk := range layout {
+		stereo[0][i] = stereoDownmix[spk][0]
+		stereo[1][i] = stereoDownmix[spk][1]
+	}
+
+	matrix := stereo
+	if out == 1 {
+		mono := make([]float64, in)
+		for i := range mono {
+			mono[i] = stereo[0][i] + stereo[1][i]
+		}
+		matrix = [][]float64{mono}
+	}
+
+	var peak float64
+	for _, row := range matrix {
+		var sum float64
+		for _, g := range row {
+			sum += math.Abs(g)
+		}
+		peak = math.Max(peak, sum)
+	}
+	for _, row := range matrix {
+		for i := range row {
+			row[i] /= peak
+		}
+	}
+	return matrix, nil
+}
+
+// checkMix validates a mixing matrix for in input channels
+func checkMix(matrix [][]float64, in int) error {
+	if len(matrix) < 1 || len(matrix) > maxChannels {
+		return fmt.Errorf("channel matrix has %d rows (1-%d output channels)", len(matrix), maxChannels)
+	}
+	for i, row := range matrix {
+		if len(row) != in {
+			return fmt.Errorf("channel matrix row %d has %d columns, input has %d channels", i, len(row), in)
+		}
+	}
+	return nil
+}
+
+// mixer remaps channels: each output channel is a weighted sum of the
+// input channels, one matrix row per output channel. Results are rounded
+// and clipped to the bit depth.
+type mixer struct {
+	matrix [][]float64
+	in     int
+	lo, hi float64
+}
+
+func newMixer(matrix [][]float64, in, bitDepth int) *mixer {
+	return &mixer{
+		matrix: matrix,
+		in:     in,
+		lo:     -float64(int64(1) << (bitDepth - 1)),
+		hi:     float64(int64(1)<<(bitDepth-1) - 1),
+	}
+}
+
+// Process mixes a chunk to the output channel count
+func (m *mixer) Process(pcm *PCMData) *PCMData {
+	frames := len(pcm.Samples) / m.in
+	out := make([]int32, 0, frames*len(m.matrix))
+	for f := 0; f < frames; f++ {
+		frame := pcm.Samples[f*m.in : (f+1)*m.in]
+		for _, row := range m.matrix {
+			var y float64
+			for i, g := range row {
+				y += g * float64(frame[i])
+			}
+			out = append(out, int32(math.Max(m.lo, math.Min(m.hi, math.Round(y)))))
+		}
+	}
+
+	return &PCMData{
+		Samples:    out,
+		SampleRate: pcm.SampleRate,
+		Channels:   len(m.matrix),
+		BitDepth:   pcm.BitDepth,
+	}
+}
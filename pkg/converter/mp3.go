@@ -0,0 +1,550 @@
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	shinemp3 "github.com/braheezy/shine-mp3/pkg/mp3"
+	gomp3 "github.com/hajimehoshi/go-mp3"
+)
+
+func init() {
+	RegisterDecoder(DecoderInfo{
+		Format:     FormatMP3,
+		Name:       "MP3",
+		Extensions: []string{"mp3"},
+		Probe:      probeMP3,
+		Tags:       true,
+		Pictures:   true,
+		New:        func(r io.Reader) (Decoder, error) { return newMP3Decoder(r) },
+	})
+	RegisterEncoder(EncoderInfo{
+		Format:      FormatMP3,
+		Name:        "MP3",
+		Extensions:  []string{"mp3"},
+		Lossy:       true,
+		BitDepths:   []int{16},
+		MaxChannels: 2,
+		Tags:        true,
+		Pictures:    true,
+		New: func(w io.Writer, cfg EncoderConfig) (Encoder, error) {
+			c := cfg.Converter
+			mode := c.MP3Mode
+			if mode == "" {
+				mode = MP3CBR
+			}
+			return newMP3Encoder(w, cfg.SampleRate, cfg.Channels, mode, c.Bitrate, c.VBRQuality)
+		},
+	})
+}
+
+// probeMP3 matches a stream starting with a Layer III frame. When the next
+// frame's header is in b it has to match, since a lone frame sync is
+// easily found in other data.
+func probeMP3(b []byte) bool {
+	h, ok := parseMPEGHeader(b)
+	if !ok || h.layer != 3 {
+		return false
+	}
+	if next := h.frameSize(); next+4 <= len(b) {
+		h2, ok := parseMPEGHeader(b[next:])
+		return ok && h2.version == h.version && h2.layer == h.layer && h2.sampleRate == h.sampleRate
+	}
+	return true
+}
+
+// mp3Decoder reads 16-bit PCM from go-mp3 chunk by chunk. go-mp3 always
+// decodes to stereo; for mono streams the duplicate channel is dropped.
+// Tags come from a leading ID3v2 tag and, when the input is seekable, a
+// trailing ID3v1 tag filling in fields ID3v2 lacks.
+//
+// A Xing/Info frame is removed before go-mp3 sees it, and when it has a
+// LAME tag the encoder and decoder delay is trimmed from the start and the
+// padding from the end, so the output lines up with the encoder's input.
+type mp3Decoder struct {
+	dec      *gomp3.Decoder
+	channels int
+	buf      []byte
+	id3      *id3Tag
+	skip     int64 // frames still to drop from the start
+	keep     int64 // frames left to return after that, -1 for all
+}
+
+func newMP3Decoder(r io.Reader) (*mp3Decoder, error) {
+	var v1 Tags
+	if rs, ok := r.(io.ReadSeeker); ok {
+		var err error
+		if v1, err = readID3v1(rs); err != nil {
+			return nil, fmt.Errorf("read ID3v1 tag: %w", err)
+		}
+	}
+
+	br := bufio.NewReader(r)
+	id3, err := readID3v2(br)
+	if err != nil {
+		return nil, err
+	}
+	id3.mergeID3v1(v1)
+	skip, keep, err := readXing(br)
+	if err != nil {
+		return nil, err
+	}
+	channels := 2
+	if mpegMono(br) {
+		channels = 1
+	}
+
+	dec, err := gomp3.NewDecoder(br)
+	if err != nil {
+		return nil, err
+	}
+	return &mp3Decoder{
+		dec:      dec,
+		channels: channels,
+		buf:      make([]byte, chunkFrames*2*2),
+		id3:      id3,
+		skip:     skip,
+		keep:     keep,
+	}, nil
+}
+
+func (d *mp3Decoder) SampleRate() int     { return d.dec.SampleRate() }
+func (d *mp3Decoder) Channels() int       { return d.channels }
+func (d *mp3Decoder) BitDepth() int       { return 16 }
+func (d *mp3Decoder) Tags() Tags          { return d.id3.tags }
+func (d *mp3Decoder) Pictures() []Picture { return d.id3.pictures }
+
+// readXing consumes a Xing/Info frame at the start of br, if there is
+// one, and returns how many decoded frames to skip and keep (see
+// xingHeader.trimFrames)
+func readXing(br *bufio.Reader) (skip, keep int64, err error) {
+	hdr, _ := br.Peek(4)
+	h, ok := parseMPEGHeader(hdr)
+	if !ok {
+		return 0, -1, nil
+	}
+	frame, _ := br.Peek(h.frameSize())
+	x, ok := parseXing(frame)
+	if !ok {
+		return 0, -1, nil
+	}
+	if _, err := br.Discard(len(frame)); err != nil {
+		return 0, 0, fmt.Errorf("skip Xing frame: %w", err)
+	}
+	skip, keep = x.trimFrames(h.samplesPerFrame())
+	return skip, keep, nil
+}
+
+// mpegMono peeks at the first MPEG audio frame header in br and reports
+// whether its channel mode is single channel
+func mpegMono(br *bufio.Reader) bool {
+	buf, _ := br.Peek(4096)
+	for i := 0; i+4 <= len(buf); i++ {
+		if h, ok := parseMPEGHeader(buf[i:]); ok {
+			return h.channels == 1
+		}
+	}
+	return false
+}
+
+// mpegHeader is a decoded MPEG audio frame header
+type mpegHeader struct {
+	version    int // 1, 2, or 25 for MPEG-2.5
+	layer      int
+	bitrate    int // kbps
+	sampleRate int
+	padding    bool
+	channels   int
+}
+
+var mpegSampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+// Layer I and II bitrates; Layer III's are mpeg1Bitrates and mpeg2Bitrates
+var (
+	mpeg1L1Bitrates = []int{32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}
+	mpeg1L2Bitrates = []int{32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384}
+	mpeg2L1Bitrates = []int{32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}
+)
+
+// parseMPEGHeader decodes the 4-byte frame header at the start of b. It
+// rejects free-format and reserved values, which also weeds out most
+// false syncs.
+func parseMPEGHeader(b []byte) (mpegHeader, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mpegHeader{}, false
+	}
+	var h mpegHeader
+	switch b[1] >> 3 & 0x03 {
+	case 0:
+		h.version = 25
+	case 2:
+		h.version = 2
+	case 3:
+		h.version = 1
+	default:
+		return mpegHeader{}, false
+	}
+	h.layer = 4 - int(b[1]>>1&0x03)
+	bitrateIndex, rateIndex := int(b[2]>>4), int(b[2]>>2&0x03)
+	if h.layer == 4 || bitrateIndex == 0 || bitrateIndex == 0x0F || rateIndex == 3 {
+		return mpegHeader{}, false
+	}
+
+	var rates []int
+	switch {
+	case h.version == 1 && h.layer == 1:
+		rates = mpeg1L1Bitrates
+	case h.version == 1 && h.layer == 2:
+		rates = mpeg1L2Bitrates
+	case h.version == 1:
+		rates = mpeg1Bitrates
+	case h.layer == 1:
+		rates = mpeg2L1Bitrates
+	default:
+		rates = mpeg2Bitrates
+	}
+	h.bitrate = rates[bitrateIndex-1]
+	h.sampleRate = mpegSampleRates[h.version][rateIndex]
+	h.padding = b[2]&0x02 != 0
+	h.channels = 2
+	if b[3]>>6 == 0x03 {
+		h.channels = 1
+	}
+	return h, true
+}
+
+// samplesPerFrame returns the samples per channel in one frame
+func (h mpegHeader) samplesPerFrame() int {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && h.version != 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// frameSize returns the frame's length in bytes, header included
+func (h mpegHeader) frameSize() int {
+	if h.layer == 1 {
+		size := 12 * h.bitrate * 1000 / h.sampleRate
+		if h.padding {
+			size++
+		}
+		return size * 4
+	}
+	size := h.samplesPerFrame() / 8 * h.bitrate * 1000 / h.sampleRate
+	if h.padding {
+		size++
+	}
+	return size
+}
+
+func (d *mp3Decoder) ReadChunk() (*PCMData, error) {
+	for {
+		if d.keep == 0 {
+			return nil, io.EOF
+		}
+		n, err := io.ReadFull(d.dec, d.buf)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		// go-mp3 output is stereo, 4 bytes a frame
+		frames := int64(n / 4)
+		if frames == 0 {
+			return nil, io.EOF
+		}
+		start := min(d.skip, frames)
+		d.skip -= start
+		end := frames
+		if d.keep >= 0 {
+			end = min(end, start+d.keep)
+			d.keep -= end - start
+		}
+		if start == end {
+			continue
+		}
+
+		// Mono keeps the left copy of each frame
+		step := 2
+		if d.channels == 1 {
+			step = 4
+		}
+		pcm := d.buf[start*4 : end*4]
+		samples := make([]int32, len(pcm)/step)
+		for i := range samples {
+			samples[i] = int32(int16(binary.LittleEndian.Uint16(pcm[i*step:])))
+		}
+
+		return &PCMData{
+			Samples:    samples,
+			SampleRate: d.dec.SampleRate(),
+			Channels:   d.channels,
+			BitDepth:   16,
+		}, nil
+	}
+}
+
+// mp3Encoder feeds shine one MPEG frame at a time, carrying leftover
+// samples over to the next chunk. The last partial frame is zero-padded.
+// shine takes 16-bit input, so deeper samples are reduced first. Each
+// frame's bitrate comes from the rate controller. Tags are written as an
+// ID3v2.4 tag before the first frame and an ID3v1.1 tag after the last.
+//
+// The audio is preceded by a Xing/Info frame with a LAME tag giving the
+// encoder delay. Its frame count, byte count, seek table and end padding
+// are patched in on Close if w is an io.WriteSeeker; otherwise gapless
+// decoders can only trim the start.
+type mp3Encoder struct {
+	w            io.Writer
+	enc          *shinemp3.Encoder
+	rate         *mp3RateController
+	channels     int
+	frameSamples int // samples per channel in an MPEG frame
+	frameLen     int // interleaved samples per MPEG frame
+	pending      []int16
+	hasWritten   bool
+	tags         Tags
+	pictures     []Picture
+
+	frame      bytes.Buffer // output of the frame being written
+	samples    int64        // input frames so far
+	frameSizes []uint32
+	audioSize  int64 // total of frameSizes
+	written    int64 // audio bytes shine has output
+	minKbps    int
+
+	xing      xingHeader
+	xingModel []byte // header of the first audio frame
+	xingKbps  int
+	xingAt    int64 // output offset of the Xing frame
+	seekable  bool
+}
+
+// defaultMP3Bitrate is the CBR rate of encodeMP3
+const defaultMP3Bitrate = 128
+
+func newMP3Encoder(w io.Writer, sampleRate, channels int, mode MP3Mode, kbps, quality int) (*mp3Encoder, error) {
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("mp3: unsupported channel count %d", channels)
+	}
+
+	enc := shinemp3.NewEncoder(sampleRate, channels)
+	frameSamples := int(enc.Mpeg.GranulesPerFrame) * shinemp3.GRANULE_SIZE
+	frameLen := frameSamples * channels
+
+	rate, err := newMP3RateController(mode, kbps, quality, sampleRate, channels, frameSamples)
+	if err != nil {
+		return nil, fmt.Errorf("mp3: %w", err)
+	}
+
+	e := &mp3Encoder{
+		w:            w,
+		enc:          enc,
+		rate:         rate,
+		channels:     channels,
+		frameSamples: frameSamples,
+		frameLen:     frameLen,
+		// shine walks the frame with unsafe pointers and keeps one that
+		// has stepped past the last sample; the spare room keeps it
+		// inside this allocation, where the garbage collector expects it
+		pending: make([]int16, 0, frameLen+2*channels),
+		xing: xingHeader{
+			vbr:    mode != MP3CBR,
+			method: lameMethod(mode),
+			delay:  shineEncoderDelay,
+		},
+	}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		_, err := ws.Seek(0, io.SeekCurrent)
+		e.seekable = err == nil
+	}
+	return e, nil
+}
+
+func (e *mp3Encoder) SetTags(tags Tags)              { e.tags = tags }
+func (e *mp3Encoder) SetPictures(pictures []Picture) { e.pictures = pictures }
+
+func (e *mp3Encoder) WriteChunk(pcm *PCMData) error {
+	samples := convertBitDepth(pcm.Samples, pcm.bits(), 16)
+	e.samples += int64(len(samples) / e.channels)
+	for len(samples) > 0 {
+		n := e.frameLen - len(e.pending)
+		if n > len(samples) {
+			n = len(samples)
+		}
+		for _, s := range samples[:n] {
+			e.pending = append(e.pending, int16(s))
+		}
+		samples = samples[n:]
+
+		if len(e.pending) == e.frameLen {
+			if err := e.flushFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *mp3Encoder) Close() error {
+	if len(e.pending) > 0 {
+		for len(e.pending) < e.frameLen {
+			e.pending = append(e.pending, 0)
+		}
+		if err := e.flushFrame(); err != nil {
+			return err
+		}
+	}
+	if !e.hasWritten {
+		return fmt.Errorf("no samples to encode")
+	}
+
+	// Gapless decoders trim the padding less their own delay from the end,
+	// so the padding must cover that delay for the last samples to come out
+	for e.padding() < mp3DecoderDelay {
+		e.pending = append(e.pending, make([]int16, e.frameLen)...)
+		if err := e.flushFrame(); err != nil {
+			return err
+		}
+	}
+	if err := e.flushTail(); err != nil {
+		return err
+	}
+
+	if len(e.tags) > 0 {
+		if err := writeID3v1(e.w, e.tags); err != nil {
+			return fmt.Errorf("write ID3v1 tag: %w", err)
+		}
+	}
+	if e.seekable {
+		return e.patchXing()
+	}
+	return nil
+}
+
+// padding returns the samples after the end of the input in the frames
+// written so far
+func (e *mp3Encoder) padding() int {
+	return int(int64(len(e.frameSizes)*e.frameSamples) - shineEncoderDelay - e.samples)
+}
+
+func (e *mp3Encoder) flushFrame() error {
+	kbps := e.rate.next(e.pending, e.channels)
+	setMP3Bitrate(e.enc, kbps, e.rate.rates)
+	e.frame.Reset()
+	if err := e.enc.Write(&e.frame, e.pending); err != nil {
+		return fmt.Errorf("encode mp3: %w", err)
+	}
+	e.pending = e.pending[:0]
+
+	if !e.hasWritten {
+		if err := e.writeHeaders(e.frame.Bytes()); err != nil {
+			return err
+		}
+		e.minKbps = kbps
+	}
+	e.hasWritten = true
+	e.minKbps = min(e.minKbps, kbps)
+	// shine writes in 32-bit words, so its output doesn't end on frame
+	// boundaries; the frame's size comes from its header
+	e.frameSizes = append(e.frameSizes, uint32(e.enc.Mpeg.BitsPerFrame/8))
+	e.audioSize += e.enc.Mpeg.BitsPerFrame / 8
+	e.written += int64(e.frame.Len())
+	if _, err := e.w.Write(e.frame.Bytes()); err != nil {
+		return fmt.Errorf("encode mp3: %w", err)
+	}
+	return nil
+}
+
+// flushTail writes the end of the last frame, which shine holds back
+// until more output follows, by encoding a frame that is thrown away
+func (e *mp3Encoder) flushTail() error {
+	missing := e.audioSize - e.written
+	if missing <= 0 {
+		return nil
+	}
+	e.pending = append(e.pending[:0], make([]int16, e.frameLen)...)
+	e.frame.Reset()
+	if err := e.enc.Write(&e.frame, e.pending); err != nil {
+		return fmt.Errorf("encode mp3: %w", err)
+	}
+	e.pending = e.pending[:0]
+	if _, err := e.w.Write(e.frame.Bytes()[:missing]); err != nil {
+		return fmt.Errorf("encode mp3: %w", err)
+	}
+	e.written += missing
+	return nil
+}
+
+// writeHeaders writes the ID3v2 tag and a placeholder Xing frame modelled
+// on the first audio frame
+func (e *mp3Encoder) writeHeaders(first []byte) error {
+	if len(e.tags) > 0 || len(e.pictures) > 0 {
+		if err := writeID3v2(e.w, e.tags, e.pictures); err != nil {
+			return fmt.Errorf("write ID3v2 tag: %w", err)
+		}
+	}
+
+	h, ok := parseMPEGHeader(first)
+	if !ok {
+		return fmt.Errorf("encode mp3: bad frame header % x", first[:min(4, len(first))])
+	}
+	e.xingModel = append([]byte(nil), first[:4]...)
+	// CBR streams keep one bitrate throughout if the header fits
+	e.xingKbps = xingBitrate(h, e.rate.kbps, e.rate.rates)
+	if e.rate.mode == MP3VBR {
+		e.xingKbps = xingBitrate(h, e.rate.rates[0], e.rate.rates)
+	}
+
+	if e.seekable {
+		pos, err := e.w.(io.WriteSeeker).Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		e.xingAt = pos
+	}
+	e.xing.bitrate = e.rate.kbps
+	if _, err := e.w.Write(e.xing.marshal(e.xingModel, e.xingKbps, e.rate.rates)); err != nil {
+		return fmt.Errorf("write Xing header: %w", err)
+	}
+	return nil
+}
+
+// patchXing rewrites the Xing frame with the stream's totals, seek table
+// and padding, then returns to the end of the output
+func (e *mp3Encoder) patchXing() error {
+	ws := e.w.(io.WriteSeeker)
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	size := len(e.xing.marshal(e.xingModel, e.xingKbps, e.rate.rates))
+	e.xing.setTOC(size, e.frameSizes)
+	e.xing.padding = e.padding()
+	if e.rate.mode == MP3VBR {
+		e.xing.bitrate = e.minKbps
+	}
+
+	if _, err := ws.Seek(e.xingAt, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(e.xing.marshal(e.xingModel, e.xingKbps, e.rate.rates)); err != nil {
+		return fmt.Errorf("write Xing header: %w", err)
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
@@ -0,0 +1,204 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	shinemp3 "github.com/braheezy/shine-mp3/pkg/mp3"
+)
+
+// MP3Mode selects how the MP3 encoder spends bits
+type MP3Mode string
+
+const (
+	// MP3CBR encodes every frame at Bitrate
+	MP3CBR MP3Mode = "cbr"
+	// MP3VBR picks each frame's bitrate from how busy its audio is, up to
+	// a ceiling set by VBRQuality
+	MP3VBR MP3Mode = "vbr"
+	// MP3ABR varies the bitrate like VBR while steering the average
+	// towards Bitrate
+	MP3ABR MP3Mode = "abr"
+)
+
+const (
+	// DefaultVBRQuality is the VBR quality New starts with
+	DefaultVBRQuality = 4
+	// MaxVBRQuality is the smallest, lowest quality VBR setting
+	MaxVBRQuality = 9
+)
+
+// ParseMP3Mode returns the MP3Mode named s
+func ParseMP3Mode(s string) (MP3Mode, error) {
+	switch m := MP3Mode(s); m {
+	case MP3CBR, MP3VBR, MP3ABR:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown MP3 mode %q (cbr, vbr, abr)", s)
+}
+
+// Layer III bitrates in kbps, excluding free format
+var (
+	mpeg1Bitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	// MPEG-2 and MPEG-2.5 share a table
+	mpeg2Bitrates = []int{8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
+// vbrCeilings is the bitrate a frame of full-band noise gets at each VBR
+// quality, for MPEG-1 stereo
+var vbrCeilings = [MaxVBRQuality + 1]float64{320, 256, 224, 192, 160, 128, 112, 96, 80, 64}
+
+// mp3Bitrates returns the legal bitrates at a sample rate, ascending, or
+// nil if MP3 can't be encoded at that rate
+func mp3Bitrates(sampleRate int) []int {
+	switch sampleRate {
+	case 32000, 44100, 48000:
+		return mpeg1Bitrates
+	case 16000, 22050, 24000, 8000, 11025, 12000:
+		return mpeg2Bitrates
+	default:
+		return nil
+	}
+}
+
+// checkMP3Bitrate rejects bitrates the MPEG version used at sampleRate
+// can't signal
+func checkMP3Bitrate(kbps, sampleRate int) error {
+	rates := mp3Bitrates(sampleRate)
+	for _, r := range rates {
+		if r == kbps {
+			return nil
+		}
+	}
+	legal := make([]string, len(rates))
+	for i, r := range rates {
+		legal[i] = fmt.Sprint(r)
+	}
+	return fmt.Errorf("%d kbps is not a legal MP3 bitrate at %d Hz (%s)", kbps, sampleRate, strings.Join(legal, ", "))
+}
+
+// mp3RateController chooses each frame's bitrate. shine runs without a
+// bit reservoir, so every frame is self-contained and the rate can change
+// from one frame to the next.
+//
+// VBR and ABR rate a frame by its complexity: the level of its first
+// difference, in bits, over that of full-scale noise. Silence scores 0 and
+// noise 1; tonal music falls in between and rises with its treble.
+type mp3RateController struct {
+	mode  MP3Mode
+	rates []int
+	kbps  int // CBR rate, ABR target
+
+	ceiling float64 // VBR: kbps at complexity 1
+
+	// ABR: bits spent against the target so far, and the mean complexity
+	spent, budget  float64
+	meanComplexity float64
+	frameBits      float64 // bits per frame at 1 kbps
+}
+
+func newMP3RateController(mode MP3Mode, kbps, quality, sampleRate, channels, frameSamples int) (*mp3RateController, error) {
+	rates := mp3Bitrates(sampleRate)
+	if rates == nil {
+		return nil, fmt.Errorf("unsupported sample rate %d", sampleRate)
+	}
+	rc := &mp3RateController{
+		mode:           mode,
+		rates:          rates,
+		kbps:           kbps,
+		meanComplexity: 0.5,
+		frameBits:      1000 * float64(frameSamples) / float64(sampleRate),
+	}
+
+	switch mode {
+	case MP3CBR, MP3ABR:
+		if err := checkMP3Bitrate(kbps, sampleRate); err != nil {
+			return nil, err
+		}
+	case MP3VBR:
+		if quality < 0 || quality > MaxVBRQuality {
+			return nil, fmt.Errorf("invalid VBR quality %d (0-%d)", quality, MaxVBRQuality)
+		}
+		rc.ceiling = vbrCeilings[quality]
+		if sampleRate < 32000 {
+			rc.ceiling /= 2
+		}
+		if channels == 1 {
+			rc.ceiling *= 0.6
+		}
+	default:
+		return nil, fmt.Errorf("unknown MP3 mode %q", mode)
+	}
+	return rc, nil
+}
+
+// next returns the bitrate for a frame of interleaved samples
+func (rc *mp3RateController) next(frame []int16, channels int) int {
+	switch rc.mode {
+	case MP3VBR:
+		return rc.snap(rc.ceiling * frameComplexity(frame, channels))
+
+	case MP3ABR:
+		c := frameComplexity(frame, channels)
+		rc.meanComplexity += (c - rc.meanComplexity) / 32
+
+		// Busier than average frames get more than the target; the
+		// running surplus or deficit pulls the next frames back
+		want := float64(rc.kbps) * (0.5 + 0.5*c/math.Max(rc.meanComplexity, 0.05))
+		want *= math.Max(0.5, math.Min(2, 1+(rc.budget-rc.spent)/(16*rc.frameBits*float64(rc.kbps))))
+		kbps := rc.snap(want)
+
+		rc.budget += rc.frameBits * float64(rc.kbps)
+		rc.spent += rc.frameBits * float64(kbps)
+		return kbps
+
+	default:
+		return rc.kbps
+	}
+}
+
+// snap returns the lowest legal bitrate of at least kbps, or the highest
+func (rc *mp3RateController) snap(kbps float64) int {
+	for _, r := range rc.rates {
+		if float64(r) >= kbps {
+			return r
+		}
+	}
+	return rc.rates[len(rc.rates)-1]
+}
+
+// frameComplexity scores a frame from 0 (silence) to about 1 (full-scale
+// white noise)
+func frameComplexity(frame []int16, channels int) float64 {
+	var sum float64
+	for i := channels; i < len(frame); i++ {
+		d := float64(frame[i]) - float64(frame[i-channels])
+		sum += d * d
+	}
+	rms := math.Sqrt(sum / float64(max(1, len(frame)-channels)))
+	// Full-scale noise has a difference RMS near 2^15
+	return math.Min(1, math.Log2(1+rms)/15)
+}
+
+// setMP3Bitrate switches a shine encoder to kbps from its next frame. It
+// redoes what NewEncoder derives from the (fixed, 128 kbps) bitrate.
+func setMP3Bitrate(enc *shinemp3.Encoder, kbps int, rates []int) {
+	if int(enc.Mpeg.Bitrate) == kbps {
+		return
+	}
+	for i, r := range rates {
+		if r == kbps {
+			// Index 0 is free format
+			enc.Mpeg.BitrateIndex = int64(i + 1)
+		}
+	}
+	enc.Mpeg.Bitrate = int64(kbps)
+
+	slots := float64(enc.Mpeg.GranulesPerFrame*shinemp3.GRANULE_SIZE) / float64(enc.Wave.SampleRate) *
+		float64(kbps) * 1000 / float64(enc.Mpeg.BitsPerSlot)
+	enc.Mpeg.WholeSlotsPerFrame = int64(slots)
+	enc.Mpeg.FracSlotsPerFrame = slots - float64(enc.Mpeg.WholeSlotsPerFrame)
+	enc.Mpeg.Slot_lag = -enc.Mpeg.FracSlotsPerFrame
+	enc.Mpeg.Padding = 0
+}
@@ -0,0 +1,79 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+func init() {
+	RegisterDecoder(DecoderInfo{
+		Format:     FormatOGG,
+		Name:       "OGG Vorbis",
+		Extensions: []string{"ogg", "oga", "ogv"},
+		Probe:      func(b []byte) bool { return oggCodec(b) == "Vorbis" },
+		Tags:       true,
+		New:        func(r io.Reader) (Decoder, error) { return newOGGDecoder(r) },
+	})
+}
+
+// errOGGEncoding is returned for OGG output.
+// Note: Pure Go Vorbis encoding doesn't exist. Use CGO with libvorbis (github.com/xlab/vorbis-go)
+var errOGGEncoding = fmt.Errorf("OGG/Vorbis encoding not yet implemented - no pure Go encoder exists, consider CGO with libvorbis")
+
+// oggDecoder reads float samples from oggvorbis and converts them to 16-bit
+type oggDecoder struct {
+	reader *oggvorbis.Reader
+	buf    []float32
+}
+
+func newOGGDecoder(r io.Reader) (*oggDecoder, error) {
+	reader, err := oggvorbis.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("open ogg: %w", err)
+	}
+	return &oggDecoder{
+		reader: reader,
+		buf:    make([]float32, chunkFrames*reader.Channels()),
+	}, nil
+}
+
+func (d *oggDecoder) SampleRate() int { return d.reader.SampleRate() }
+func (d *oggDecoder) Channels() int   { return d.reader.Channels() }
+func (d *oggDecoder) BitDepth() int   { return 16 }
+
+// Tags returns the Vorbis comments from the stream's comment header
+func (d *oggDecoder) Tags() Tags {
+	return parseVorbisComments(d.reader.CommentHeader().Comments)
+}
+
+func (d *oggDecoder) ReadChunk() (*PCMData, error) {
+	for {
+		n, err := d.reader.Read(d.buf)
+		if n > 0 {
+			samples := make([]int32, n)
+			for i := 0; i < n; i++ {
+				sample := d.buf[i]
+				if sample > 1.0 {
+					sample = 1.0
+				} else if sample < -1.0 {
+					sample = -1.0
+				}
+				samples[i] = int32(sample * 32767)
+			}
+			return &PCMData{
+				Samples:    samples,
+				SampleRate: d.reader.SampleRate(),
+				Channels:   d.reader.Channels(),
+				BitDepth:   16,
+			}, nil
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read ogg: %w", err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package converter
+
+// defaultBitDepth is assumed for PCMData that doesn't declare BitDepth
+const defaultBitDepth = 16
+
+// bits returns the bit depth of the samples
+func (p *PCMData) bits() int {
+	if p.BitDepth == 0 {
+		return defaultBitDepth
+	}
+	return p.BitDepth
+}
+
+// convertBitDepth rescales samples from one bit depth to another by
+// shifting. Widening is lossless; narrowing truncates the low bits.
+func convertBitDepth(samples []int32, from, to int) []int32 {
+	if from == to {
+		return samples
+	}
+
+	out := make([]int32, len(samples))
+	if to > from {
+		shift := to - from
+		for i, s := range samples {
+			out[i] = s << shift
+		}
+	} else {
+		shift := from - to
+		for i, s := range samples {
+			out[i] = s >> shift
+		}
+	}
+	return out
+}
@@ -0,0 +1,241 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Decoder reads decoded audio in chunks. A decoder may also implement
+// Tags() Tags, Pictures() []Picture and WAVMetadata() *WAVMetadata to hand
+// its input's metadata to encoders that can store it, ChannelMask() uint32
+// to give its speaker layout as WAVE_FORMAT_EXTENSIBLE speaker bits, and
+// FloatBits() int if its input is floating point.
+type Decoder interface {
+	SampleRate() int
+	Channels() int
+	// BitDepth is the resolution of the decoded samples
+	BitDepth() int
+	// ReadChunk returns the next block of interleaved samples, or io.EOF
+	// once the stream is exhausted
+	ReadChunk() (*PCMData, error)
+}
+
+// Encoder writes audio chunk by chunk. Close must be called to finish the
+// output stream (trailing frames, header sizes). An encoder may also
+// implement SetTags(Tags), SetPictures([]Picture) and
+// SetWAVMetadata(*WAVMetadata), which are called before the first
+// WriteChunk.
+type Encoder interface {
+	WriteChunk(pcm *PCMData) error
+	Close() error
+}
+
+// DecoderInfo describes a decoder for RegisterDecoder
+type DecoderInfo struct {
+	Format Format
+	// Name is shown to users, e.g. "FLAC"
+	Name string
+	// Extensions are the file extensions DetectFormat maps to Format,
+	// lower case and without the dot
+	Extensions []string
+	// Probe reports whether the start of a stream is in this format. It
+	// gets up to 4 KiB, past any ID3v2 tag. Nil leaves the format to be
+	// detected by extension only.
+	Probe func(header []byte) bool
+	// Tags and Pictures tell whether the decoder reads metadata
+	Tags, Pictures bool
+	// New returns a decoder reading from r
+	New func(r io.Reader) (Decoder, error)
+}
+
+// EncoderInfo describes an encoder for RegisterEncoder
+type EncoderInfo struct {
+	Format     Format
+	Name       string
+	Extensions []string
+	// Lossy is set for encoders that discard audio information
+	Lossy bool
+	// BitDepths lists the sample resolutions the encoder writes. With a
+	// single entry every stream is encoded at it; otherwise Converter's
+	// BitDepth is used if set, or the input's.
+	BitDepths []int
+	// MaxDefaultBitDepth, if set, caps the input's bit depth when
+	// Converter.BitDepth is 0
+	MaxDefaultBitDepth int
+	// MaxChannels, if set, is the most channels the encoder takes; wider
+	// input is downmixed to it unless Converter.Channels says otherwise
+	MaxChannels int
+	// Float is set for encoders that can write floating point samples,
+	// 32 or 64 bits wide
+	Float bool
+	// Tags and Pictures tell whether the encoder stores metadata
+	Tags, Pictures bool
+	// New returns an encoder writing to w
+	New func(w io.Writer, cfg EncoderConfig) (Encoder, error)
+}
+
+// EncoderConfig is the stream an encoder is created for
+type EncoderConfig struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	// Float asks for floating point samples, BitDepth wide
+	Float bool
+	// ChannelMask is the speaker layout as WAVE_FORMAT_EXTENSIBLE speaker
+	// bits, 0 for the default layout of Channels
+	ChannelMask uint32
+	// Converter carries the remaining settings, such as Bitrate and
+	// FLACLevel, for encoders that take options
+	Converter *Converter
+}
+
+// registry holds the codecs in registration order
+var registry struct {
+	sync.RWMutex
+	decoders []DecoderInfo
+	encoders []EncoderInfo
+}
+
+// RegisterDecoder makes a decoder available to Convert, ConvertFile,
+// DetectFormat and DetectFormatFromReader. Registering a Format again
+// replaces its decoder. When codecs claim the same extension or their
+// probes both match, the one registered last wins.
+func RegisterDecoder(info DecoderInfo) {
+	if info.Format == FormatUnknown || info.New == nil {
+		panic("converter: RegisterDecoder needs a Format and New")
+	}
+	info.Extensions = lowerAll(info.Extensions)
+
+	registry.Lock()
+	defer registry.Unlock()
+	for i, d := range registry.decoders {
+		if d.Format == info.Format {
+			registry.decoders[i] = info
+			return
+		}
+	}
+	registry.decoders = append(registry.decoders, info)
+}
+
+// RegisterEncoder makes an encoder available to Convert, ConvertFile and
+// DetectFormat. Registering a Format again replaces its encoder.
+func RegisterEncoder(info EncoderInfo) {
+	if info.Format == FormatUnknown || info.New == nil {
+		panic("converter: RegisterEncoder needs a Format and New")
+	}
+	info.Extensions = lowerAll(info.Extensions)
+
+	registry.Lock()
+	defer registry.Unlock()
+	for i, e := range registry.encoders {
+		if e.Format == info.Format {
+			registry.encoders[i] = info
+			return
+		}
+	}
+	registry.encoders = append(registry.encoders, info)
+}
+
+// LookupDecoder returns the decoder registered for format
+func LookupDecoder(format Format) (DecoderInfo, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, d := range registry.decoders {
+		if d.Format == format {
+			return d, true
+		}
+	}
+	return DecoderInfo{}, false
+}
+
+// LookupEncoder returns the encoder registered for format
+func LookupEncoder(format Format) (EncoderInfo, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, e := range registry.encoders {
+		if e.Format == format {
+			return e, true
+		}
+	}
+	return EncoderInfo{}, false
+}
+
+// Decoders returns the registered decoders, sorted by Format
+func Decoders() []DecoderInfo {
+	registry.RLock()
+	decoders := append([]DecoderInfo(nil), registry.decoders...)
+	registry.RUnlock()
+	sort.Slice(decoders, func(i, j int) bool { return decoders[i].Format < decoders[j].Format })
+	return decoders
+}
+
+// Encoders returns the registered encoders, sorted by Format
+func Encoders() []EncoderInfo {
+	registry.RLock()
+	encoders := append([]EncoderInfo(nil), registry.encoders...)
+	registry.RUnlock()
+	sort.Slice(encoders, func(i, j int) bool { return encoders[i].Format < encoders[j].Format })
+	return encoders
+}
+
+// formatByExtension returns the format a codec registered ext for
+func formatByExtension(ext string) Format {
+	registry.RLock()
+	defer registry.RUnlock()
+	for i := len(registry.encoders) - 1; i >= 0; i-- {
+		if slices.Contains(registry.encoders[i].Extensions, ext) {
+			return registry.encoders[i].Format
+		}
+	}
+	for i := len(registry.decoders) - 1; i >= 0; i-- {
+		if slices.Contains(registry.decoders[i].Extensions, ext) {
+			return registry.decoders[i].Format
+		}
+	}
+	return FormatUnknown
+}
+
+// probeFormat returns the format of the last registered decoder whose
+// probe matches header
+func probeFormat(header []byte) Format {
+	registry.RLock()
+	defer registry.RUnlock()
+	for i := len(registry.decoders) - 1; i >= 0; i-- {
+		if probe := registry.decoders[i].Probe; probe != nil && probe(header) {
+			return registry.decoders[i].Format
+		}
+	}
+	return FormatUnknown
+}
+
+// newDecoder returns a chunked decoder for the given input format
+func newDecoder(r io.Reader, format Format) (Decoder, error) {
+	info, ok := LookupDecoder(format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+	return info.New(r)
+}
+
+// newEncoder returns a chunked encoder for the given output format and
+// stream. Encoders convert chunks of any other depth by shifting.
+func (c *Converter) newEncoder(w io.Writer, format Format, cfg EncoderConfig) (Encoder, error) {
+	info, ok := LookupEncoder(format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+	cfg.Converter = c
+	return info.New(w, cfg)
+}
+
+func lowerAll(s []string) []string {
+	out := make([]string, len(s))
+	for i := range s {
+		out[i] = strings.ToLower(strings.TrimPrefix(s[i], "."))
+	}
+	return out
+}
@@ -0,0 +1,250 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+)
+
+// ResampleQuality selects the sample rate converter's filter
+type ResampleQuality string
+
+const (
+	// ResampleLinear interpolates between neighbouring samples. It is the
+	// fastest mode but doesn't filter, so downsampling aliases.
+	ResampleLinear ResampleQuality = "linear"
+	// ResampleLow is a short windowed-sinc filter: about 60 dB of alias
+	// rejection with a passband up to 60% of the lower Nyquist frequency
+	ResampleLow ResampleQuality = "low"
+	// ResampleMedium is about 80 dB of rejection with a passband up to
+	// 80% of the lower Nyquist frequency
+	ResampleMedium ResampleQuality = "medium"
+	// ResampleHigh is about 100 dB of rejection with a passband up to 90%
+	// of the lower Nyquist frequency
+	ResampleHigh ResampleQuality = "high"
+)
+
+// Sample rates TargetSampleRate accepts
+const (
+	minSampleRate = 1000
+	maxSampleRate = 768000
+)
+
+// maxResamplePhases bounds the precomputed polyphase table. Rate pairs
+// needing more phases (44100 -> 44101, say) compute taps per sample.
+const maxResamplePhases = 4096
+
+// sincFilter describes a Kaiser-windowed sinc low-pass
+type sincFilter struct {
+	zeroCrossings int     // per side of the kernel
+	attenuation   float64 // stopband attenuation in dB
+}
+
+var resampleFilters = map[ResampleQuality]sincFilter{
+	ResampleLow:    {zeroCrossings: 8, attenuation: 60},
+	ResampleMedium: {zeroCrossings: 24, attenuation: 80},
+	ResampleHigh:   {zeroCrossings: 64, attenuation: 100},
+}
+
+// ParseResampleQuality returns the ResampleQuality named s
+func ParseResampleQuality(s string) (ResampleQuality, error) {
+	q := ResampleQuality(s)
+	if _, ok := resampleFilters[q]; ok || q == ResampleLinear {
+		return q, nil
+	}
+	return "", fmt.Errorf("unknown resample quality %q (linear, low, medium, high)", s)
+}
+
+// resampler converts a stream between two sample rates chunk by chunk.
+// Output sample n sits at input position n*down/up, and is the input
+// convolved with a kernel centred there: a triangle for linear mode,
+// otherwise a sinc cut off below the lower of the two Nyquist frequencies.
+// The output isn't delayed: the first output sample is aligned with the
+// first input sample.
+type resampler struct {
+	from, to int
+	up, down int64 // to/from reduced to lowest terms
+	channels int
+	bitDepth int
+
+	half   int // kernel taps per side
+	kernel func(t float64) float64
+	table  [][]float64 // taps per phase, if precomputed
+
+	hist     [][]float64 // per channel; hist[ch][0] is input frame base
+	base     int64
+	inFrames int64
+	outN     int64 // next output frame
+}
+
+func newResampler(quality ResampleQuality, from, to, channels, bitDepth int) (*resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("invalid sample rates %d -> %d", from, to)
+	}
+
+	g := gcd(from, to)
+	r := &resampler{
+		from:     from,
+		to:       to,
+		up:       int64(to / g),
+		down:     int64(from / g),
+		channels: channels,
+		bitDepth: bitDepth,
+		hist:     make([][]float64, channels),
+	}
+
+	if quality == ResampleLinear {
+		r.half = 1
+		r.kernel = func(t float64) float64 { return max(0, 1-math.Abs(t)) }
+	} else {
+		f, ok := resampleFilters[quality]
+		if !ok {
+			return nil, fmt.Errorf("unknown resample quality %q", quality)
+		}
+		r.half, r.kernel = f.kernel(math.Min(1, float64(to)/float64(from)))
+	}
+
+	if r.up <= maxResamplePhases {
+		r.table = make([][]float64, r.up)
+		for p := range r.table {
+			r.table[p] = r.taps(int64(p))
+		}
+	}
+
+	// History before the first sample is silence
+	r.base = -int64(r.half - 1)
+	for ch := range r.hist {
+		r.hist[ch] = make([]float64, r.half-1)
+	}
+	return r, nil
+}
+
+// kernel returns the filter's taps per side and impulse response for a
+// rate ratio (output/input, at most 1), in input sample units.
+//
+// The cutoff sits where the Kaiser transition band ends at the lower
+// Nyquist frequency, so everything that would alias is attenuated.
+func (f sincFilter) kernel(ratio float64) (int, func(t float64) float64) {
+	// Kaiser: transition width in cycles/sample for a kernel of n taps is
+	// (A - 7.95) / (14.36 n); n = 2*zeroCrossings / (2*cutoff)
+	transition := (f.attenuation - 7.95) / (14.36 * float64(f.zeroCrossings))
+	cutoff := 0.5 * ratio / (1 + transition/2) // cycles per input sample
+
+	beta := 0.1102 * (f.attenuation - 8.7)
+	if f.attenuation <= 50 {
+		beta = 0.5842*math.Pow(f.attenuation-21, 0.4) + 0.07886*(f.attenuation-21)
+	}
+	width := float64(f.zeroCrossings) / (2 * cutoff)
+	norm := besselI0(beta)
+
+	kernel := func(t float64) float64 {
+		if math.Abs(t) >= width {
+			return 0
+		}
+		x := t / width
+		w := besselI0(beta*math.Sqrt(1-x*x)) / norm
+		if t == 0 {
+			return 2 * cutoff * w
+		}
+		return math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t) * w
+	}
+	return int(math.Ceil(width)), kernel
+}
+
+// taps returns the kernel weights for an output at phase p/up past an
+// input frame i, applied to input frames i-half+1 .. i+half
+func (r *resampler) taps(p int64) []float64 {
+	taps := make([]float64, 2*r.half)
+	frac := float64(p) / float64(r.up)
+	for j := range taps {
+		taps[j] = r.kernel(frac + float64(r.half-1-j))
+	}
+	return taps
+}
+
+// Process resamples a chunk. Output that depends on input not yet seen is
+// held back until the next chunk or Flush.
+func (r *resampler) Process(pcm *PCMData) *PCMData {
+	for i, s := range pcm.Samples {
+		ch := i % r.channels
+		r.hist[ch] = append(r.hist[ch], float64(s))
+	}
+	r.inFrames += int64(len(pcm.Samples) / r.channels)
+	return r.output(r.base + int64(len(r.hist[0])))
+}
+
+// Flush returns the output that was waiting for input past the end of
+// the stream, which is treated as silence
+func (r *resampler) Flush() *PCMData {
+	for ch := range r.hist {
+		r.hist[ch] = append(r.hist[ch], make([]float64, r.half)...)
+	}
+	return r.output(r.base + int64(len(r.hist[0])))
+}
+
+// output computes every output frame whose taps end before input frame
+// end, stopping at the stream's length in output frames, and drops the
+// history no later output needs
+func (r *resampler) output(end int64) *PCMData {
+	total := (r.inFrames*r.up + r.down - 1) / r.down
+	lo := -float64(int64(1) << (r.bitDepth - 1))
+	hi := float64(int64(1)<<(r.bitDepth-1) - 1)
+
+	var samples []int32
+	for ; r.outN < total; r.outN++ {
+		i := r.outN * r.down / r.up
+		if i+int64(r.half) > end-1 {
+			break
+		}
+		p := r.outN * r.down % r.up
+
+		taps := r.tapsAt(p)
+		start := int(i - int64(r.half) + 1 - r.base)
+		for ch := 0; ch < r.channels; ch++ {
+			var y float64
+			for j, w := range taps {
+				y += w * r.hist[ch][start+j]
+			}
+			samples = append(samples, int32(math.Max(lo, math.Min(hi, math.Round(y)))))
+		}
+	}
+
+	// Keep from the first frame the next output reads
+	next := r.outN*r.down/r.up - int64(r.half) + 1
+	if drop := min(int(next-r.base), len(r.hist[0])); drop > 0 {
+		for ch := range r.hist {
+			r.hist[ch] = append(r.hist[ch][:0], r.hist[ch][drop:]...)
+		}
+		r.base += int64(drop)
+	}
+
+	return &PCMData{
+		Samples:    samples,
+		SampleRate: r.to,
+		Channels:   r.channels,
+		BitDepth:   r.bitDepth,
+	}
+}
+
+func (r *resampler) tapsAt(p int64) []float64 {
+	if r.table != nil {
+		return r.table[p]
+	}
+	return r.taps(p)
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / 2) * (x / 2) / float64(k*k)
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
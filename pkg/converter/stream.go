@@ -0,0 +1,280 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// chunkFrames is the number of sample frames a decoder returns per chunk
+const chunkFrames = 4096
+
+// Convert transcodes audio read from r into w without loading the whole
+// stream into memory. Decoded chunks are piped into the encoder, remixed
+// first when the channel count changes (see Channels and ChannelMatrix),
+// resampled when TargetSampleRate is set and dithered when the output bit
+// depth is lower (see BitDepth and Dither).
+// If w implements io.WriteSeeker, headers that depend on the stream length
+// are patched on completion. Tags found in the input are carried over when
+// the output format can store them.
+func (c *Converter) Convert(ctx context.Context, r io.Reader, inFmt Format, w io.Writer, outFmt Format) error {
+	dec, err := newDecoder(r, inFmt)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	bitDepth, float, err := c.outputBitDepth(outFmt, dec)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	stages, err := c.newStages(dec, outFmt, bitDepth)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	cfg := EncoderConfig{
+		SampleRate: dec.SampleRate(),
+		BitDepth:   bitDepth,
+		Float:      float,
+	}
+	if c.TargetSampleRate != 0 {
+		cfg.SampleRate = c.TargetSampleRate
+	}
+	channels, matrix, err := c.channelMix(outFmt, dec)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	cfg.Channels = channels
+	// The speaker layout survives as long as the channels pass through
+	if mr, ok := dec.(channelMaskReader); ok && matrix == nil {
+		cfg.ChannelMask = mr.ChannelMask()
+	}
+	enc, err := c.newEncoder(w, outFmt, cfg)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	copyTags(dec, enc)
+	copyWAVMetadata(dec, enc, cfg.SampleRate)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk, err := dec.ReadChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decode: %w", err)
+		}
+
+		if err := writeThrough(stages, enc, chunk); err != nil {
+			return fmt.Errorf("encode: %w", err)
+		}
+	}
+
+	// Stages holding samples back release them, through the stages after them
+	for i, stage := range stages {
+		if f, ok := stage.(pcmFlusher); ok {
+			if err := writeThrough(stages[i+1:], enc, f.Flush()); err != nil {
+				return fmt.Errorf("encode: %w", err)
+			}
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return nil
+}
+
+// pcmStage transforms decoded chunks before they reach the encoder
+type pcmStage interface {
+	Process(pcm *PCMData) *PCMData
+}
+
+// pcmFlusher is implemented by stages whose output lags their input.
+// Flush is called once the input is exhausted and returns the rest.
+type pcmFlusher interface {
+	Flush() *PCMData
+}
+
+// writeThrough passes a chunk through stages and writes what comes out.
+// Stages may return empty chunks, which aren't written.
+func writeThrough(stages []pcmStage, enc Encoder, chunk *PCMData) error {
+	for _, stage := range stages {
+		chunk = stage.Process(chunk)
+	}
+	if len(chunk.Samples) == 0 {
+		return nil
+	}
+	return enc.WriteChunk(chunk)
+}
+
+// floatReader is implemented by decoders whose input holds floating point
+// samples. FloatBits is their width, 32 or 64; the decoded samples are
+// 32-bit integers either way.
+type floatReader interface {
+	FloatBits() int
+}
+
+// outputBitDepth returns the bit depth to encode at, and whether samples
+// are written as floating point: the encoder's only depth if it has a
+// single one, otherwise c.BitDepth if set, or the input's capped at the
+// encoder's MaxDefaultBitDepth (24 bits for FLAC). Float input stays float
+// for encoders that can write it unless c.BitDepth asks for integers.
+func (c *Converter) outputBitDepth(format Format, dec Decoder) (int, bool, error) {
+	switch {
+	case c.BitDepth == 0, c.BitDepth == 16, c.BitDepth == 24, c.BitDepth == 32:
+	case c.BitDepth == 64 && c.Float:
+	default:
+		return 0, false, fmt.Errorf("unsupported output bit depth %d (16, 24 or 32; 32 or 64 for float)", c.BitDepth)
+	}
+
+	info, ok := LookupEncoder(format)
+	if !ok {
+		return 0, false, fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	var floatBits int
+	if fr, ok := dec.(floatReader); ok {
+		floatBits = fr.FloatBits()
+	}
+	if c.Float || (floatBits != 0 && c.BitDepth == 0 && info.Float) {
+		switch {
+		case !info.Float:
+			return 0, false, fmt.Errorf("%s can't store float samples", format)
+		case c.BitDepth == 32 || c.BitDepth == 64:
+			return c.BitDepth, true, nil
+		case c.BitDepth != 0:
+			return 0, false, fmt.Errorf("float output is 32 or 64 bits, not %d", c.BitDepth)
+		case floatBits != 0:
+			return floatBits, true, nil
+		default:
+			return 32, true, nil
+		}
+	}
+
+	if len(info.BitDepths) == 1 {
+		return info.BitDepths[0], false, nil
+	}
+	if c.BitDepth != 0 {
+		return c.BitDepth, false, nil
+	}
+	if info.MaxDefaultBitDepth != 0 {
+		return min(dec.BitDepth(), info.MaxDefaultBitDepth), false, nil
+	}
+	return dec.BitDepth(), false, nil
+}
+
+// channelMix returns the output channel count and the matrix that mixes
+// down (or up) to it, nil if the channels pass through unchanged.
+// Standard downmixes follow the input's speaker layout when the decoder
+// knows it.
+func (c *Converter) channelMix(format Format, dec Decoder) (int, [][]float64, error) {
+	in := dec.Channels()
+	if c.ChannelMatrix != nil {
+		if err := checkMix(c.ChannelMatrix, in); err != nil {
+			return 0, nil, err
+		}
+		if c.Channels != 0 && c.Channels != len(c.ChannelMatrix) {
+			return 0, nil, fmt.Errorf("channel matrix has %d rows, but %d output channels were asked for", len(c.ChannelMatrix), c.Channels)
+		}
+		return len(c.ChannelMatrix), c.ChannelMatrix, nil
+	}
+
+	info, _ := LookupEncoder(format)
+	out := c.Channels
+	switch {
+	case out < 0 || out > maxChannels:
+		return 0, nil, fmt.Errorf("unsupported output channel count %d (1-%d)", out, maxChannels)
+	case out == 0 && info.MaxChannels != 0:
+		out = min(in, info.MaxChannels)
+	case out == 0:
+		out = in
+	}
+
+	if mr, ok := dec.(channelMaskReader); ok && mr.ChannelMask() != 0 {
+		if layout := speakerLayout(mr.ChannelMask(), in); layout != nil {
+			matrix, err := layoutMix(layout, out)
+			return out, matrix, err
+		}
+	}
+	matrix, err := standardMix(in, out)
+	return out, matrix, err
+}
+
+// newStages builds the processing between decoder and encoder: channel
+// mixing, resampling at the input's bit depth, then dither down to the
+// output's
+func (c *Converter) newStages(dec Decoder, format Format, bitDepth int) ([]pcmStage, error) {
+	var stages []pcmStage
+
+	channels, matrix, err := c.channelMix(format, dec)
+	if err != nil {
+		return nil, err
+	}
+	if matrix != nil {
+		stages = append(stages, newMixer(matrix, dec.Channels(), dec.BitDepth()))
+	}
+
+	sampleRate := dec.SampleRate()
+	if c.TargetSampleRate != 0 && c.TargetSampleRate != sampleRate {
+		if c.TargetSampleRate < minSampleRate || c.TargetSampleRate > maxSampleRate {
+			return nil, fmt.Errorf("unsupported output sample rate %d (%d-%d Hz)", c.TargetSampleRate, minSampleRate, maxSampleRate)
+		}
+		quality := c.ResampleQuality
+		if quality == "" {
+			quality = ResampleMedium
+		}
+		r, err := newResampler(quality, sampleRate, c.TargetSampleRate, channels, dec.BitDepth())
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, r)
+		sampleRate = c.TargetSampleRate
+	}
+
+	if bitDepth < dec.BitDepth() {
+		dither := c.Dither
+		if dither == "" {
+			dither = DitherTriangular
+		}
+		d, err := newDitherer(dither, c.DitherSeed, sampleRate, channels, dec.BitDepth(), bitDepth)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, d)
+	}
+
+	return stages, nil
+}
+
+// readAll drains a decoder into a single PCMData
+func readAll(dec Decoder) (*PCMData, error) {
+	pcm := &PCMData{
+		SampleRate: dec.SampleRate(),
+		Channels:   dec.Channels(),
+		BitDepth:   dec.BitDepth(),
+	}
+
+	for {
+		chunk, err := dec.ReadChunk()
+		if err == io.EOF {
+			return pcm, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pcm.Samples = append(pcm.Samples, chunk.Samples...)
+	}
+}
+
+// encodeAll writes a complete PCMData through a chunked encoder
+func encodeAll(enc Encoder, pcm *PCMData) error {
+	if err := enc.WriteChunk(pcm); err != nil {
+		return err
+	}
+	return enc.Close()
+}
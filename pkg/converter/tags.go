@@ -0,0 +1,87 @@
+package converter
+
+import "strings"
+
+// Tags are metadata fields in Vorbis comment form: NAME=value pairs with
+// upper-case names by convention (TITLE, ARTIST, ALBUM, ...). A name may
+// appear more than once.
+type Tags [][2]string
+
+// Picture is embedded artwork such as a cover. Type is the ID3v2 APIC
+// picture type, which FLAC PICTURE blocks share (3 is the front cover).
+type Picture struct {
+	Type        int
+	MIME        string // e.g. "image/jpeg"
+	Description string
+	Data        []byte
+}
+
+// tagReader is implemented by decoders that found tags in their input
+type tagReader interface {
+	Tags() Tags
+}
+
+// tagWriter is implemented by encoders that can store tags. SetTags must
+// be called before the first WriteChunk.
+type tagWriter interface {
+	SetTags(tags Tags)
+}
+
+// pictureReader is implemented by decoders that found pictures in their
+// input
+type pictureReader interface {
+	Pictures() []Picture
+}
+
+// pictureWriter is implemented by encoders that can embed pictures.
+// SetPictures must be called before the first WriteChunk.
+type pictureWriter interface {
+	SetPictures(pictures []Picture)
+}
+
+// copyTags passes tags and pictures from dec to enc when both sides
+// support them. Tags travel in Vorbis comment form, so each format only
+// maps its own fields to and from that.
+func copyTags(dec Decoder, enc Encoder) {
+	if tr, ok := dec.(tagReader); ok {
+		if tw, ok := enc.(tagWriter); ok {
+			if tags := tr.Tags(); len(tags) > 0 {
+				tw.SetTags(tags)
+			}
+		}
+	}
+	if pr, ok := dec.(pictureReader); ok {
+		if pw, ok := enc.(pictureWriter); ok {
+			if pictures := pr.Pictures(); len(pictures) > 0 {
+				pw.SetPictures(pictures)
+			}
+		}
+	}
+}
+
+// add appends a tag with its name upper-cased. Names that aren't valid
+// Vorbis comment names (printable ASCII except '=') are dropped so a
+// malformed input tag can't fail the conversion.
+func (t *Tags) add(name, value string) {
+	if name == "" {
+		return
+	}
+	for _, c := range []byte(name) {
+		if c < 0x20 || c > 0x7D || c == '=' {
+			return
+		}
+	}
+	*t = append(*t, [2]string{strings.ToUpper(name), value})
+}
+
+// parseVorbisComments splits raw "NAME=value" comments, dropping entries
+// without a separator
+func parseVorbisComments(comments []string) Tags {
+	var tags Tags
+	for _, c := range comments {
+		if name, value, ok := strings.Cut(c, "="); ok {
+			tags.add(name, value)
+		}
+	}
+	return tags
+}
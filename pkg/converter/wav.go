@@ -0,0 +1,802 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+func init() {
+	RegisterDecoder(DecoderInfo{
+		Format:     FormatWAV,
+		Name:       "WAV",
+		Extensions: []string{"wav", "wave"},
+		Probe:      probeWAV,
+		Tags:       true,
+		New:        func(r io.Reader) (Decoder, error) { return newWAVDecoder(r) },
+	})
+	RegisterEncoder(EncoderInfo{
+		Format:     FormatWAV,
+		Name:       "WAV",
+		Extensions: []string{"wav", "wave"},
+		BitDepths:  []int{8, 16, 24, 32},
+		Float:      true,
+		Tags:       true,
+		New: func(w io.Writer, cfg EncoderConfig) (Encoder, error) {
+			return newWAVEncoder(w, wavFormat{
+				sampleRate:  cfg.SampleRate,
+				channels:    cfg.Channels,
+				bitDepth:    cfg.BitDepth,
+				float:       cfg.Float,
+				channelMask: cfg.ChannelMask,
+				container:   cfg.Converter.WAVContainer,
+			})
+		},
+	})
+}
+
+// probeWAV matches a RIFF/WAVE header, or its RF64 and BW64 variants
+func probeWAV(b []byte) bool {
+	if len(b) < 12 || string(b[8:12]) != "WAVE" {
+		return false
+	}
+	switch string(b[0:4]) {
+	case "RIFF", "RF64", "BW64":
+		return true
+	}
+	return false
+}
+
+const (
+	// wavUnknownSize is written as RIFF/data size when the output can't be
+	// seeked back to patch the header; readers treat it as "until EOF"
+	wavUnknownSize = 0xFFFFFFFF
+	// wavUntilEOF is the chunk size the chunk reader gives for a data
+	// chunk of unknown length, in any container
+	wavUntilEOF = ^uint64(0)
+
+	// wavDS64Size is the size of a ds64 chunk without a table, and so of
+	// the JUNK chunk reserving space for it
+	wavDS64Size = 28
+	// wavMaxChunk bounds the non-audio chunks read into memory
+	wavMaxChunk = 1 << 24
+
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// WAVContainer selects the RIFF variant WAV output is written as
+type WAVContainer string
+
+const (
+	// WAVAuto writes RIFF, switching to RF64 when the file outgrows RIFF's
+	// 4 GB limit. The switch needs seekable output, as it rewrites the
+	// header; streamed WAVs carry "unknown" sizes instead.
+	//
+	// The final size isn't known until Close, so seekable RIFF output
+	// always reserves room for the ds64 chunk with a 36-byte JUNK chunk
+	// after the RIFF header, small files included. Readers skip it, but
+	// the header is no longer the canonical 44 bytes and WAV to WAV
+	// conversions aren't byte for byte copies.
+	WAVAuto WAVContainer = "auto"
+	// WAVRF64 always writes RF64 (EBU Tech 3306)
+	WAVRF64 WAVContainer = "rf64"
+	// WAVBW64 always writes BW64 (ITU-R BS.2088), RF64 by another name
+	WAVBW64 WAVContainer = "bw64"
+)
+
+// ParseWAVContainer returns the WAVContainer named s
+func ParseWAVContainer(s string) (WAVContainer, error) {
+	switch c := WAVContainer(s); c {
+	case WAVAuto, WAVRF64, WAVBW64:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown WAV container %q (auto, rf64, bw64)", s)
+}
+
+// EXTENSIBLE fmt chunks carry a SubFormat GUID saying what the samples
+// really are: KSDATAFORMAT_SUBTYPE_PCM or _IEEE_FLOAT, in on-disk byte
+// order
+var (
+	wavSubFormatPCM = [16]byte{
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00,
+		0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71,
+	}
+	wavSubFormatFloat = [16]byte{
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00,
+		0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71,
+	}
+)
+
+// wavDecoder reads integer or IEEE float PCM from a RIFF/WAVE stream chunk
+// by chunk. Float samples are returned as 32-bit integers, full scale
+// being ±1.0; louder samples are clipped. bext, iXML and LIST/INFO chunks
+// before the audio are read, and those after it too when the input is
+// seekable.
+type wavDecoder struct {
+	r           io.Reader
+	sampleRate  int
+	channels    int
+	bitDepth    int
+	float       bool
+	channelMask uint32
+	meta        WAVMetadata
+	buf         []byte
+}
+
+func newWAVDecoder(r io.Reader) (*wavDecoder, error) {
+	chunks, err := newWAVChunkReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &wavDecoder{}
+	// RF64 and BW64 keep the data size in ds64, with 0xFFFFFFFF in the data
+	// chunk header
+	ds64DataSize := wavUntilEOF
+	for {
+		id, size, err := chunks.next()
+		if err != nil {
+			return nil, fmt.Errorf("invalid WAV file: no data chunk")
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("invalid WAV fmt chunk")
+			}
+			fmtChunk, err := chunks.read(size)
+			if err != nil {
+				return nil, fmt.Errorf("read fmt chunk: %w", err)
+			}
+			formatTag := binary.LittleEndian.Uint16(fmtChunk[0:2])
+			switch formatTag {
+			case wavFormatPCM:
+			case wavFormatFloat:
+				d.float = true
+			case wavFormatExtensible:
+				if size < 40 {
+					return nil, fmt.Errorf("invalid WAV EXTENSIBLE fmt chunk")
+				}
+				switch [16]byte(fmtChunk[24:40]) {
+				case wavSubFormatPCM:
+				case wavSubFormatFloat:
+					d.float = true
+				default:
+					return nil, fmt.Errorf("unsupported WAV EXTENSIBLE sub-format")
+				}
+				d.channelMask = binary.LittleEndian.Uint32(fmtChunk[20:24])
+			default:
+				return nil, fmt.Errorf("unsupported WAV format tag: %d", formatTag)
+			}
+			d.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			d.sampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+			d.bitDepth = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+
+		case "ds64":
+			if !chunks.rf64 || size < 24 {
+				return nil, fmt.Errorf("invalid WAV ds64 chunk")
+			}
+			ds64, err := chunks.read(size)
+			if err != nil {
+				return nil, fmt.Errorf("read ds64 chunk: %w", err)
+			}
+			if n := binary.LittleEndian.Uint64(ds64[8:16]); n != 0 {
+				ds64DataSize = n
+			}
+
+		case "bext", "iXML", "LIST":
+			if err := d.readMetadata(chunks, id, size); err != nil {
+				return nil, fmt.Errorf("read %q chunk: %w", id, err)
+			}
+
+		case "data":
+			if d.channels == 0 {
+				return nil, fmt.Errorf("invalid WAV file: data before fmt chunk")
+			}
+			if err := checkWAVBitDepth(d.bitDepth, d.float); err != nil {
+				return nil, err
+			}
+			if size == wavUntilEOF {
+				size = ds64DataSize
+			}
+			if rs, ok := r.(io.ReadSeeker); ok && size != 0 && size != wavUntilEOF {
+				if err := d.readTrailingMetadata(rs, chunks, size); err != nil {
+					return nil, err
+				}
+			}
+			d.r = r
+			// Streamed WAVs carry a zero or "unknown" size: read until EOF
+			if size != 0 && size != wavUntilEOF {
+				d.r = io.LimitReader(r, int64(min(size, math.MaxInt64)))
+			}
+			d.buf = make([]byte, chunkFrames*d.channels*d.bitDepth/8)
+			return d, nil
+
+		default:
+			if err := chunks.skip(size); err != nil {
+				return nil, fmt.Errorf("skip %q chunk: %w", id, err)
+			}
+		}
+	}
+}
+
+// readMetadata reads a metadata chunk into d.meta. Malformed metadata is
+// dropped rather than failing the conversion.
+func (d *wavDecoder) readMetadata(chunks *wavChunkReader, id string, size uint64) error {
+	if size > wavMaxChunk {
+		return chunks.skip(size)
+	}
+	b, err := chunks.read(size)
+	if err != nil {
+		return err
+	}
+	switch id {
+	case "bext":
+		if bext := parseBext(b); bext != nil {
+			d.meta.Bext = bext
+		}
+	case "iXML":
+		d.meta.IXML = string(bytes.TrimRight(b, "\x00"))
+	case "LIST":
+		d.meta.Info = append(d.meta.Info, parseInfoList(b)...)
+	}
+	return nil
+}
+
+// readTrailingMetadata reads the metadata chunks that follow dataSize bytes
+// of samples, leaving the read position at the first sample
+func (d *wavDecoder) readTrailingMetadata(rs io.ReadSeeker, chunks *wavChunkReader, dataSize uint64) error {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// Not seekable after all, like a pipe
+		return nil
+	}
+	if _, err := rs.Seek(pos+int64(dataSize+chunks.padding(dataSize)), io.SeekStart); err == nil {
+		for {
+			id, size, err := chunks.next()
+			if err != nil {
+				break
+			}
+			switch id {
+			case "bext", "iXML", "LIST":
+				err = d.readMetadata(chunks, id, size)
+			default:
+				err = chunks.skip(size)
+			}
+			if err != nil {
+				// A truncated file ends with the samples
+				break
+			}
+		}
+	}
+	_, err = rs.Seek(pos, io.SeekStart)
+	return err
+}
+
+// wavChunkReader walks the chunks of a RIFF, RF64/BW64 or Wave64 file.
+// Wave64 chunks are tagged with GUIDs; those of the standard chunks start
+// with the RIFF ID, which is what next returns for them.
+type wavChunkReader struct {
+	r    io.Reader
+	rf64 bool
+	w64  bool
+}
+
+// newWAVChunkReader reads the file header
+func newWAVChunkReader(r io.Reader) (*wavChunkReader, error) {
+	var head [12]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("invalid WAV file")
+	}
+	c := &wavChunkReader{r: r}
+	switch string(head[0:4]) {
+	case "RIFF":
+	case "RF64", "BW64":
+		c.rf64 = true
+	case "riff":
+		var rest [w64HeaderSize - 12]byte
+		if _, err := io.ReadFull(r, rest[:]); err != nil {
+			return nil, fmt.Errorf("invalid WAV file")
+		}
+		if !probeW64(append(head[:], rest[:]...)) {
+			return nil, fmt.Errorf("invalid WAV file")
+		}
+		c.w64 = true
+		return c, nil
+	default:
+		return nil, fmt.Errorf("invalid WAV file")
+	}
+	if string(head[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("invalid WAV file")
+	}
+	return c, nil
+}
+
+// next returns the ID and payload size of the next chunk. A data chunk of
+// unknown length has size wavUntilEOF.
+func (c *wavChunkReader) next() (string, uint64, error) {
+	if c.w64 {
+		var hdr [w64ChunkHeaderSize]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return "", 0, err
+		}
+		size := binary.LittleEndian.Uint64(hdr[16:24])
+		switch {
+		case size == wavUntilEOF:
+		case size < w64ChunkHeaderSize:
+			return "", 0, fmt.Errorf("invalid Wave64 chunk size %d", size)
+		default:
+			size -= w64ChunkHeaderSize
+		}
+		if [12]byte(hdr[4:16]) != w64GUIDSuffix {
+			return "", size, nil
+		}
+		return string(hdr[0:4]), size, nil
+	}
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+	size := uint64(binary.LittleEndian.Uint32(hdr[4:8]))
+	if size == wavUnknownSize {
+		size = wavUntilEOF
+	}
+	return string(hdr[0:4]), size, nil
+}
+
+// read returns a chunk's payload, consuming its padding
+func (c *wavChunkReader) read(size uint64) ([]byte, error) {
+	if size > wavMaxChunk {
+		return nil, fmt.Errorf("chunk too large (%d bytes)", size)
+	}
+	buf := make([]byte, size+c.padding(size))
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// skip discards a chunk's payload and padding
+func (c *wavChunkReader) skip(size uint64) error {
+	if size == wavUntilEOF {
+		return fmt.Errorf("chunk of unknown size")
+	}
+	_, err := io.CopyN(io.Discard, c.r, int64(size+c.padding(size)))
+	return err
+}
+
+// padding is the number of bytes after a chunk's payload: RIFF pads to an
+// even size, Wave64 to a multiple of 8
+func (c *wavChunkReader) padding(size uint64) uint64 {
+	if c.w64 {
+		return -size & 7
+	}
+	return size % 2
+}
+
+func (d *wavDecoder) SampleRate() int { return d.sampleRate }
+func (d *wavDecoder) Channels() int   { return d.channels }
+
+// BitDepth is that of the decoded samples: 32 for float input
+func (d *wavDecoder) BitDepth() int {
+	if d.float {
+		return 32
+	}
+	return d.bitDepth
+}
+
+// Tags are the LIST/INFO fields
+func (d *wavDecoder) Tags() Tags { return d.meta.Info }
+
+// WAVMetadata returns the bext, iXML and LIST/INFO chunks, nil if the file
+// has none
+func (d *wavDecoder) WAVMetadata() *WAVMetadata {
+	if d.meta.Bext == nil && d.meta.IXML == "" && d.meta.Info == nil {
+		return nil
+	}
+	m := d.meta
+	return &m
+}
+
+// ChannelMask is the EXTENSIBLE speaker layout, 0 if the file has none
+func (d *wavDecoder) ChannelMask() uint32 { return d.channelMask }
+
+// FloatBits is the float sample width, 0 for integer PCM
+func (d *wavDecoder) FloatBits() int {
+	if d.float {
+		return d.bitDepth
+	}
+	return 0
+}
+
+func (d *wavDecoder) ReadChunk() (*PCMData, error) {
+	n, err := io.ReadFull(d.r, d.buf)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	bytesPerSample := d.bitDepth / 8
+	frameSize := bytesPerSample * d.channels
+	n -= n % frameSize
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	data := d.buf[:n]
+	samples := make([]int32, n/bytesPerSample)
+	for i := range samples {
+		b := data[i*bytesPerSample:]
+		switch {
+		case d.float && d.bitDepth == 32:
+			samples[i] = floatToInt32(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+		case d.float:
+			samples[i] = floatToInt32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		case d.bitDepth == 8:
+			// 8-bit WAV is unsigned
+			samples[i] = int32(b[0]) - 128
+		case d.bitDepth == 16:
+			samples[i] = int32(int16(binary.LittleEndian.Uint16(b)))
+		case d.bitDepth == 24:
+			samples[i] = int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		case d.bitDepth == 32:
+			samples[i] = int32(binary.LittleEndian.Uint32(b))
+		}
+	}
+
+	return &PCMData{
+		Samples:    samples,
+		SampleRate: d.sampleRate,
+		Channels:   d.channels,
+		BitDepth:   d.BitDepth(),
+	}, nil
+}
+
+// wavFormat is the stream a WAV header describes
+type wavFormat struct {
+	sampleRate  int
+	channels    int
+	bitDepth    int
+	float       bool
+	channelMask uint32       // 0 for the default layout
+	container   WAVContainer // "" is WAVAuto
+}
+
+// header builds the header up to the samples for dataSize bytes of them,
+// or -1 if the size isn't known yet. Plain PCM with up to two channels in
+// the default layout gets the canonical 44-byte header; more channels or
+// another layout need WAVE_FORMAT_EXTENSIBLE, which also carries the
+// channel mask. Float formats add the fact chunk non-PCM WAVs require.
+//
+// An automatic container is RIFF unless dataSize is too large for it. With
+// reserve, a RIFF header gets a JUNK chunk where RF64's ds64 would go, so
+// that it can be rewritten as RF64 in place once the size is known.
+// Metadata chunks, framed by appendChunk, go between the format and the
+// samples.
+func (f wavFormat) header(dataSize int64, reserve bool, metadata []byte) []byte {
+	fmtChunk := f.fmtChunk()
+	var frames int64
+	if dataSize > 0 {
+		frames = dataSize / int64(f.channels*f.bitDepth/8)
+	}
+	if f.container == wavW64 {
+		return w64Header(fmtChunk, f.float, frames, dataSize, metadata)
+	}
+
+	// The chunks after the file header and ds64 or JUNK
+	var body []byte
+	body = appendChunkHeader(body, "fmt ", uint32(len(fmtChunk)))
+	body = append(body, fmtChunk...)
+	if f.float {
+		body = appendChunkHeader(body, "fact", 4)
+		body = binary.LittleEndian.AppendUint32(body, uint32(min(frames, wavUnknownSize)))
+	}
+	body = append(body, metadata...)
+	body = appendChunkHeader(body, "data", 0)
+	dataAt := len(body) - 4
+
+	id := "RIFF"
+	switch f.container {
+	case WAVRF64:
+		id = "RF64"
+	case WAVBW64:
+		id = "BW64"
+	}
+	riffSize := 4 + int64(len(body)) + dataSize + dataSize%2
+	if id != "RIFF" || reserve {
+		riffSize += 8 + wavDS64Size
+	}
+	if id == "RIFF" && riffSize >= wavUnknownSize {
+		id = "RF64"
+		if !reserve {
+			riffSize += 8 + wavDS64Size
+		}
+	}
+
+	hdr := append([]byte(id), 0, 0, 0, 0)
+	hdr = append(hdr, "WAVE"...)
+	riff32, data32 := uint32(riffSize), uint32(dataSize)
+	switch {
+	case id != "RIFF":
+		// The sizes go in ds64; the 32-bit fields say to look there
+		riff64, data64 := uint64(riffSize), uint64(dataSize)
+		if dataSize < 0 {
+			riff64, data64 = wavUntilEOF, wavUntilEOF
+		}
+		hdr = appendChunkHeader(hdr, "ds64", wavDS64Size)
+		hdr = binary.LittleEndian.AppendUint64(hdr, riff64)
+		hdr = binary.LittleEndian.AppendUint64(hdr, data64)
+		hdr = binary.LittleEndian.AppendUint64(hdr, uint64(frames))
+		hdr = binary.LittleEndian.AppendUint32(hdr, 0) // no table entries
+		riff32, data32 = wavUnknownSize, wavUnknownSize
+	case reserve:
+		hdr = appendChunkHeader(hdr, "JUNK", wavDS64Size)
+		hdr = append(hdr, make([]byte, wavDS64Size)...)
+	}
+	if dataSize < 0 {
+		riff32, data32 = wavUnknownSize, wavUnknownSize
+	}
+	binary.LittleEndian.PutUint32(hdr[4:8], riff32)
+	binary.LittleEndian.PutUint32(body[dataAt:], data32)
+	return append(hdr, body...)
+}
+
+// fmtChunk returns the payload of the fmt chunk
+func (f wavFormat) fmtChunk() []byte {
+	mask := f.channelMask
+	if f.channels <= maxChannels && mask == 0 {
+		mask = defaultChannelMasks[f.channels]
+	}
+	extensible := f.channels > 2 || mask != defaultChannelMasks[f.channels]
+	blockAlign := f.channels * f.bitDepth / 8
+
+	var fmtChunk []byte
+	switch {
+	case extensible:
+		fmtChunk = make([]byte, 40)
+		binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatExtensible)
+		binary.LittleEndian.PutUint16(fmtChunk[16:18], 22)
+		binary.LittleEndian.PutUint16(fmtChunk[18:20], uint16(f.bitDepth))
+		binary.LittleEndian.PutUint32(fmtChunk[20:24], mask)
+		subFormat := wavSubFormatPCM
+		if f.float {
+			subFormat = wavSubFormatFloat
+		}
+		copy(fmtChunk[24:40], subFormat[:])
+	case f.float:
+		// cbSize is 0
+		fmtChunk = make([]byte, 18)
+		binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatFloat)
+	default:
+		fmtChunk = make([]byte, 16)
+		binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatPCM)
+	}
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], uint16(f.channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], uint32(f.sampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], uint32(f.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], uint16(f.bitDepth))
+	return fmtChunk
+}
+
+// padding is the number of bytes written after dataSize bytes of samples
+func (f wavFormat) padding(dataSize int64) int64 {
+	if f.container == wavW64 {
+		return -dataSize & 7
+	}
+	return dataSize % 2
+}
+
+// appendChunk appends a chunk in the container's framing
+func (f wavFormat) appendChunk(b []byte, id string, payload []byte) []byte {
+	if f.container == wavW64 {
+		return appendW64Chunk(b, id, payload)
+	}
+	b = appendChunkHeader(b, id, uint32(len(payload)))
+	b = append(b, payload...)
+	return append(b, make([]byte, len(payload)%2)...)
+}
+
+func appendChunkHeader(b []byte, id string, size uint32) []byte {
+	b = append(b, id...)
+	return binary.LittleEndian.AppendUint32(b, size)
+}
+
+// wavEncoder writes integer or IEEE float PCM WAV. The header, carrying
+// any tags as LIST/INFO and the bext and iXML chunks, is written with the
+// first samples with placeholder sizes, which are patched on Close if the
+// writer can seek. Wave64 output only gets bext, the one with a standard
+// Wave64 GUID.
+type wavEncoder struct {
+	w        io.Writer
+	format   wavFormat
+	tags     Tags
+	meta     *WAVMetadata
+	metadata []byte // the encoded metadata chunks, once the header is out
+	started  bool
+	start    int64
+	seekable bool
+	dataSize int64
+}
+
+func newWAVEncoder(w io.Writer, format wavFormat) (*wavEncoder, error) {
+	if err := checkWAVBitDepth(format.bitDepth, format.float); err != nil {
+		return nil, err
+	}
+	switch format.container {
+	case "", WAVAuto, WAVRF64, WAVBW64, wavW64:
+	default:
+		return nil, fmt.Errorf("unknown WAV container %q", format.container)
+	}
+	e := &wavEncoder{w: w, format: format}
+
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			e.start = pos
+			e.seekable = true
+		}
+	}
+
+	return e, nil
+}
+
+// SetTags stores tags as LIST/INFO fields
+func (e *wavEncoder) SetTags(tags Tags) { e.tags = tags }
+
+// SetWAVMetadata stores bext and iXML chunks
+func (e *wavEncoder) SetWAVMetadata(m *WAVMetadata) { e.meta = m }
+
+// writeHeader writes the header once the metadata is known
+func (e *wavEncoder) writeHeader() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+
+	var b []byte
+	if e.meta != nil && e.meta.Bext != nil {
+		b = e.format.appendChunk(b, "bext", e.meta.Bext.marshal())
+	}
+	if e.format.container != wavW64 {
+		if e.meta != nil && e.meta.IXML != "" {
+			b = e.format.appendChunk(b, "iXML", []byte(e.meta.IXML))
+		}
+		if info := infoList(e.tags); info != nil {
+			b = e.format.appendChunk(b, "LIST", info)
+		}
+	}
+	e.metadata = b
+
+	_, err := e.w.Write(e.format.header(-1, e.seekable, e.metadata))
+	return err
+}
+
+func (e *wavEncoder) WriteChunk(pcm *PCMData) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	var err error
+	if e.format.float {
+		err = writeFloat(e.w, pcm.Samples, pcm.bits(), e.format.bitDepth)
+	} else {
+		err = writePCM(e.w, convertBitDepth(pcm.Samples, pcm.bits(), e.format.bitDepth), e.format.bitDepth)
+	}
+	if err != nil {
+		return err
+	}
+	e.dataSize += int64(len(pcm.Samples) * e.format.bitDepth / 8)
+	return nil
+}
+
+func (e *wavEncoder) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	// Nothing follows a data chunk of unknown size, so it isn't padded:
+	// readers would take the padding for samples
+	if !e.seekable {
+		return nil
+	}
+	pad := e.format.padding(e.dataSize)
+	if err := writePadding(e.w, pad); err != nil {
+		return err
+	}
+	ws := e.w.(io.WriteSeeker)
+
+	// Rebuild the header with the final sizes. Its length doesn't change:
+	// RF64's ds64 takes the place of the JUNK chunk.
+	hdr := e.format.header(e.dataSize, true, e.metadata)
+	if _, err := ws.Seek(e.start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(hdr); err != nil {
+		return err
+	}
+
+	_, err := ws.Seek(e.start+int64(len(hdr))+e.dataSize+pad, io.SeekStart)
+	return err
+}
+
+// checkWAVBitDepth rejects sample sizes the PCM reader and writer don't
+// handle
+func checkWAVBitDepth(bitDepth int, float bool) error {
+	switch {
+	case float && (bitDepth == 32 || bitDepth == 64):
+		return nil
+	case float:
+		return fmt.Errorf("unsupported WAV float bit depth: %d", bitDepth)
+	case bitDepth == 8, bitDepth == 16, bitDepth == 24, bitDepth == 32:
+		return nil
+	default:
+		return fmt.Errorf("unsupported WAV bit depth: %d", bitDepth)
+	}
+}
+
+// writePCM writes samples as little-endian PCM; 8-bit WAV is unsigned
+func writePCM(w io.Writer, samples []int32, bitDepth int) error {
+	bytesPerSample := bitDepth / 8
+	buf := make([]byte, len(samples)*bytesPerSample)
+	for i, s := range samples {
+		b := buf[i*bytesPerSample:]
+		switch bitDepth {
+		case 8:
+			b[0] = byte(s + 128)
+		case 16:
+			binary.LittleEndian.PutUint16(b, uint16(s))
+		case 24:
+			b[0], b[1], b[2] = byte(s), byte(s>>8), byte(s>>16)
+		case 32:
+			binary.LittleEndian.PutUint32(b, uint32(s))
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// writeFloat writes integer samples of the given bit depth as little-endian
+// IEEE floats, full scale being ±1.0
+func writeFloat(w io.Writer, samples []int32, from, floatBits int) error {
+	scale := 1 / float64(int64(1)<<(from-1))
+	bytesPerSample := floatBits / 8
+	buf := make([]byte, len(samples)*bytesPerSample)
+	for i, s := range samples {
+		if floatBits == 32 {
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(float32(float64(s)*scale)))
+		} else {
+			binary.LittleEndian.PutUint64(buf[i*8:], math.Float64bits(float64(s)*scale))
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// floatToInt32 converts a float sample to 32-bit integer PCM, clipping it
+// to full scale
+func floatToInt32(f float64) int32 {
+	v := math.Round(f * (1 << 31))
+	switch {
+	case v >= math.MaxInt32:
+		return math.MaxInt32
+	case v <= math.MinInt32:
+		return math.MinInt32
+	case v != v: // NaN
+		return 0
+	}
+	return int32(v)
+}
+
+// writePadding writes the n zero bytes that pad a chunk
+func writePadding(w io.Writer, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := w.Write(make([]byte, n))
+	return err
+}
@@ -0,0 +1,237 @@
+package converter
+
+import "encoding/binary"
+
+// Delays between an MP3 encoder's input and a decoder's output, in
+// samples. LAME tags store the encoder's; decoders add their own, which
+// is 529 for the standard synthesis filterbank (go-mp3's included).
+const (
+	shineEncoderDelay = 528
+	mp3DecoderDelay   = 529
+)
+
+// Xing header flags: which optional fields follow
+const (
+	xingFrames  = 0x1
+	xingBytes   = 0x2
+	xingTOC     = 0x4
+	xingQuality = 0x8
+)
+
+// LAME tag VBR methods
+const (
+	lameCBR = 1
+	lameABR = 2
+	lameVBR = 4
+)
+
+// lameTagSize is the length of the LAME extension after the Xing fields
+const lameTagSize = 36
+
+// xingHeader is the Xing/Info frame encoders put before the audio: a
+// frame of silence whose side information slot carries stream totals for
+// duration display and seeking, and in its LAME extension the encoder
+// delay and end padding gapless playback trims. "Info" marks CBR streams.
+type xingHeader struct {
+	vbr    bool
+	flags  uint32
+	frames int   // audio frames, excluding this one
+	bytes  int64 // from the start of this frame to the end of the last
+	toc    [100]byte
+
+	lame           bool
+	method         byte
+	bitrate        int // LAME: CBR rate, ABR target or VBR minimum
+	delay, padding int
+}
+
+// xingOffset returns where the Xing tag starts in a Layer III frame: after
+// the header and the side information
+func xingOffset(h mpegHeader) int {
+	switch {
+	case h.version == 1 && h.channels == 2:
+		return 4 + 32
+	case h.version == 1, h.channels == 2:
+		return 4 + 17
+	default:
+		return 4 + 9
+	}
+}
+
+// xingFrameSize returns the smallest frame a full Xing header with a LAME
+// tag fits in
+func xingFrameSize(h mpegHeader) int {
+	return xingOffset(h) + 8 + 4 + 4 + 100 + lameTagSize
+}
+
+// parseXing reads a Xing/Info header from a whole frame, reporting false
+// if the frame is ordinary audio. The LAME extension is only trusted when
+// its CRC checks out.
+func parseXing(frame []byte) (*xingHeader, bool) {
+	h, ok := parseMPEGHeader(frame)
+	if !ok || h.layer != 3 {
+		return nil, false
+	}
+	off := xingOffset(h)
+	if len(frame) < off+8 {
+		return nil, false
+	}
+	x := &xingHeader{}
+	switch string(frame[off : off+4]) {
+	case "Xing":
+		x.vbr = true
+	case "Info":
+	default:
+		return nil, false
+	}
+	x.flags = binary.BigEndian.Uint32(frame[off+4:])
+	p := off + 8
+
+	field := func(flag uint32, size int) []byte {
+		if x.flags&flag == 0 || p+size > len(frame) {
+			return nil
+		}
+		p += size
+		return frame[p-size : p]
+	}
+	if b := field(xingFrames, 4); b != nil {
+		x.frames = int(binary.BigEndian.Uint32(b))
+	}
+	if b := field(xingBytes, 4); b != nil {
+		x.bytes = int64(binary.BigEndian.Uint32(b))
+	}
+	if b := field(xingTOC, 100); b != nil {
+		copy(x.toc[:], b)
+	}
+	field(xingQuality, 4)
+
+	if p+lameTagSize <= len(frame) &&
+		binary.BigEndian.Uint16(frame[p+34:]) == lameCRC(frame[:p+34]) {
+		lame := frame[p:]
+		x.lame = true
+		x.method = lame[9] & 0x0F
+		x.bitrate = int(lame[20])
+		x.delay = int(lame[21])<<4 | int(lame[22])>>4
+		x.padding = int(lame[22]&0x0F)<<8 | int(lame[23])
+	}
+	return x, true
+}
+
+// marshal builds the Xing frame at kbps, copying the rest of its header
+// from model, an audio frame header of the stream. Totals are only written
+// once known, i.e. frames > 0.
+func (x *xingHeader) marshal(model []byte, kbps int, rates []int) []byte {
+	hdr := []byte{model[0], model[1], model[2], model[3]}
+	for i, r := range rates {
+		if r == kbps {
+			// No CRC, no padding or private bit
+			hdr[1] |= 0x01
+			hdr[2] = byte(i+1)<<4 | model[2]&0x0C
+		}
+	}
+	h, _ := parseMPEGHeader(hdr)
+	frame := make([]byte, h.frameSize())
+	copy(frame, hdr)
+
+	off := xingOffset(h)
+	tag := "Info"
+	if x.vbr {
+		tag = "Xing"
+	}
+	copy(frame[off:], tag)
+	p := off + 8
+	if x.frames > 0 {
+		binary.BigEndian.PutUint32(frame[off+4:], xingFrames|xingBytes|xingTOC)
+		binary.BigEndian.PutUint32(frame[p:], uint32(x.frames))
+		binary.BigEndian.PutUint32(frame[p+4:], uint32(x.bytes))
+		copy(frame[p+8:], x.toc[:])
+		p += 108
+	}
+
+	lame := frame[p : p+lameTagSize]
+	// Encoder version, 9 characters
+	copy(lame[0:9], "shine-mp3")
+	lame[9] = x.method
+	lame[20] = byte(min(x.bitrate, 255))
+	lame[21] = byte(x.delay >> 4)
+	lame[22] = byte(x.delay<<4) | byte(x.padding>>8&0x0F)
+	lame[23] = byte(x.padding)
+	binary.BigEndian.PutUint32(lame[28:], uint32(x.bytes))
+	binary.BigEndian.PutUint16(lame[34:], lameCRC(frame[:p+34]))
+	return frame
+}
+
+// setTOC fills the seek table from each audio frame's size: entry i is
+// the byte position, in 256ths of the stream, of the frame i% of the way in
+func (x *xingHeader) setTOC(xingSize int, frameSizes []uint32) {
+	pos := make([]int64, len(frameSizes))
+	offset := int64(xingSize)
+	for i, size := range frameSizes {
+		pos[i] = offset
+		offset += int64(size)
+	}
+	x.frames = len(frameSizes)
+	x.bytes = offset
+	for i := range x.toc {
+		x.toc[i] = byte(min(255, int(pos[i*len(pos)/100]*256/offset)))
+	}
+}
+
+// trimFrames returns how many decoded frames to drop from the start of
+// the stream, and how many to keep after that (-1 if unknown)
+func (x *xingHeader) trimFrames(samplesPerFrame int) (skip, keep int64) {
+	if !x.lame {
+		return 0, -1
+	}
+	skip = int64(x.delay + mp3DecoderDelay)
+	keep = -1
+	if x.flags&xingFrames != 0 {
+		keep = max(0, int64(x.frames*samplesPerFrame-x.delay-x.padding))
+	}
+	return skip, keep
+}
+
+// lameCRC is the CRC-16 (polynomial 0x8005, reflected) LAME tags end with
+func lameCRC(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// lameMethod returns the LAME tag VBR method for an MP3Mode
+func lameMethod(mode MP3Mode) byte {
+	switch mode {
+	case MP3VBR:
+		return lameVBR
+	case MP3ABR:
+		return lameABR
+	default:
+		return lameCBR
+	}
+}
+
+// xingBitrate returns the bitrate for the Xing frame: kbps if the header
+// fits in a frame that size, otherwise the lowest rate it fits in
+func xingBitrate(h mpegHeader, kbps int, rates []int) int {
+	h.padding = false
+	h.bitrate = kbps
+	if h.frameSize() >= xingFrameSize(h) {
+		return kbps
+	}
+	for _, r := range rates {
+		h.bitrate = r
+		if h.frameSize() >= xingFrameSize(h) {
+			return r
+		}
+	}
+	return rates[len(rates)-1]
+}
@@ -97,9 +97,14 @@ func (b *BitWriter) WriteSignedRice(value int32, k int) error {
 		uval = (uint32(-value-1) << 1) | 1
 	}
 
-	// Unary part (quotient)
+	// Unary part (quotient): FLAC writes q zeros terminated by a one
 	q := uval >> k
-	if err := b.WriteUnary(q); err != nil {
+	for ; q >= 32; q -= 32 {
+		if err := b.WriteBits(0, 32); err != nil {
+			return err
+		}
+	}
+	if err := b.WriteBits(1, int(q)+1); err != nil {
 		return err
 	}
 
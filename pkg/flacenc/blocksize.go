@@ -0,0 +1,106 @@
+package flacenc
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// maxSplitDepth is how many times a block may be halved in variable
+	// block size mode (4096 -> 512)
+	maxSplitDepth = 3
+	// minSplitBlockSize is the shortest frame a split may produce
+	minSplitBlockSize = 256
+	// frameOverheadBits approximates a frame header plus CRCs, the cost of
+	// starting another frame
+	frameOverheadBits = 96
+)
+
+// framePlan is a planned frame covering block[offset:offset+size]
+type framePlan struct {
+	offset      int
+	size        int
+	channelCode int
+	subframes   []*subframePlan
+	bits        int64
+}
+
+// planFrame plans the subframes of one candidate frame
+func (e *Encoder) planFrame(block [][]int32, offset, size int) *framePlan {
+	part := make([][]int32, len(block))
+	for ch := range block {
+		part[ch] = block[ch][offset : offset+size]
+	}
+
+	channelCode, subframes := e.planChannels(part)
+	bits := int64(frameOverheadBits)
+	for _, sf := range subframes {
+		bits += sf.bits
+	}
+	return &framePlan{offset, size, channelCode, subframes, bits}
+}
+
+// splitFrame returns the cheapest way to code whole: as is, or as its two
+// halves, each of them split further where that pays off
+func (e *Encoder) splitFrame(block [][]int32, whole *framePlan, depth int) []*framePlan {
+	half := whole.size / 2
+	if depth >= maxSplitDepth || half < minSplitBlockSize {
+		return []*framePlan{whole}
+	}
+
+	left := e.splitFrame(block, e.planFrame(block, whole.offset, half), depth+1)
+	right := e.splitFrame(block, e.planFrame(block, whole.offset+half, whole.size-half), depth+1)
+
+	var bits int64
+	for _, f := range append(left, right...) {
+		bits += f.bits
+	}
+	if bits >= whole.bits {
+		return []*framePlan{whole}
+	}
+	return append(left, right...)
+}
+
+// encodeVariableBlock encodes a deinterleaved block as one or more frames
+// whose headers carry the sample number of their first sample
+func (e *Encoder) encodeVariableBlock(block [][]int32, firstSample uint64) ([]encodedFrame, error) {
+	whole := e.planFrame(block, 0, len(block[0]))
+	plans := e.splitFrame(block, whole, 0)
+
+	frames := make([]encodedFrame, len(plans))
+	for i, p := range plans {
+		sampleNum := firstSample + uint64(p.offset)
+
+		var buf bytes.Buffer
+		if _, err := e.writeFrame(&buf, p.size, sampleNum, p.channelCode, p.subframes); err != nil {
+			return nil, fmt.Errorf("encode frame at sample %d: %w", sampleNum, err)
+		}
+		frames[i] = encodedFrame{buf.Bytes(), p.size}
+	}
+	return frames, nil
+}
+
+// recordBlockSize tracks the min/max block size of a variable block size
+// stream. The spec excludes the last frame from the minimum, so a frame's
+// size is only counted once the next one arrives.
+func (e *Encoder) recordBlockSize(blockSize int) {
+	if e.totalSamples == 0 {
+		e.minBlockSize, e.maxBlockSize = 0xFFFF, 0
+	}
+	if e.lastBlockSize > 0 {
+		e.minBlockSize = min(e.minBlockSize, e.lastBlockSize)
+	}
+	e.lastBlockSize = uint16(blockSize)
+	e.maxBlockSize = max(e.maxBlockSize, uint16(blockSize))
+}
+
+// blockSizeRange returns the min/max block size for STREAMINFO. A stream
+// with a single frame reports that frame's size as both; the format
+// requires at least 16.
+func (e *Encoder) blockSizeRange() (uint16, uint16) {
+	minSize, maxSize := e.minBlockSize, e.maxBlockSize
+	if minSize > maxSize {
+		minSize = maxSize
+	}
+	return max(minSize, 16), max(maxSize, 16)
+}
@@ -0,0 +1,157 @@
+package flacenc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+)
+
+// transientSignal is quiet noise with a loud burst every 10000 samples,
+// the kind of signal where shorter frames around the attack pay off
+func transientSignal(frames, channels int) []int32 {
+	samples := make([]int32, frames*channels)
+	seed := uint32(1)
+	for i := 0; i < frames; i++ {
+		amp := 8.0
+		if pos := i % 10000; pos >= 7000 && pos < 7600 {
+			amp = 20000
+		}
+		for ch := 0; ch < channels; ch++ {
+			seed = seed*1664525 + 1013904223
+			noise := float64(int32(seed>>16)&0xFF) - 128
+			samples[i*channels+ch] = int32(amp*sin(float64(i)*0.05) + noise/16)
+		}
+	}
+	return samples
+}
+
+// frameHeaders parses the frame headers of an encoded stream
+func frameHeaders(t *testing.T, data []byte) []frame.Header {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []frame.Header
+	for {
+		f, err := stream.ParseNext()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, f.Header)
+	}
+}
+
+func TestEncoder_VariableBlockSize(t *testing.T) {
+	samples := transientSignal(50000, 2)
+
+	var fixed bytes.Buffer
+	if err := NewEncoder(44100, 2, 16).Encode(&fixed, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	enc := NewEncoder(44100, 2, 16)
+	enc.VariableBlockSize = true
+	var variable bytes.Buffer
+	if err := enc.Encode(&variable, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, decoded := decodeAll(t, variable.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+
+	if variable.Len() > fixed.Len() {
+		t.Errorf("variable block size output %d bytes, fixed %d", variable.Len(), fixed.Len())
+	}
+
+	headers := frameHeaders(t, variable.Bytes())
+	var next uint64
+	minSize, maxSize := uint16(0xFFFF), uint16(0)
+	for i, h := range headers {
+		if h.HasFixedBlockSize {
+			t.Fatalf("frame %d has the fixed blocking strategy bit", i)
+		}
+		if h.Num != next {
+			t.Errorf("frame %d sample number = %d, want %d", i, h.Num, next)
+		}
+		next += uint64(h.BlockSize)
+		if i < len(headers)-1 {
+			minSize = min(minSize, h.BlockSize)
+		}
+		maxSize = max(maxSize, h.BlockSize)
+	}
+	if minSize == maxSize {
+		t.Errorf("all frames are %d samples; expected splits around the transients", minSize)
+	}
+	if stream.Info.BlockSizeMin != minSize || stream.Info.BlockSizeMax != maxSize {
+		t.Errorf("STREAMINFO block sizes %d-%d, frames %d-%d",
+			stream.Info.BlockSizeMin, stream.Info.BlockSizeMax, minSize, maxSize)
+	}
+}
+
+func TestEncoder_VariableBlockSizeShort(t *testing.T) {
+	samples := testSignal(100, 1)
+
+	enc := NewEncoder(44100, 1, 16)
+	enc.VariableBlockSize = true
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+	if stream.Info.BlockSizeMin != 100 || stream.Info.BlockSizeMax != 100 {
+		t.Errorf("STREAMINFO block sizes %d-%d, want 100-100", stream.Info.BlockSizeMin, stream.Info.BlockSizeMax)
+	}
+}
+
+func TestStreamEncoder_VariableBlockSize(t *testing.T) {
+	samples := transientSignal(40000, 2)
+
+	var want bytes.Buffer
+	enc := NewEncoder(44100, 2, 16)
+	enc.VariableBlockSize = true
+	enc.SeekPointInterval = 8192
+	if err := enc.Encode(&want, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "out.flac")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senc := NewStreamEncoder(f, 44100, 2, 16)
+	senc.VariableBlockSize = true
+	senc.SeekPointInterval = 8192
+	senc.SeekPoints = 64
+	writeInChunks(t, senc, samples, 2)
+	if err := senc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[seekTableOffset+64*seekPointSize:], want.Bytes()[firstFrameOffset(want.Bytes()):]) {
+		t.Error("streamed frames differ from Encode output")
+	}
+
+	// Variable block size frames carry sample numbers
+	checkSeekTable(t, data, 1)
+	checkSeekTable(t, want.Bytes(), 1)
+
+	_, decoded := decodeAll(t, data)
+	assertSamplesEqual(t, decoded, samples)
+}
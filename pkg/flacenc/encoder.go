@@ -5,7 +5,10 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"math/bits"
 )
 
 // Encoder encodes audio to FLAC format
@@ -15,101 +18,112 @@ type Encoder struct {
 	BitsPerSample int
 	BlockSize     int // samples per block (typically 4096)
 
+	// Level is a libFLAC-style compression preset (0-8, default 5) for
+	// BlockSize, MaxLPCOrder, StereoDecorrelation, MaxPartitionOrder and
+	// ExhaustiveModelSearch. Assigning it directly takes effect when encoding
+	// starts and overrides those fields; use SetLevel to apply it right away
+	// and fine-tune from there.
+	Level int
+
+	// MaxLPCOrder is the highest LPC order tried per subframe (0 disables
+	// LPC, max 32)
+	MaxLPCOrder int
+	// QLPCoeffPrecision is the quantized LPC coefficient precision in bits
+	// (up to 15); 0 selects it from the block size like libFLAC does
+	QLPCoeffPrecision int
+	// MaxPartitionOrder is the highest Rice partition order searched (0-15).
+	// Higher orders adapt the Rice parameter to shorter stretches of residual.
+	MaxPartitionOrder int
+	// VariableBlockSize lets each BlockSize block be split into shorter
+	// frames where that codes smaller, e.g. around transients. Frames then
+	// carry sample numbers instead of frame numbers.
+	VariableBlockSize bool
+	// StereoDecorrelation tries left/side, right/side and mid/side coding
+	// for stereo frames
+	StereoDecorrelation bool
+	// ExhaustiveModelSearch encodes every LPC order up to MaxLPCOrder and
+	// keeps the smallest, instead of picking the order from the predicted
+	// prediction error
+	ExhaustiveModelSearch bool
+
+	// Concurrency is the number of frames encoded in parallel; 0 uses
+	// GOMAXPROCS. Output is identical for every setting.
+	Concurrency int
+
+	// VorbisComment is written after STREAMINFO when set; see AddTag
+	VorbisComment *VorbisComment
+	// Pictures are written as PICTURE blocks, e.g. cover art
+	Pictures []Picture
+	// Applications are written as APPLICATION blocks
+	Applications []Application
+	// Padding is the size in bytes of a trailing PADDING block, reserved
+	// so tags can later be edited in place (0 = none)
+	Padding int
+	// SeekPointInterval adds a SEEKTABLE with a seek point every that many
+	// samples (0 = none); see SetSeekInterval
+	SeekPointInterval int
+
+	appliedLevel int
+
 	totalSamples uint64
 	minBlockSize uint16
 	maxBlockSize uint16
-	minFrameSize uint32
-	maxFrameSize uint32
-	md5sum       [16]byte
-	md5hash      []byte
+	// lastBlockSize is the newest frame's block size in variable mode; it
+	// only counts towards the minimum once another frame follows
+	lastBlockSize uint16
+	minFrameSize  uint32
+	maxFrameSize  uint32
+	md5sum        [16]byte
+	md5hash       []byte
+
+	frameBytes     uint64 // bytes of frames written so far
+	seekInterval   int    // current seek point spacing, grows when thinning
+	seekLimit      int    // reserved seek points, 0 = unlimited
+	nextSeekSample uint64
+	seekPoints     []seekPoint
 }
 
 // NewEncoder creates a new FLAC encoder
 func NewEncoder(sampleRate, channels, bitsPerSample int) *Encoder {
-	return &Encoder{
+	e := &Encoder{
 		SampleRate:    sampleRate,
 		Channels:      channels,
 		BitsPerSample: bitsPerSample,
-		BlockSize:     4096,
 		minBlockSize:  4096,
 		maxBlockSize:  4096,
 		minFrameSize:  0xFFFFFF,
 		maxFrameSize:  0,
 	}
+	e.SetLevel(DefaultLevel)
+	return e
 }
 
 // Encode encodes PCM samples to FLAC
 func (e *Encoder) Encode(w io.Writer, samples []int32) error {
+	if err := e.applyLevel(); err != nil {
+		return err
+	}
+	if len(samples)%e.Channels != 0 {
+		return fmt.Errorf("%d samples is not a multiple of %d channels", len(samples), e.Channels)
+	}
+	blocks, err := e.metadataBlocks()
+	if err != nil {
+		return err
+	}
+
 	// We need to write to a buffer first to calculate MD5 and frame sizes
 	var buf bytes.Buffer
 
-	// Calculate total samples per channel
-	e.totalSamples = uint64(len(samples) / e.Channels)
+	e.reset()
 
 	// Compute MD5 of raw samples
 	md5h := md5.New()
-	for _, s := range samples {
-		// Write sample as little-endian based on bit depth
-		switch e.BitsPerSample {
-		case 8:
-			md5h.Write([]byte{byte(s)})
-		case 16:
-			b := make([]byte, 2)
-			binary.LittleEndian.PutUint16(b, uint16(int16(s)))
-			md5h.Write(b)
-		case 24:
-			b := make([]byte, 3)
-			b[0] = byte(s)
-			b[1] = byte(s >> 8)
-			b[2] = byte(s >> 16)
-			md5h.Write(b)
-		case 32:
-			b := make([]byte, 4)
-			binary.LittleEndian.PutUint32(b, uint32(s))
-			md5h.Write(b)
-		}
-	}
+	e.hashSamples(md5h, samples)
 	copy(e.md5sum[:], md5h.Sum(nil))
 
 	// Encode frames
-	samplesPerChannel := len(samples) / e.Channels
-	frameNum := uint64(0)
-
-	for offset := 0; offset < samplesPerChannel; offset += e.BlockSize {
-		blockSize := e.BlockSize
-		if offset+blockSize > samplesPerChannel {
-			blockSize = samplesPerChannel - offset
-		}
-
-		// Extract block samples (deinterleave)
-		block := make([][]int32, e.Channels)
-		for ch := 0; ch < e.Channels; ch++ {
-			block[ch] = make([]int32, blockSize)
-			for i := 0; i < blockSize; i++ {
-				block[ch][i] = samples[(offset+i)*e.Channels+ch]
-			}
-		}
-
-		frameSize, err := e.encodeFrame(&buf, block, frameNum)
-		if err != nil {
-			return fmt.Errorf("encode frame %d: %w", frameNum, err)
-		}
-
-		if uint32(frameSize) < e.minFrameSize {
-			e.minFrameSize = uint32(frameSize)
-		}
-		if uint32(frameSize) > e.maxFrameSize {
-			e.maxFrameSize = uint32(frameSize)
-		}
-
-		if uint16(blockSize) < e.minBlockSize {
-			e.minBlockSize = uint16(blockSize)
-		}
-		if uint16(blockSize) > e.maxBlockSize {
-			e.maxBlockSize = uint16(blockSize)
-		}
-
-		frameNum++
+	if _, err := e.encodeBlocks(&buf, samples, 0); err != nil {
+		return err
 	}
 
 	// Now write everything with correct header
@@ -118,8 +132,8 @@ func (e *Encoder) Encode(w io.Writer, samples []int32) error {
 		return err
 	}
 
-	// STREAMINFO block
-	if err := e.writeStreamInfo(w); err != nil {
+	// STREAMINFO and the remaining metadata blocks
+	if err := e.writeMetadata(w, blocks); err != nil {
 		return err
 	}
 
@@ -131,25 +145,116 @@ func (e *Encoder) Encode(w io.Writer, samples []int32) error {
 	return nil
 }
 
-// writeStreamInfo writes the STREAMINFO metadata block
-func (e *Encoder) writeStreamInfo(w io.Writer) error {
-	// Block header: 1 bit last-metadata-block flag + 7 bits type + 24 bits length
-	// Type 0 = STREAMINFO, length = 34 bytes
-	// 0x80 = last block flag set, type 0
-	header := []byte{0x80, 0x00, 0x00, 0x22} // 0x22 = 34 in decimal
-	if _, err := w.Write(header); err != nil {
+// reset clears the per-stream statistics reported in STREAMINFO
+func (e *Encoder) reset() {
+	e.totalSamples = 0
+	// Fixed-blocksize streams: every block but the last has BlockSize samples,
+	// and the last one is excluded from the minimum by the spec. Variable
+	// block size streams start from the splitter's bounds and track the
+	// actual sizes as frames are written.
+	e.minBlockSize = uint16(e.BlockSize)
+	e.maxBlockSize = uint16(e.BlockSize)
+	if e.VariableBlockSize {
+		e.minBlockSize = uint16(min(e.BlockSize, minSplitBlockSize))
+	}
+	e.lastBlockSize = 0
+	e.minFrameSize = 0xFFFFFF
+	e.maxFrameSize = 0
+	e.md5sum = [16]byte{}
+	e.frameBytes = 0
+	e.seekInterval = e.SeekPointInterval
+	e.seekLimit = 0
+	e.nextSeekSample = 0
+	e.seekPoints = nil
+}
+
+// hashSamples feeds interleaved samples to h as little-endian PCM, which
+// is what the STREAMINFO MD5 signature is computed over
+func (e *Encoder) hashSamples(h hash.Hash, samples []int32) {
+	bytesPerSample := (e.BitsPerSample + 7) / 8
+	buf := make([]byte, len(samples)*bytesPerSample)
+	for i, s := range samples {
+		for j := 0; j < bytesPerSample; j++ {
+			buf[i*bytesPerSample+j] = byte(s >> (8 * j))
+		}
+	}
+	h.Write(buf)
+}
+
+// encodedFrame is an encoded frame and the number of samples it holds
+type encodedFrame struct {
+	data      []byte
+	blockSize int
+}
+
+// encodeBlock deinterleaves one block and encodes it as a frame, or as
+// several frames in variable block size mode. blockNum is the block's
+// index in the stream. It only reads encoder settings, so blocks can be
+// encoded concurrently.
+func (e *Encoder) encodeBlock(samples []int32, blockNum uint64) ([]encodedFrame, error) {
+	blockSize := len(samples) / e.Channels
+
+	// Extract block samples (deinterleave)
+	block := make([][]int32, e.Channels)
+	for ch := 0; ch < e.Channels; ch++ {
+		block[ch] = make([]int32, blockSize)
+		for i := 0; i < blockSize; i++ {
+			block[ch][i] = samples[i*e.Channels+ch]
+		}
+	}
+
+	if e.VariableBlockSize {
+		return e.encodeVariableBlock(block, blockNum*uint64(e.BlockSize))
+	}
+
+	var buf bytes.Buffer
+	if _, err := e.encodeFrame(&buf, block, blockNum); err != nil {
+		return nil, fmt.Errorf("encode frame %d: %w", blockNum, err)
+	}
+	return []encodedFrame{{buf.Bytes(), blockSize}}, nil
+}
+
+// recordFrame updates the STREAMINFO statistics for a written frame
+func (e *Encoder) recordFrame(frameSize, blockSize int) {
+	if e.VariableBlockSize {
+		e.recordBlockSize(blockSize)
+	}
+	if uint32(frameSize) < e.minFrameSize {
+		e.minFrameSize = uint32(frameSize)
+	}
+	if uint32(frameSize) > e.maxFrameSize {
+		e.maxFrameSize = uint32(frameSize)
+	}
+	e.recordSeekPoint(e.totalSamples, blockSize)
+	e.totalSamples += uint64(blockSize)
+	e.frameBytes += uint64(frameSize)
+}
+
+// writeStreamInfo writes the STREAMINFO metadata block (type 0, 34 bytes)
+func (e *Encoder) writeStreamInfo(w io.Writer, last bool) error {
+	if err := writeMetadataHeader(w, blockStreamInfo, last, 34); err != nil {
 		return err
 	}
 
-	// STREAMINFO data (34 bytes)
+	return e.writeStreamInfoBody(w)
+}
+
+// writeStreamInfoBody writes the 34-byte STREAMINFO data without its
+// block header
+func (e *Encoder) writeStreamInfoBody(w io.Writer) error {
 	var buf bytes.Buffer
 
 	// Min block size (16 bits)
-	binary.Write(&buf, binary.BigEndian, e.minBlockSize)
+	minBlockSize, maxBlockSize := e.blockSizeRange()
+	binary.Write(&buf, binary.BigEndian, minBlockSize)
 	// Max block size (16 bits)
-	binary.Write(&buf, binary.BigEndian, e.maxBlockSize)
-	// Min frame size (24 bits)
-	buf.Write([]byte{byte(e.minFrameSize >> 16), byte(e.minFrameSize >> 8), byte(e.minFrameSize)})
+	binary.Write(&buf, binary.BigEndian, maxBlockSize)
+	// Min frame size (24 bits), 0 if unknown
+	minFrameSize := e.minFrameSize
+	if e.maxFrameSize == 0 {
+		minFrameSize = 0
+	}
+	buf.Write([]byte{byte(minFrameSize >> 16), byte(minFrameSize >> 8), byte(minFrameSize)})
 	// Max frame size (24 bits)
 	buf.Write([]byte{byte(e.maxFrameSize >> 16), byte(e.maxFrameSize >> 8), byte(e.maxFrameSize)})
 
@@ -175,11 +280,16 @@ func (e *Encoder) writeStreamInfo(w io.Writer) error {
 
 // encodeFrame encodes a single frame
 func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (int, error) {
+	channelCode, subframes := e.planChannels(block)
+	return e.writeFrame(w, len(block[0]), frameNum, channelCode, subframes)
+}
+
+// writeFrame writes a frame from planned subframes. number is the frame
+// number, or the first sample number in variable block size mode.
+func (e *Encoder) writeFrame(w io.Writer, blockSize int, number uint64, channelCode int, subframes []*subframePlan) (int, error) {
 	var buf bytes.Buffer
 	bw := NewBitWriter(&buf)
 
-	blockSize := len(block[0])
-
 	// Frame header
 	bw.ResetCRC8()
 	bw.ResetCRC16()
@@ -188,8 +298,12 @@ func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (in
 	bw.WriteBits(0x3FFE, 14)
 	// Reserved (1 bit)
 	bw.WriteBits(0, 1)
-	// Blocking strategy (1 bit): 0 = fixed block size
-	bw.WriteBits(0, 1)
+	// Blocking strategy (1 bit): 0 = fixed block size, 1 = variable
+	if e.VariableBlockSize {
+		bw.WriteBits(1, 1)
+	} else {
+		bw.WriteBits(0, 1)
+	}
 
 	// Block size (4 bits) - encode block size
 	blockSizeCode := getBlockSizeCode(blockSize)
@@ -200,8 +314,7 @@ func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (in
 	bw.WriteBits(uint64(sampleRateCode), 4)
 
 	// Channel assignment (4 bits)
-	channelCode := uint64(e.Channels - 1)
-	bw.WriteBits(channelCode, 4)
+	bw.WriteBits(uint64(channelCode), 4)
 
 	// Sample size (3 bits)
 	sampleSizeCode := getSampleSizeCode(e.BitsPerSample)
@@ -211,7 +324,7 @@ func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (in
 	bw.WriteBits(0, 1)
 
 	// Frame/sample number (UTF-8 coded)
-	bw.WriteUTF8(frameNum)
+	bw.WriteUTF8(number)
 
 	// Block size (if code requires it)
 	if blockSizeCode == 6 {
@@ -235,8 +348,8 @@ func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (in
 	bw.WriteByte(crc8)
 
 	// Subframes (one per channel)
-	for ch := 0; ch < e.Channels; ch++ {
-		if err := e.encodeSubframe(bw, block[ch]); err != nil {
+	for _, sf := range subframes {
+		if err := e.writeSubframe(bw, sf); err != nil {
 			return 0, err
 		}
 	}
@@ -253,68 +366,203 @@ func (e *Encoder) encodeFrame(w io.Writer, block [][]int32, frameNum uint64) (in
 	return n, err
 }
 
-// encodeSubframe encodes a single subframe using FIXED prediction
-func (e *Encoder) encodeSubframe(bw *BitWriter, samples []int32) error {
+// Subframe types
+const (
+	subframeConstant = iota
+	subframeVerbatim
+	subframeFixed
+	subframeLPC
+)
+
+// subframePlan is the encoding chosen for one subframe
+type subframePlan struct {
+	samples   []int32 // shifted right by wasted
+	bps       int     // bits per sample after removing wasted bits
+	wasted    int     // common trailing zero bits removed from every sample
+	kind      int
+	order     int           // FIXED predictor order
+	lpc       *lpcCandidate // LPC predictor
+	residuals []int32
+	rice      *riceCoding
+	bits      int64 // estimated encoded size
+}
+
+// analyzeSubframe chooses the smallest encoding for a subframe. Blocks
+// holding a single value become CONSTANT subframes; common trailing zero
+// bits are stripped and signalled as wasted bits before prediction.
+func (e *Encoder) analyzeSubframe(samples []int32, bps int) *subframePlan {
+	if isConstant(samples) {
+		return &subframePlan{samples: samples, bps: bps, kind: subframeConstant, bits: int64(8 + bps)}
+	}
+
+	wasted := wastedBits(samples)
+	if wasted == 0 {
+		return e.analyzePredictors(samples, bps)
+	}
+
+	shifted := make([]int32, len(samples))
+	for i, s := range samples {
+		shifted[i] = s >> wasted
+	}
+	plan := e.analyzePredictors(shifted, bps-wasted)
+	plan.wasted = wasted
+	plan.bits += int64(wasted)
+	return plan
+}
+
+// analyzePredictors chooses between FIXED, LPC and VERBATIM encoding by
+// estimated size
+func (e *Encoder) analyzePredictors(samples []int32, bps int) *subframePlan {
 	// Try different prediction orders and pick the best
-	bestOrder := 0
-	bestSize := int64(1<<63 - 1)
+	plan := &subframePlan{samples: samples, bps: bps, kind: subframeFixed, bits: 1<<63 - 1}
 
-	for order := 0; order <= 4; order++ {
+	for order := 0; order <= 4 && order <= len(samples); order++ {
+		// An order k residual needs up to bps+k bits, which may not fit
+		// in 32 for high bit depths
+		if bps+order > 32 && !fixedResidualsFit(samples, order) {
+			continue
+		}
 		residuals := computeFixedResiduals(samples, order)
-		size := estimateRiceSize(residuals)
-		if size < bestSize {
-			bestSize = size
-			bestOrder = order
+		rice := planRice(residuals, order, e.MaxPartitionOrder)
+		size := int64(8+order*bps) + rice.bits
+		if size < plan.bits {
+			plan.order = order
+			plan.residuals = residuals
+			plan.rice = rice
+			plan.bits = size
 		}
 	}
 
+	if lpc, lpcSize := e.findBestLPC(samples, bps); lpc != nil && lpcSize < plan.bits {
+		plan.kind = subframeLPC
+		plan.lpc = lpc
+		plan.residuals = lpc.residuals
+		plan.rice = lpc.rice
+		plan.bits = lpcSize
+	}
+
 	// Also try verbatim
-	verbatimSize := int64(len(samples) * e.BitsPerSample)
-	if verbatimSize < bestSize {
-		return e.encodeVerbatimSubframe(bw, samples)
+	if verbatimSize := int64(8 + len(samples)*bps); verbatimSize < plan.bits {
+		plan.kind = subframeVerbatim
+		plan.bits = verbatimSize
 	}
 
-	return e.encodeFixedSubframe(bw, samples, bestOrder)
+	return plan
 }
 
-// encodeVerbatimSubframe encodes without compression
-func (e *Encoder) encodeVerbatimSubframe(bw *BitWriter, samples []int32) error {
-	// Subframe header
+// writeSubframe writes a planned subframe
+func (e *Encoder) writeSubframe(bw *BitWriter, sf *subframePlan) error {
+	switch sf.kind {
+	case subframeConstant:
+		return e.encodeConstantSubframe(bw, sf.samples, sf.bps)
+	case subframeVerbatim:
+		return e.encodeVerbatimSubframe(bw, sf.samples, sf.bps, sf.wasted)
+	case subframeLPC:
+		return e.encodeLPCSubframe(bw, sf.samples, sf.bps, sf.wasted, sf.lpc)
+	default:
+		return e.encodeFixedSubframe(bw, sf.samples, sf.bps, sf.wasted, sf.order, sf.residuals, sf.rice)
+	}
+}
+
+// isConstant reports whether every sample has the same value
+func isConstant(samples []int32) bool {
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// wastedBits returns the number of trailing zero bits shared by all samples
+func wastedBits(samples []int32) int {
+	var or uint32
+	for _, s := range samples {
+		or |= uint32(s)
+	}
+	if or == 0 {
+		return 0
+	}
+	return bits.TrailingZeros32(or)
+}
+
+// encodeSubframe encodes a single subframe with the best encoding found
+func (e *Encoder) encodeSubframe(bw *BitWriter, samples []int32, bps int) error {
+	return e.writeSubframe(bw, e.analyzeSubframe(samples, bps))
+}
+
+// writeSubframeHeader writes the subframe type and wasted bits field
+func writeSubframeHeader(bw *BitWriter, subframeType uint64, wasted int) {
 	// 1 bit zero padding
 	bw.WriteBits(0, 1)
-	// 6 bits subframe type: 1 = VERBATIM
-	bw.WriteBits(1, 6)
-	// 1 bit wasted bits flag
-	bw.WriteBits(0, 1)
+	// 6 bits subframe type
+	bw.WriteBits(subframeType, 6)
+	// 1 bit wasted bits flag, followed by wasted-1 in unary (zeros ending in a one)
+	if wasted == 0 {
+		bw.WriteBits(0, 1)
+		return
+	}
+	bw.WriteBits(1, 1)
+	bw.WriteBits(1, wasted)
+}
+
+// encodeConstantSubframe encodes a block holding a single value
+func (e *Encoder) encodeConstantSubframe(bw *BitWriter, samples []int32, bps int) error {
+	// Subframe header: 000000 = CONSTANT
+	writeSubframeHeader(bw, 0, 0)
+
+	// The value, unencoded
+	return bw.WriteBits(uint64(uint32(samples[0])), bps)
+}
+
+// encodeVerbatimSubframe encodes without compression
+func (e *Encoder) encodeVerbatimSubframe(bw *BitWriter, samples []int32, bps, wasted int) error {
+	// Subframe header: 000001 = VERBATIM
+	writeSubframeHeader(bw, 1, wasted)
 
 	// Raw samples
 	for _, s := range samples {
-		bw.WriteBits(uint64(uint32(s)), e.BitsPerSample)
+		bw.WriteBits(uint64(uint32(s)), bps)
 	}
 
 	return nil
 }
 
 // encodeFixedSubframe encodes using FIXED prediction
-func (e *Encoder) encodeFixedSubframe(bw *BitWriter, samples []int32, order int) error {
-	// Subframe header
-	// 1 bit zero padding
-	bw.WriteBits(0, 1)
-	// 6 bits subframe type: 001xxx = FIXED, xxx = order
-	bw.WriteBits(uint64(0x08|order), 6)
-	// 1 bit wasted bits flag
-	bw.WriteBits(0, 1)
+func (e *Encoder) encodeFixedSubframe(bw *BitWriter, samples []int32, bps, wasted, order int, residuals []int32, rice *riceCoding) error {
+	// Subframe header: 001xxx = FIXED, xxx = order
+	writeSubframeHeader(bw, uint64(0x08|order), wasted)
 
 	// Warmup samples (unencoded)
 	for i := 0; i < order; i++ {
-		bw.WriteBits(uint64(uint32(samples[i])), e.BitsPerSample)
+		bw.WriteBits(uint64(uint32(samples[i])), bps)
+	}
+
+	// Encode residuals with Rice coding
+	return encodeResidual(bw, residuals, order, rice)
+}
+
+// encodeLPCSubframe encodes using a quantized LPC predictor
+func (e *Encoder) encodeLPCSubframe(bw *BitWriter, samples []int32, bps, wasted int, lpc *lpcCandidate) error {
+	// Subframe header: 1xxxxx = LPC, xxxxx = order-1
+	writeSubframeHeader(bw, uint64(0x20|(lpc.order-1)), wasted)
+
+	// Warmup samples (unencoded)
+	for i := 0; i < lpc.order; i++ {
+		bw.WriteBits(uint64(uint32(samples[i])), bps)
 	}
 
-	// Compute residuals
-	residuals := computeFixedResiduals(samples, order)
+	// Quantized coefficient precision - 1 (4 bits)
+	bw.WriteBits(uint64(lpc.precision-1), 4)
+	// Quantized coefficient shift (5 bits, signed)
+	bw.WriteBits(uint64(lpc.shift), 5)
+	// Coefficients (precision bits each, signed)
+	for _, c := range lpc.coeffs {
+		bw.WriteBits(uint64(uint32(c)), lpc.precision)
+	}
 
 	// Encode residuals with Rice coding
-	return encodeRicePartition(bw, residuals)
+	return encodeResidual(bw, lpc.residuals, lpc.order, lpc.rice)
 }
 
 // computeFixedResiduals computes residuals for FIXED prediction
@@ -353,87 +601,68 @@ func computeFixedResiduals(samples []int32, order int) []int32 {
 	return residuals
 }
 
-// estimateRiceSize estimates bits needed for Rice coding
-func estimateRiceSize(residuals []int32) int64 {
-	if len(residuals) == 0 {
-		return 0
-	}
-
-	// Find optimal k parameter
-	var sum int64
-	for _, r := range residuals {
-		if r >= 0 {
-			sum += int64(r)
-		} else {
-			sum += int64(-r - 1)
+// fixedResidualsFit reports whether every fixed predictor residual of the
+// given order fits in an int32
+func fixedResidualsFit(samples []int32, order int) bool {
+	coeffs := [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}[order]
+	for i := order; i < len(samples); i++ {
+		r := int64(samples[i])
+		for j, c := range coeffs {
+			r -= c * int64(samples[i-j-1])
 		}
-	}
-
-	// Estimate k from average magnitude
-	avg := float64(sum) / float64(len(residuals))
-	k := 0
-	for (1 << k) < int(avg) {
-		k++
-	}
-	if k > 14 {
-		k = 14
-	}
-
-	// Estimate total bits
-	var bits int64
-	for _, r := range residuals {
-		var uval uint32
-		if r >= 0 {
-			uval = uint32(r) << 1
-		} else {
-			uval = (uint32(-r-1) << 1) | 1
+		if r > math.MaxInt32 || r < math.MinInt32 {
+			return false
 		}
-		q := uval >> k
-		bits += int64(q) + 1 + int64(k)
 	}
-
-	return bits
+	return true
 }
 
-// encodeRicePartition encodes residuals using Rice coding
-func encodeRicePartition(bw *BitWriter, residuals []int32) error {
-	if len(residuals) == 0 {
-		// Write minimal partition header
-		bw.WriteBits(0, 2) // encoding method
-		bw.WriteBits(0, 4) // partition order
-		return nil
-	}
-
-	// Calculate optimal Rice parameter
-	var sum int64
-	for _, r := range residuals {
-		if r >= 0 {
-			sum += int64(r)
-		} else {
-			sum += int64(-r - 1)
-		}
-	}
+// estimateRiceSize estimates bits needed for partitioned Rice coding of
+// the residuals of a predictor of the given order, including the residual
+// section header
+func estimateRiceSize(residuals []int32, predictorOrder, maxPartitionOrder int) int64 {
+	return planRice(residuals, predictorOrder, maxPartitionOrder).bits
+}
 
-	avg := float64(sum) / float64(len(residuals))
-	k := 0
-	for (1 << k) < int(avg) {
-		k++
+// encodeResidual writes the residual section of a subframe as planned by
+// planRice
+func encodeResidual(bw *BitWriter, residuals []int32, predictorOrder int, rc *riceCoding) error {
+	paramBits := 4
+	if rc.method == rice2Method {
+		paramBits = 5
 	}
-	if k > 14 {
-		k = 14
-	}
-
-	// Residual coding method (2 bits): 0 = Rice coding with 4-bit parameter
-	bw.WriteBits(0, 2)
-	// Partition order (4 bits): 0 = single partition
-	bw.WriteBits(0, 4)
-	// Rice parameter (4 bits for method 0, 5 bits for method 1)
-	bw.WriteBits(uint64(k), 4)
+	escapeCode := uint64(1)<<paramBits - 1
+
+	// Residual coding method (2 bits): 0 = 4-bit parameters, 1 = 5-bit
+	bw.WriteBits(uint64(rc.method), 2)
+	// Partition order (4 bits)
+	bw.WriteBits(uint64(rc.order), 4)
+
+	blockSize := len(residuals) + predictorOrder
+	idx := 0
+	for p := range rc.params {
+		n := partitionSamples(blockSize, predictorOrder, rc.order, p)
+		part := residuals[idx : idx+n]
+		idx += n
+
+		if raw := rc.escape[p]; raw > 0 {
+			// Escaped partition: escape code, 5-bit sample size, raw samples
+			bw.WriteBits(escapeCode, paramBits)
+			bw.WriteBits(uint64(raw), 5)
+			for _, r := range part {
+				if err := bw.WriteBits(uint64(uint32(r)), raw); err != nil {
+					return err
+				}
+			}
+			continue
+		}
 
-	// Encode each residual
-	for _, r := range residuals {
-		if err := bw.WriteSignedRice(r, k); err != nil {
-			return err
+		k := rc.params[p]
+		bw.WriteBits(uint64(k), paramBits)
+		for _, r := range part {
+			if err := bw.WriteSignedRice(r, k); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -524,7 +753,7 @@ func getSampleSizeCode(bitsPerSample int) int {
 	case 24:
 		return 6
 	case 32:
-		return 7 // Non-standard but some decoders support it
+		return 7 // Defined by RFC 9639; older decoders treat it as reserved
 	default:
 		return 0 // Get from STREAMINFO
 	}
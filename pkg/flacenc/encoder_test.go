@@ -2,7 +2,14 @@ package flacenc
 
 import (
 	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"math"
 	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
 )
 
 func TestBitWriter_WriteBits(t *testing.T) {
@@ -75,6 +82,47 @@ func TestBitWriter_WriteSignedRice(t *testing.T) {
 	}
 }
 
+func TestBitWriter_WriteSignedRiceBits(t *testing.T) {
+	// FLAC codes the zig-zagged value's quotient as that many zeros
+	// followed by a one, then the low k bits as is
+	tests := []struct {
+		value int32
+		k     int
+		bits  string
+	}{
+		{0, 0, "1"},
+		{1, 0, "001"},
+		{-1, 0, "01"},
+		{0, 2, "100"},
+		{5, 2, "00110"},
+		{-3, 2, "0101"},
+		{20, 0, "00000000000000000000000000000000000000001"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		bw := NewBitWriter(&buf)
+		if err := bw.WriteSignedRice(tt.value, tt.k); err != nil {
+			t.Fatalf("WriteSignedRice(%d, %d) error: %v", tt.value, tt.k, err)
+		}
+		bw.Flush()
+
+		var got []byte
+		for i := 0; i < len(tt.bits); i++ {
+			got = append(got, '0'+buf.Bytes()[i/8]>>(7-i%8)&1)
+		}
+		if string(got) != tt.bits {
+			t.Errorf("WriteSignedRice(%d, %d) = %s, want %s", tt.value, tt.k, got, tt.bits)
+		}
+		// Flush pads with zeros, so nothing else should be set
+		for i := len(tt.bits); i < buf.Len()*8; i++ {
+			if buf.Bytes()[i/8]>>(7-i%8)&1 != 0 {
+				t.Errorf("WriteSignedRice(%d, %d): bit %d set past the code", tt.value, tt.k, i)
+			}
+		}
+	}
+}
+
 func TestBitWriter_WriteUTF8(t *testing.T) {
 	tests := []struct {
 		value    uint64
@@ -133,11 +181,11 @@ func TestComputeFixedResiduals(t *testing.T) {
 func TestEstimateRiceSize(t *testing.T) {
 	// Small residuals should have small size
 	small := []int32{0, 1, -1, 2, -2, 1, 0, -1}
-	smallSize := estimateRiceSize(small)
+	smallSize := estimateRiceSize(small, 0, 0)
 
 	// Large residuals should have larger size
 	large := []int32{1000, -1000, 2000, -2000}
-	largeSize := estimateRiceSize(large)
+	largeSize := estimateRiceSize(large, 0, 0)
 
 	if smallSize >= largeSize {
 		t.Errorf("small residuals (%d) should be smaller than large (%d)",
@@ -260,6 +308,459 @@ func TestEncoder_Stereo(t *testing.T) {
 	}
 }
 
+// decodeAll decodes a FLAC stream with mewkiz/flac and returns the
+// interleaved samples, verifying the STREAMINFO MD5 (if set) along the way
+func decodeAll(t *testing.T, data []byte) (*flac.Stream, []int32) {
+	t.Helper()
+
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("flac.New: %v", err)
+	}
+
+	var samples []int32
+	md5h := md5.New()
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parse frame: %v", err)
+		}
+		frame.Hash(md5h)
+		for i := 0; i < int(frame.BlockSize); i++ {
+			for ch := range frame.Subframes {
+				samples = append(samples, frame.Subframes[ch].Samples[i])
+			}
+		}
+	}
+
+	if stream.Info.MD5sum != [16]byte{} && !bytes.Equal(md5h.Sum(nil), stream.Info.MD5sum[:]) {
+		t.Errorf("MD5 mismatch: stream %x, decoded %x", stream.Info.MD5sum, md5h.Sum(nil))
+	}
+	return stream, samples
+}
+
+func assertSamplesEqual(t *testing.T, got, want []int32) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample[%d] = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestEncoder_Roundtrip(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		samples := make([]int32, 10000*channels)
+		for i := range samples {
+			samples[i] = int32(20000*sin(float64(i)*0.01)) + int32(i%7)
+		}
+
+		var buf bytes.Buffer
+		if err := NewEncoder(44100, channels, 16).Encode(&buf, samples); err != nil {
+			t.Fatalf("Encode error: %v", err)
+		}
+
+		stream, decoded := decodeAll(t, buf.Bytes())
+		if stream.Info.NSamples != 10000 {
+			t.Errorf("NSamples = %d, want 10000", stream.Info.NSamples)
+		}
+		assertSamplesEqual(t, decoded, samples)
+	}
+}
+
+func TestEncoder_HighBitDepth(t *testing.T) {
+	for _, bps := range []int{8, 20, 24} {
+		scale := float64(int64(1)<<(bps-1) - 1)
+		samples := make([]int32, 10000*2)
+		for i := range samples {
+			// Full-scale tone with noise in the low bits, so nothing is wasted
+			s := scale*sin(float64(i/2)*0.02) - float64(i%3)
+			samples[i] = int32(max(min(s, scale), -scale))
+		}
+
+		var buf bytes.Buffer
+		if err := NewEncoder(96000, 2, bps).Encode(&buf, samples); err != nil {
+			t.Fatalf("%d bits: Encode error: %v", bps, err)
+		}
+
+		stream, decoded := decodeAll(t, buf.Bytes())
+		if int(stream.Info.BitsPerSample) != bps {
+			t.Errorf("BitsPerSample = %d, want %d", stream.Info.BitsPerSample, bps)
+		}
+		assertSamplesEqual(t, decoded, samples)
+	}
+}
+
+// bitReader reads MSB-first bit fields for decodeFrames
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) read(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) readSigned(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	return int64(r.read(n)<<(64-n)) >> (64 - n)
+}
+
+func (r *bitReader) readUnary() int {
+	n := 0
+	for r.read(1) == 0 {
+		n++
+	}
+	return n
+}
+
+// decodeFrames is a minimal FLAC frame decoder for streams mewkiz/flac
+// can't read (32 bits per sample). It trusts the CRCs and returns the
+// interleaved samples of every frame.
+func decodeFrames(t *testing.T, data []byte, channels, bps int) []int32 {
+	t.Helper()
+
+	r := &bitReader{data: data, pos: firstFrameOffset(data) * 8}
+	var out []int32
+	for r.pos/8 < len(data) {
+		if sync := r.read(14); sync != 0x3FFE {
+			t.Fatalf("bad frame sync %#x at byte %d", sync, r.pos/8)
+		}
+		r.read(2)
+		blockSizeCode := int(r.read(4))
+		sampleRateCode := r.read(4)
+		assignment := int(r.read(4))
+		r.read(4)
+		// UTF-8 coded frame number: leading ones give the byte count
+		first := r.read(8)
+		for n := 7; n > 0 && first&(1<<n) != 0; n-- {
+			if n < 7 {
+				r.read(8)
+			}
+		}
+
+		var blockSize int
+		switch {
+		case blockSizeCode == 1:
+			blockSize = 192
+		case blockSizeCode <= 5:
+			blockSize = 576 << (blockSizeCode - 2)
+		case blockSizeCode == 6:
+			blockSize = int(r.read(8)) + 1
+		case blockSizeCode == 7:
+			blockSize = int(r.read(16)) + 1
+		default:
+			blockSize = 256 << (blockSizeCode - 8)
+		}
+		switch sampleRateCode {
+		case 12:
+			r.read(8)
+		case 13, 14:
+			r.read(16)
+		}
+		r.read(8) // CRC-8
+
+		subframes := make([][]int64, channels)
+		for ch := range subframes {
+			sfBps := bps
+			if assignment == channelLeftSide && ch == 1 || assignment == channelRightSide && ch == 0 ||
+				assignment == channelMidSide && ch == 1 {
+				sfBps++
+			}
+			subframes[ch] = decodeSubframe(t, r, blockSize, sfBps)
+		}
+
+		for i := 0; i < blockSize; i++ {
+			a, b := subframes[0][i], int64(0)
+			if channels == 2 {
+				b = subframes[1][i]
+			}
+			switch assignment {
+			case channelLeftSide:
+				subframes[1][i] = a - b
+			case channelRightSide:
+				subframes[0][i] = a + b
+			case channelMidSide:
+				mid := a<<1 | b&1
+				subframes[0][i] = (mid + b) >> 1
+				subframes[1][i] = (mid - b) >> 1
+			}
+			for ch := range subframes {
+				out = append(out, int32(subframes[ch][i]))
+			}
+		}
+
+		// Byte alignment, then CRC-16
+		r.pos = (r.pos+7)/8*8 + 16
+	}
+	return out
+}
+
+// decodeSubframe decodes one subframe of blockSize samples
+func decodeSubframe(t *testing.T, r *bitReader, blockSize, bps int) []int64 {
+	t.Helper()
+
+	r.read(1)
+	typ := int(r.read(6))
+	wasted := 0
+	if r.read(1) == 1 {
+		wasted = r.readUnary() + 1
+	}
+	bps -= wasted
+
+	samples := make([]int64, blockSize)
+	switch {
+	case typ == subframeConstant:
+		v := r.readSigned(bps)
+		for i := range samples {
+			samples[i] = v
+		}
+	case typ == subframeVerbatim:
+		for i := range samples {
+			samples[i] = r.readSigned(bps)
+		}
+	case typ&0x38 == 0x08:
+		order := typ & 0x07
+		for i := 0; i < order; i++ {
+			samples[i] = r.readSigned(bps)
+		}
+		decodeResidual(r, samples, order)
+		coeffs := [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}[order]
+		predict(samples, coeffs, 0)
+	case typ&0x20 != 0:
+		order := typ&0x1F + 1
+		for i := 0; i < order; i++ {
+			samples[i] = r.readSigned(bps)
+		}
+		precision := int(r.read(4)) + 1
+		shift := int(r.readSigned(5))
+		coeffs := make([]int64, order)
+		for i := range coeffs {
+			coeffs[i] = r.readSigned(precision)
+		}
+		decodeResidual(r, samples, order)
+		predict(samples, coeffs, shift)
+	default:
+		t.Fatalf("reserved subframe type %d", typ)
+	}
+
+	for i := range samples {
+		samples[i] <<= wasted
+	}
+	return samples
+}
+
+// decodeResidual reads partitioned Rice coded residuals into
+// samples[order:]
+func decodeResidual(r *bitReader, samples []int64, order int) {
+	method := int(r.read(2))
+	paramBits, escape := 4, 15
+	if method == rice2Method {
+		paramBits, escape = 5, 31
+	}
+	partOrder := int(r.read(4))
+
+	i := order
+	for p := 0; p < 1<<partOrder; p++ {
+		n := partitionSamples(len(samples), order, partOrder, p)
+		param := int(r.read(paramBits))
+		if param == escape {
+			rawBits := int(r.read(5))
+			for end := i + n; i < end; i++ {
+				samples[i] = r.readSigned(rawBits)
+			}
+			continue
+		}
+		for end := i + n; i < end; i++ {
+			u := uint64(r.readUnary())<<param | r.read(param)
+			samples[i] = int64(u>>1) ^ -int64(u&1)
+		}
+	}
+}
+
+// predict turns residuals after the warmup into samples
+func predict(samples, coeffs []int64, shift int) {
+	for i := len(coeffs); i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * samples[i-j-1]
+		}
+		samples[i] += sum >> shift
+	}
+}
+
+func TestEncoder_32Bit(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		samples := make([]int32, 5000*channels)
+		for i := range samples {
+			samples[i] = int32(2147483000*sin(float64(i/channels)*0.02)) - int32(i%3)
+		}
+		// A full-scale swing, so some residuals only fit escaped or verbatim
+		samples[100*channels] = math.MaxInt32
+		samples[101*channels] = math.MinInt32
+
+		var buf bytes.Buffer
+		if err := NewEncoder(96000, channels, 32).Encode(&buf, samples); err != nil {
+			t.Fatalf("Encode error: %v", err)
+		}
+
+		// mewkiz/flac predates 32-bit support: check the header bits, then
+		// decode the frames ourselves
+		data := buf.Bytes()
+		if bps := ((data[20]&0x01)<<4 | data[21]>>4) + 1; bps != 32 {
+			t.Errorf("STREAMINFO bits per sample = %d, want 32", bps)
+		}
+		frame := data[firstFrameOffset(data):]
+		if code := frame[3] >> 1 & 0x07; code != 7 {
+			t.Errorf("frame sample size code = %d, want 7", code)
+		}
+		assertSamplesEqual(t, decodeFrames(t, data, channels, 32), samples)
+	}
+}
+
+func TestFixedResidualsFit(t *testing.T) {
+	samples := []int32{math.MaxInt32, math.MinInt32, math.MaxInt32}
+	if !fixedResidualsFit(samples, 0) {
+		t.Error("order 0 residuals are the samples and always fit")
+	}
+	if fixedResidualsFit(samples, 1) {
+		t.Error("order 1 residual of a full-scale swing doesn't fit in 32 bits")
+	}
+}
+
+func TestWastedBits(t *testing.T) {
+	tests := []struct {
+		samples []int32
+		want    int
+	}{
+		{[]int32{1, 2, 3}, 0},
+		{[]int32{256, -512, 768}, 8},
+		{[]int32{0, 0, 4}, 2},
+		{[]int32{0, 0}, 0},
+		{[]int32{-32768, 0}, 15},
+	}
+	for _, tt := range tests {
+		if got := wastedBits(tt.samples); got != tt.want {
+			t.Errorf("wastedBits(%v) = %d, want %d", tt.samples, got, tt.want)
+		}
+	}
+}
+
+// firstFrameSubframes returns the parsed subframes of the first frame
+func firstFrameSubframes(t *testing.T, data []byte) []*frame.Subframe {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := stream.ParseNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Subframes
+}
+
+func TestEncoder_ConstantSubframe(t *testing.T) {
+	tests := []struct {
+		name  string
+		value int32
+	}{
+		{"digital silence", 0},
+		{"DC offset", -1234},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := make([]int32, 4096*2*3)
+			for i := range samples {
+				samples[i] = tt.value
+			}
+
+			var buf bytes.Buffer
+			if err := NewEncoder(44100, 2, 16).Encode(&buf, samples); err != nil {
+				t.Fatalf("Encode error: %v", err)
+			}
+			_, decoded := decodeAll(t, buf.Bytes())
+			assertSamplesEqual(t, decoded, samples)
+
+			for _, sf := range firstFrameSubframes(t, buf.Bytes()) {
+				if sf.Pred != frame.PredConstant {
+					t.Errorf("subframe prediction = %v, want CONSTANT", sf.Pred)
+				}
+			}
+			// 3 frames of a few bytes each, plus the 42-byte header
+			if buf.Len() > 100 {
+				t.Errorf("constant signal encoded to %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestEncoder_WastedBits(t *testing.T) {
+	tests := []struct {
+		name   string
+		bps    int
+		shift  int
+		wasted uint
+	}{
+		{"8-bit in 16-bit", 16, 8, 8},
+		{"16-bit in 24-bit", 24, 8, 8},
+		{"even samples", 16, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := make([]int32, 8192)
+			for i := range samples {
+				v := int32(100*sin(float64(i)*0.02)) + int32(i%3)
+				samples[i] = v << tt.shift
+			}
+
+			var buf bytes.Buffer
+			if err := NewEncoder(44100, 1, tt.bps).Encode(&buf, samples); err != nil {
+				t.Fatalf("Encode error: %v", err)
+			}
+			_, decoded := decodeAll(t, buf.Bytes())
+			assertSamplesEqual(t, decoded, samples)
+
+			sf := firstFrameSubframes(t, buf.Bytes())[0]
+			if sf.Wasted != tt.wasted {
+				t.Errorf("wasted bits = %d, want %d", sf.Wasted, tt.wasted)
+			}
+		})
+	}
+}
+
+func TestEncoder_WastedBitsStereo(t *testing.T) {
+	// Upsampled 8-bit stereo: the side channel has wasted bits too
+	samples := make([]int32, 8192*2)
+	for i := 0; i < 8192; i++ {
+		samples[i*2] = int32(100*sin(float64(i)*0.02)) << 8
+		samples[i*2+1] = int32(90*sin(float64(i)*0.021)) << 8
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(44100, 2, 16).Encode(&buf, samples); err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
 // Simple sine approximation
 func sin(x float64) float64 {
 	for x > 3.14159 {
@@ -284,6 +785,29 @@ func BenchmarkEncoder_1Sec(b *testing.B) {
 	}
 }
 
+// BenchmarkEncoder_Concurrency encodes 10 seconds of stereo audio with
+// increasing worker counts to show how frame encoding scales across cores
+func BenchmarkEncoder_Concurrency(b *testing.B) {
+	samples := make([]int32, 441000*2)
+	for i := range samples {
+		samples[i] = int32(12000*sin(float64(i/2)*0.03)) + int32(i*7919%97)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			enc := NewEncoder(44100, 2, 16)
+			enc.Concurrency = workers
+			b.SetBytes(int64(len(samples) * 2))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				enc.Encode(&buf, samples)
+			}
+		})
+	}
+}
+
 func BenchmarkComputeResiduals(b *testing.B) {
 	samples := make([]int32, 4096)
 	for i := range samples {
@@ -0,0 +1,62 @@
+package flacenc
+
+import "fmt"
+
+const (
+	// DefaultLevel is the compression level NewEncoder starts with
+	DefaultLevel = 5
+	// MaxLevel is the slowest, strongest compression level
+	MaxLevel = 8
+)
+
+// levelPreset holds the tuning fields a compression level sets
+type levelPreset struct {
+	blockSize             int
+	maxLPCOrder           int
+	stereoDecorrelation   bool
+	maxPartitionOrder     int
+	exhaustiveModelSearch bool
+}
+
+// levelPresets mirror libFLAC's -0 ... -8. None of them enables
+// exhaustive model search, which is libFLAC's separate -e option. -7 and
+// -8 only differ in apodization windows, which this encoder doesn't vary.
+var levelPresets = [MaxLevel + 1]levelPreset{
+	{1152, 0, false, 3, false},
+	{1152, 0, true, 3, false},
+	{1152, 0, true, 3, false},
+	{4096, 6, false, 4, false},
+	{4096, 8, true, 4, false},
+	{4096, 8, true, 5, false},
+	{4096, 8, true, 6, false},
+	{4096, 12, true, 6, false},
+	{4096, 12, true, 6, false},
+}
+
+// SetLevel applies a compression level preset (0-8) immediately, so the
+// individual tuning fields can be adjusted afterwards
+func (e *Encoder) SetLevel(level int) error {
+	if level < 0 || level > MaxLevel {
+		return fmt.Errorf("invalid compression level %d (0-%d)", level, MaxLevel)
+	}
+
+	p := levelPresets[level]
+	e.BlockSize = p.blockSize
+	e.MaxLPCOrder = p.maxLPCOrder
+	e.StereoDecorrelation = p.stereoDecorrelation
+	e.MaxPartitionOrder = p.maxPartitionOrder
+	e.ExhaustiveModelSearch = p.exhaustiveModelSearch
+
+	e.Level = level
+	e.appliedLevel = level
+	return nil
+}
+
+// applyLevel applies Level if it was assigned directly since the last
+// preset was applied
+func (e *Encoder) applyLevel() error {
+	if e.Level == e.appliedLevel {
+		return nil
+	}
+	return e.SetLevel(e.Level)
+}
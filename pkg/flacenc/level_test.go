@@ -0,0 +1,75 @@
+package flacenc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoder_Levels(t *testing.T) {
+	left := multiTone(30000)
+	samples := stereoSignal(left, func(i int, l int32) int32 { return l/2 + int32(i%5) })
+
+	sizes := make([]int, MaxLevel+1)
+	for level := 0; level <= MaxLevel; level++ {
+		enc := NewEncoder(44100, 2, 16)
+		enc.Level = level
+
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, samples); err != nil {
+			t.Fatalf("level %d: Encode error: %v", level, err)
+		}
+		if enc.BlockSize != levelPresets[level].blockSize {
+			t.Errorf("level %d: BlockSize = %d, want %d", level, enc.BlockSize, levelPresets[level].blockSize)
+		}
+		_, decoded := decodeAll(t, buf.Bytes())
+		assertSamplesEqual(t, decoded, samples)
+		sizes[level] = buf.Len()
+	}
+
+	t.Logf("sizes by level: %v", sizes)
+	if sizes[8] >= sizes[0] {
+		t.Errorf("level 8 (%d bytes) should compress better than level 0 (%d bytes)", sizes[8], sizes[0])
+	}
+}
+
+func TestEncoder_InvalidLevel(t *testing.T) {
+	enc := NewEncoder(44100, 1, 16)
+	if err := enc.SetLevel(9); err == nil {
+		t.Error("SetLevel(9) should fail")
+	}
+
+	enc.Level = -1
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, make([]int32, 100)); err == nil {
+		t.Error("Encode with Level -1 should fail")
+	}
+}
+
+func TestEncoder_SetLevelThenTune(t *testing.T) {
+	enc := NewEncoder(44100, 1, 16)
+	if err := enc.SetLevel(8); err != nil {
+		t.Fatal(err)
+	}
+	enc.MaxLPCOrder = 4
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, multiTone(5000)); err != nil {
+		t.Fatal(err)
+	}
+	if enc.MaxLPCOrder != 4 {
+		t.Errorf("MaxLPCOrder = %d, want 4: tuning after SetLevel must be kept", enc.MaxLPCOrder)
+	}
+	if enc.ExhaustiveModelSearch {
+		t.Error("level 8 should leave exhaustive model search off, as libFLAC's -8 does")
+	}
+}
+
+func TestNewEncoder_DefaultLevel(t *testing.T) {
+	enc := NewEncoder(44100, 2, 16)
+	if enc.Level != DefaultLevel {
+		t.Errorf("Level = %d, want %d", enc.Level, DefaultLevel)
+	}
+	if enc.BlockSize != 4096 || enc.MaxLPCOrder != 8 || !enc.StereoDecorrelation {
+		t.Errorf("unexpected level 5 settings: %+v", enc)
+	}
+}
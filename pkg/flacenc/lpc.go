@@ -0,0 +1,317 @@
+package flacenc
+
+import (
+	"math"
+)
+
+const (
+	// maxLPCOrder is the highest LPC order allowed by the FLAC format
+	maxLPCOrder = 32
+
+	maxQLPCoeffPrecision = 15
+	maxQLPShift          = 15
+	minQLPShift          = 0
+)
+
+// lpcCandidate is a quantized LPC predictor for one subframe
+type lpcCandidate struct {
+	order     int
+	precision int
+	shift     int
+	coeffs    []int32
+	residuals []int32
+	rice      *riceCoding
+}
+
+// tukeyWindow applies a Tukey window with the given taper ratio (0.5 is
+// libFLAC's default) and returns the windowed copy of samples
+func tukeyWindow(samples []int32, p float64) []float64 {
+	n := len(samples)
+	out := make([]float64, n)
+	taper := int(p / 2 * float64(n))
+
+	for i, s := range samples {
+		w := 1.0
+		if taper > 0 {
+			if i < taper {
+				w = 0.5 - 0.5*math.Cos(math.Pi*float64(i)/float64(taper))
+			} else if i >= n-taper {
+				w = 0.5 - 0.5*math.Cos(math.Pi*float64(n-1-i)/float64(taper))
+			}
+		}
+		out[i] = float64(s) * w
+	}
+	return out
+}
+
+// autocorrelation computes autocorrelation lags 0..maxLag
+func autocorrelation(data []float64, maxLag int) []float64 {
+	autoc := make([]float64, maxLag+1)
+	for lag := 0; lag <= maxLag; lag++ {
+		var sum float64
+		for i := lag; i < len(data); i++ {
+			sum += data[i] * data[i-lag]
+		}
+		autoc[lag] = sum
+	}
+	return autoc
+}
+
+// levinsonDurbin solves for LPC coefficients of every order up to
+// maxOrder. coeffs[k] holds the k+1 coefficients of the order k+1
+// predictor, in the sign convention FLAC uses: pred = sum(c[j]*s[i-j-1]).
+// errs[k] is the corresponding prediction error. Fewer than maxOrder sets
+// are returned if the recursion becomes unstable or the error reaches zero.
+func levinsonDurbin(autoc []float64, maxOrder int) (coeffs [][]float64, errs []float64) {
+	if autoc[0] == 0 {
+		return nil, nil
+	}
+
+	lpc := make([]float64, maxOrder)
+	err := autoc[0]
+
+	for i := 0; i < maxOrder; i++ {
+		// Reflection coefficient
+		r := -autoc[i+1]
+		for j := 0; j < i; j++ {
+			r -= lpc[j] * autoc[i-j]
+		}
+		r /= err
+
+		// Update the predictor in place
+		lpc[i] = r
+		for j := 0; j < i/2; j++ {
+			tmp := lpc[j]
+			lpc[j] += r * lpc[i-1-j]
+			lpc[i-1-j] += r * tmp
+		}
+		if i%2 == 1 {
+			lpc[i/2] += lpc[i/2] * r
+		}
+
+		err *= 1 - r*r
+		if err < 0 || math.IsNaN(err) {
+			break
+		}
+
+		c := make([]float64, i+1)
+		for j := range c {
+			c[j] = -lpc[j]
+		}
+		coeffs = append(coeffs, c)
+		errs = append(errs, err)
+
+		if err == 0 {
+			break
+		}
+	}
+
+	return coeffs, errs
+}
+
+// quantizeLPC converts floating point coefficients to integers of the
+// given precision (in bits, including sign) and returns them with the
+// matching right shift. ok is false if the coefficients can't be
+// represented (e.g. all zero).
+func quantizeLPC(lpc []float64, precision int) (qcoeffs []int32, shift int, ok bool) {
+	var cmax float64
+	for _, c := range lpc {
+		if math.Abs(c) > cmax {
+			cmax = math.Abs(c)
+		}
+	}
+	if cmax <= 0 || math.IsInf(cmax, 0) || math.IsNaN(cmax) {
+		return nil, 0, false
+	}
+
+	maxCoeff := int64(1)<<(precision-1) - 1
+	minCoeff := -(int64(1) << (precision - 1))
+
+	// Largest shift that keeps the biggest coefficient within precision
+	_, log2cmax := math.Frexp(cmax)
+	shift = precision - 1 - log2cmax
+	if shift > maxQLPShift {
+		shift = maxQLPShift
+	}
+	if shift < minQLPShift {
+		return nil, 0, false
+	}
+
+	// Quantize with error feedback so rounding errors don't accumulate
+	qcoeffs = make([]int32, len(lpc))
+	var errAcc float64
+	for i, c := range lpc {
+		errAcc += c * float64(int64(1)<<shift)
+		q := int64(math.Round(errAcc))
+		if q > maxCoeff {
+			q = maxCoeff
+		} else if q < minCoeff {
+			q = minCoeff
+		}
+		errAcc -= float64(q)
+		qcoeffs[i] = int32(q)
+	}
+
+	return qcoeffs, shift, true
+}
+
+// computeLPCResiduals computes residuals for a quantized LPC predictor.
+// ok is false if a residual doesn't fit in 32 bits.
+func computeLPCResiduals(samples []int32, qcoeffs []int32, shift int) (residuals []int32, ok bool) {
+	order := len(qcoeffs)
+	residuals = make([]int32, len(samples)-order)
+
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range qcoeffs {
+			sum += int64(c) * int64(samples[i-j-1])
+		}
+		r := int64(samples[i]) - (sum >> shift)
+		if r > math.MaxInt32 || r < math.MinInt32 {
+			return nil, false
+		}
+		residuals[i-order] = int32(r)
+	}
+
+	return residuals, true
+}
+
+// defaultQLPPrecision picks the coefficient precision libFLAC uses for a
+// given block size
+func defaultQLPPrecision(blockSize int) int {
+	switch {
+	case blockSize <= 192:
+		return 7
+	case blockSize <= 384:
+		return 8
+	case blockSize <= 576:
+		return 9
+	case blockSize <= 1152:
+		return 10
+	case blockSize <= 2304:
+		return 11
+	case blockSize <= 4608:
+		return 12
+	default:
+		return 13
+	}
+}
+
+// qlpPrecision returns the coefficient precision to use for a subframe,
+// capped so that predictions fit a 32-bit accumulator in common decoders
+func (e *Encoder) qlpPrecision(blockSize, bps, order int) int {
+	precision := e.QLPCoeffPrecision
+	if precision <= 0 {
+		precision = defaultQLPPrecision(blockSize)
+	}
+	if precision > maxQLPCoeffPrecision {
+		precision = maxQLPCoeffPrecision
+	}
+
+	limit := 32 - bps - ilog2(order)
+	if precision > limit {
+		precision = limit
+	}
+	return precision
+}
+
+// guessLPCOrder predicts the cheapest LPC order from the Levinson-Durbin
+// prediction errors, as libFLAC does without exhaustive model search:
+// expected residual bits plus warmup and coefficient overhead per order
+func (e *Encoder) guessLPCOrder(errs []float64, blockSize, bps int) int {
+	errorScale := 0.5 / float64(blockSize)
+
+	bestOrder := 1
+	bestBits := math.Inf(1)
+	for i, lpcErr := range errs {
+		order := i + 1
+
+		var bitsPerSample float64
+		if lpcErr > 0 {
+			bitsPerSample = math.Max(0, 0.5*math.Log2(errorScale*lpcErr))
+		}
+		overhead := float64(order * (bps + e.qlpPrecision(blockSize, bps, order)))
+		bits := bitsPerSample*float64(blockSize-order) + overhead
+
+		if bits < bestBits {
+			bestBits = bits
+			bestOrder = order
+		}
+	}
+	return bestOrder
+}
+
+// findBestLPC returns the LPC candidate with the smallest estimated subframe
+// size. With ExhaustiveModelSearch every order up to the encoder's maximum
+// is encoded; otherwise only the order predicted by guessLPCOrder.
+func (e *Encoder) findBestLPC(samples []int32, bps int) (*lpcCandidate, int64) {
+	maxOrder := e.MaxLPCOrder
+	if maxOrder > maxLPCOrder {
+		maxOrder = maxLPCOrder
+	}
+	if maxOrder >= len(samples) {
+		maxOrder = len(samples) - 1
+	}
+	if maxOrder < 1 {
+		return nil, 0
+	}
+
+	windowed := tukeyWindow(samples, 0.5)
+	autoc := autocorrelation(windowed, maxOrder)
+	lpcs, errs := levinsonDurbin(autoc, maxOrder)
+
+	minOrder := 1
+	if !e.ExhaustiveModelSearch && len(lpcs) > 0 {
+		guess := e.guessLPCOrder(errs, len(samples), bps)
+		lpcs = lpcs[:guess]
+		minOrder = guess
+	}
+
+	var best *lpcCandidate
+	bestSize := int64(math.MaxInt64)
+
+	for i := minOrder - 1; i < len(lpcs); i++ {
+		lpc := lpcs[i]
+		order := i + 1
+		precision := e.qlpPrecision(len(samples), bps, order)
+		if precision < 2 {
+			continue
+		}
+
+		qcoeffs, shift, ok := quantizeLPC(lpc, precision)
+		if !ok {
+			continue
+		}
+		residuals, ok := computeLPCResiduals(samples, qcoeffs, shift)
+		if !ok {
+			continue
+		}
+
+		// Header + warmup + precision/shift fields + coefficients + residual
+		rice := planRice(residuals, order, e.MaxPartitionOrder)
+		size := int64(8+order*bps+4+5+order*precision) + rice.bits
+		if size < bestSize {
+			bestSize = size
+			best = &lpcCandidate{
+				order:     order,
+				precision: precision,
+				shift:     shift,
+				coeffs:    qcoeffs,
+				residuals: residuals,
+				rice:      rice,
+			}
+		}
+	}
+
+	return best, bestSize
+}
+
+// ilog2 returns floor(log2(v)) for v > 0
+func ilog2(v int) int {
+	n := 0
+	for v > 1 {
+		v >>= 1
+		n++
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package flacenc
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// multiTone returns a mono signal that FIXED predictors handle poorly
+func multiTone(n int) []int32 {
+	samples := make([]int32, n)
+	for i := range samples {
+		t := float64(i) / 44100
+		samples[i] = int32(8000*math.Sin(2*math.Pi*440*t) +
+			4000*math.Sin(2*math.Pi*1234*t) +
+			2000*math.Sin(2*math.Pi*3000*t))
+	}
+	return samples
+}
+
+func TestLevinsonDurbin_AR1(t *testing.T) {
+	// Autocorrelation of an AR(1) process x[n] = 0.9*x[n-1] + e[n]
+	autoc := []float64{1, 0.9, 0.81, 0.729}
+
+	coeffs, errs := levinsonDurbin(autoc, 3)
+	if len(coeffs) != 3 {
+		t.Fatalf("got %d orders, want 3", len(coeffs))
+	}
+	if math.Abs(coeffs[0][0]-0.9) > 1e-9 {
+		t.Errorf("order 1 coefficient = %f, want 0.9", coeffs[0][0])
+	}
+	// Higher orders shouldn't find anything beyond the first lag
+	for j, c := range coeffs[2] {
+		want := 0.0
+		if j == 0 {
+			want = 0.9
+		}
+		if math.Abs(c-want) > 1e-9 {
+			t.Errorf("order 3 coefficient[%d] = %f, want %f", j, c, want)
+		}
+	}
+	if math.Abs(errs[0]-0.19) > 1e-9 {
+		t.Errorf("order 1 error = %f, want 0.19", errs[0])
+	}
+}
+
+func TestQuantizeLPC(t *testing.T) {
+	lpc := []float64{1.8, -0.9}
+
+	qcoeffs, shift, ok := quantizeLPC(lpc, 12)
+	if !ok {
+		t.Fatal("quantizeLPC failed")
+	}
+	for i, c := range qcoeffs {
+		if c > 2047 || c < -2048 {
+			t.Errorf("coefficient %d = %d exceeds 12-bit range", i, c)
+		}
+		got := float64(c) / float64(int(1)<<shift)
+		if math.Abs(got-lpc[i]) > 1.0/float64(int(1)<<shift) {
+			t.Errorf("coefficient %d = %f, want ~%f", i, got, lpc[i])
+		}
+	}
+
+	if _, _, ok := quantizeLPC([]float64{0, 0}, 12); ok {
+		t.Error("all-zero coefficients should not quantize")
+	}
+}
+
+func TestEncoder_LPCRoundtrip(t *testing.T) {
+	samples := multiTone(44100)
+
+	sizes := map[int]int{}
+	for _, order := range []int{0, 8, 32} {
+		enc := NewEncoder(44100, 1, 16)
+		enc.MaxLPCOrder = order
+
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, samples); err != nil {
+			t.Fatalf("order %d: Encode error: %v", order, err)
+		}
+		_, decoded := decodeAll(t, buf.Bytes())
+		assertSamplesEqual(t, decoded, samples)
+		sizes[order] = buf.Len()
+	}
+
+	t.Logf("FIXED only: %d bytes, LPC 8: %d bytes, LPC 32: %d bytes", sizes[0], sizes[8], sizes[32])
+	if sizes[8] >= sizes[0] {
+		t.Errorf("LPC order 8 (%d bytes) should beat FIXED only (%d bytes)", sizes[8], sizes[0])
+	}
+}
+
+func TestEncoder_LPCPrecision(t *testing.T) {
+	samples := multiTone(8192)
+
+	for _, precision := range []int{4, 9, 15} {
+		enc := NewEncoder(44100, 1, 16)
+		enc.QLPCoeffPrecision = precision
+
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, samples); err != nil {
+			t.Fatalf("precision %d: Encode error: %v", precision, err)
+		}
+		_, decoded := decodeAll(t, buf.Bytes())
+		assertSamplesEqual(t, decoded, samples)
+	}
+}
+
+func TestEncoder_ShortBlock(t *testing.T) {
+	// A trailing block shorter than the predictor orders must still encode
+	samples := multiTone(4096 + 3)
+
+	var buf bytes.Buffer
+	if err := NewEncoder(44100, 1, 16).Encode(&buf, samples); err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
@@ -0,0 +1,237 @@
+package flacenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Metadata block types
+const (
+	blockStreamInfo    = 0
+	blockPadding       = 1
+	blockApplication   = 2
+	blockVorbisComment = 4
+	blockPicture       = 6
+)
+
+// maxMetadataLength is the largest body the 24-bit length field can declare
+const maxMetadataLength = 1<<24 - 1
+
+// DefaultVendor is the VORBIS_COMMENT vendor string AddTag starts with
+const DefaultVendor = "go-audio-converter flacenc"
+
+// VorbisComment is a VORBIS_COMMENT metadata block: a vendor string and a
+// list of NAME=value tags. Names are case-insensitive and may repeat
+// (e.g. several ARTIST tags).
+type VorbisComment struct {
+	Vendor string
+	Tags   [][2]string
+}
+
+// PictureType is the ID3v2 APIC picture type of a PICTURE block
+type PictureType uint32
+
+// Picture types
+const (
+	PictureOther PictureType = iota
+	PictureFileIcon
+	PictureOtherFileIcon
+	PictureFrontCover
+	PictureBackCover
+	PictureLeaflet
+	PictureMedia
+	PictureLeadArtist
+	PictureArtist
+	PictureConductor
+	PictureBand
+	PictureComposer
+	PictureLyricist
+	PictureRecordingLocation
+	PictureDuringRecording
+	PictureDuringPerformance
+	PictureScreenCapture
+	PictureFish
+	PictureIllustration
+	PictureBandLogo
+	PicturePublisherLogo
+)
+
+// Picture is a PICTURE metadata block, typically cover art. Width, Height,
+// Depth (bits per pixel) and Colors (palette size, 0 if not indexed) are
+// informational and may be left zero.
+type Picture struct {
+	Type        PictureType
+	MIME        string // e.g. "image/jpeg"; "-->" means Data is a URL
+	Description string
+	Width       uint32
+	Height      uint32
+	Depth       uint32
+	Colors      uint32
+	Data        []byte
+}
+
+// Application is an APPLICATION metadata block holding data for a
+// registered application ID
+type Application struct {
+	ID   [4]byte
+	Data []byte
+}
+
+// metadataBlock is an encoded metadata block body waiting to be written
+type metadataBlock struct {
+	blockType int
+	data      []byte
+}
+
+// AddTag appends a NAME=value tag to the VORBIS_COMMENT block, creating
+// the block with DefaultVendor if there is none yet
+func (e *Encoder) AddTag(name, value string) {
+	if e.VorbisComment == nil {
+		e.VorbisComment = &VorbisComment{Vendor: DefaultVendor}
+	}
+	e.VorbisComment.Tags = append(e.VorbisComment.Tags, [2]string{name, value})
+}
+
+// validate checks tag names against the Vorbis comment spec: printable
+// ASCII 0x20-0x7D, excluding '='
+func (vc *VorbisComment) validate() error {
+	for _, tag := range vc.Tags {
+		if tag[0] == "" {
+			return fmt.Errorf("empty vorbis comment name")
+		}
+		for _, c := range []byte(tag[0]) {
+			if c < 0x20 || c > 0x7D || c == '=' {
+				return fmt.Errorf("invalid vorbis comment name %q", tag[0])
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the fields the spec restricts
+func (p *Picture) validate() error {
+	if p.Type > PicturePublisherLogo {
+		return fmt.Errorf("invalid picture type %d", p.Type)
+	}
+	for _, c := range []byte(p.MIME) {
+		if c < 0x20 || c > 0x7E {
+			return fmt.Errorf("invalid picture MIME type %q", p.MIME)
+		}
+	}
+	return nil
+}
+
+// marshal encodes the block body: big-endian fields with length-prefixed
+// MIME type, description and data
+func (p *Picture) marshal() []byte {
+	var buf []byte
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.Type))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.MIME)))
+	buf = append(buf, p.MIME...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Description)))
+	buf = append(buf, p.Description...)
+	buf = binary.BigEndian.AppendUint32(buf, p.Width)
+	buf = binary.BigEndian.AppendUint32(buf, p.Height)
+	buf = binary.BigEndian.AppendUint32(buf, p.Depth)
+	buf = binary.BigEndian.AppendUint32(buf, p.Colors)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Data)))
+	return append(buf, p.Data...)
+}
+
+// marshal encodes the block body. Unlike the rest of FLAC, Vorbis comment
+// lengths are little-endian.
+func (vc *VorbisComment) marshal() []byte {
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vc.Vendor)))
+	buf = append(buf, vc.Vendor...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vc.Tags)))
+	for _, tag := range vc.Tags {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(tag[0])+1+len(tag[1])))
+		buf = append(buf, tag[0]...)
+		buf = append(buf, '=')
+		buf = append(buf, tag[1]...)
+	}
+	return buf
+}
+
+// metadataBlocks encodes the metadata blocks that follow STREAMINFO and
+// the SEEKTABLE, in the usual order: tags, pictures, application data and
+// finally padding
+func (e *Encoder) metadataBlocks() ([]metadataBlock, error) {
+	var blocks []metadataBlock
+
+	if e.SeekPointInterval < 0 {
+		return nil, fmt.Errorf("invalid seek point interval %d", e.SeekPointInterval)
+	}
+
+	if e.VorbisComment != nil {
+		if err := e.VorbisComment.validate(); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, metadataBlock{blockVorbisComment, e.VorbisComment.marshal()})
+	}
+
+	for i := range e.Pictures {
+		if err := e.Pictures[i].validate(); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, metadataBlock{blockPicture, e.Pictures[i].marshal()})
+	}
+
+	for _, app := range e.Applications {
+		data := append(app.ID[:], app.Data...)
+		blocks = append(blocks, metadataBlock{blockApplication, data})
+	}
+
+	if e.Padding < 0 {
+		return nil, fmt.Errorf("invalid padding size %d", e.Padding)
+	}
+	if e.Padding > 0 {
+		blocks = append(blocks, metadataBlock{blockPadding, make([]byte, e.Padding)})
+	}
+
+	for _, b := range blocks {
+		if len(b.data) > maxMetadataLength {
+			return nil, fmt.Errorf("metadata block type %d too large: %d bytes", b.blockType, len(b.data))
+		}
+	}
+	return blocks, nil
+}
+
+// writeMetadataHeader writes a block header: 1 bit last-metadata-block
+// flag + 7 bits type + 24 bits length
+func writeMetadataHeader(w io.Writer, blockType int, last bool, length int) error {
+	header := []byte{byte(blockType), byte(length >> 16), byte(length >> 8), byte(length)}
+	if last {
+		header[0] |= 0x80
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// writeMetadata writes STREAMINFO, the SEEKTABLE if there is one and then
+// blocks, flagging the final one as the last metadata block
+func (e *Encoder) writeMetadata(w io.Writer, blocks []metadataBlock) error {
+	if e.hasSeekTable() {
+		seekTable := metadataBlock{blockSeekTable, e.marshalSeekTable()}
+		if len(seekTable.data) > maxMetadataLength {
+			return fmt.Errorf("seek table too large: %d bytes", len(seekTable.data))
+		}
+		blocks = append([]metadataBlock{seekTable}, blocks...)
+	}
+
+	if err := e.writeStreamInfo(w, len(blocks) == 0); err != nil {
+		return err
+	}
+
+	for i, b := range blocks {
+		if err := writeMetadataHeader(w, b.blockType, i == len(blocks)-1, len(b.data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package flacenc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+// parseMetadata parses an encoded stream including all metadata blocks
+func parseMetadata(t *testing.T, data []byte) *flac.Stream {
+	t.Helper()
+	stream, err := flac.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("flac.Parse: %v", err)
+	}
+	return stream
+}
+
+func TestEncoder_VorbisComment(t *testing.T) {
+	samples := testSignal(5000, 2)
+
+	enc := NewEncoder(44100, 2, 16)
+	enc.AddTag("TITLE", "Test Tone")
+	enc.AddTag("ARTIST", "First")
+	enc.AddTag("ARTIST", "Second")
+	enc.AddTag("COMMENT", "key=value inside ✓")
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := parseMetadata(t, buf.Bytes())
+	if len(stream.Blocks) != 1 {
+		t.Fatalf("got %d metadata blocks after STREAMINFO, want 1", len(stream.Blocks))
+	}
+	block := stream.Blocks[0]
+	if !block.IsLast {
+		t.Error("VORBIS_COMMENT should be the last metadata block")
+	}
+	vc, ok := block.Body.(*meta.VorbisComment)
+	if !ok {
+		t.Fatalf("block body is %T, want *meta.VorbisComment", block.Body)
+	}
+	if vc.Vendor != DefaultVendor {
+		t.Errorf("Vendor = %q, want %q", vc.Vendor, DefaultVendor)
+	}
+	want := [][2]string{
+		{"TITLE", "Test Tone"},
+		{"ARTIST", "First"},
+		{"ARTIST", "Second"},
+		{"COMMENT", "key=value inside ✓"},
+	}
+	if !reflect.DeepEqual(vc.Tags, want) {
+		t.Errorf("Tags = %q, want %q", vc.Tags, want)
+	}
+
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestEncoder_NoMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewEncoder(44100, 1, 16).Encode(&buf, testSignal(1000, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// STREAMINFO header: last-block flag set, type 0, length 34
+	if got := buf.Bytes()[4:8]; !bytes.Equal(got, []byte{0x80, 0, 0, 34}) {
+		t.Errorf("STREAMINFO header = % x", got)
+	}
+}
+
+func TestEncoder_InvalidTagName(t *testing.T) {
+	for _, name := range []string{"", "A=B", "TAB\t", "~"} {
+		enc := NewEncoder(44100, 1, 16)
+		enc.AddTag(name, "x")
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, testSignal(100, 1)); err == nil {
+			t.Errorf("name %q: expected error", name)
+		}
+	}
+}
+
+func TestStreamEncoder_VorbisComment(t *testing.T) {
+	samples := testSignal(10000, 1)
+
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, 48000, 1, 16)
+	enc.VorbisComment = &VorbisComment{
+		Vendor: "custom vendor",
+		Tags:   [][2]string{{"ALBUM", "Streams"}},
+	}
+	writeInChunks(t, enc, samples, 1)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := parseMetadata(t, buf.Bytes())
+	if len(stream.Blocks) != 1 {
+		t.Fatalf("got %d metadata blocks after STREAMINFO, want 1", len(stream.Blocks))
+	}
+	vc := stream.Blocks[0].Body.(*meta.VorbisComment)
+	if vc.Vendor != "custom vendor" || len(vc.Tags) != 1 || vc.Tags[0] != [2]string{"ALBUM", "Streams"} {
+		t.Errorf("got %+v", vc)
+	}
+
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestEncoder_PictureApplicationPadding(t *testing.T) {
+	samples := testSignal(3000, 2)
+	cover := []byte("\x89PNG\r\n\x1a\nnot really a png")
+
+	enc := NewEncoder(44100, 2, 16)
+	enc.AddTag("TITLE", "Cover")
+	enc.Pictures = []Picture{{
+		Type:        PictureFrontCover,
+		MIME:        "image/png",
+		Description: "front",
+		Width:       600,
+		Height:      600,
+		Depth:       24,
+		Data:        cover,
+	}}
+	enc.Applications = []Application{{ID: [4]byte{'t', 'e', 's', 't'}, Data: []byte{1, 2, 3}}}
+	enc.Padding = 1024
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := parseMetadata(t, buf.Bytes())
+	wantTypes := []meta.Type{meta.TypeVorbisComment, meta.TypePicture, meta.TypeApplication, meta.TypePadding}
+	if len(stream.Blocks) != len(wantTypes) {
+		t.Fatalf("got %d metadata blocks after STREAMINFO, want %d", len(stream.Blocks), len(wantTypes))
+	}
+	for i, block := range stream.Blocks {
+		if block.Type != wantTypes[i] {
+			t.Errorf("block %d type = %v, want %v", i, block.Type, wantTypes[i])
+		}
+		if block.IsLast != (i == len(stream.Blocks)-1) {
+			t.Errorf("block %d IsLast = %v", i, block.IsLast)
+		}
+	}
+
+	pic := stream.Blocks[1].Body.(*meta.Picture)
+	if pic.Type != 3 || pic.MIME != "image/png" || pic.Desc != "front" ||
+		pic.Width != 600 || pic.Height != 600 || pic.Depth != 24 || !bytes.Equal(pic.Data, cover) {
+		t.Errorf("picture = %+v", pic)
+	}
+
+	app := stream.Blocks[2].Body.(*meta.Application)
+	if app.ID != 0x74657374 || !bytes.Equal(app.Data, []byte{1, 2, 3}) {
+		t.Errorf("application = %+v", app)
+	}
+
+	if stream.Blocks[3].Length != 1024 {
+		t.Errorf("padding length = %d, want 1024", stream.Blocks[3].Length)
+	}
+
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestEncoder_InvalidMetadata(t *testing.T) {
+	tests := map[string]func(*Encoder){
+		"picture type": func(e *Encoder) { e.Pictures = []Picture{{Type: 21}} },
+		"picture MIME": func(e *Encoder) { e.Pictures = []Picture{{MIME: "image/\n"}} },
+		"padding":      func(e *Encoder) { e.Padding = -1 },
+		"oversized":    func(e *Encoder) { e.Padding = 1 << 24 },
+	}
+	for name, setup := range tests {
+		enc := NewEncoder(44100, 1, 16)
+		setup(enc)
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, testSignal(100, 1)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
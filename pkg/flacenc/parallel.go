@@ -0,0 +1,115 @@
+package flacenc
+
+import (
+	"io"
+	"runtime"
+)
+
+// blockResult holds the frames of an encoded block waiting to be written
+// in order
+type blockResult struct {
+	frames []encodedFrame
+	err    error
+}
+
+// workers returns the number of frames to encode in parallel
+func (e *Encoder) workers() int {
+	if e.Concurrency > 0 {
+		return e.Concurrency
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// encodeBlocks splits interleaved samples into BlockSize blocks (the last
+// one may be short), encodes them as blocks numbered from firstBlock and
+// writes the frames to w in order. Blocks are encoded by a pool of
+// workers; the STREAMINFO statistics are updated by the caller's goroutine
+// as frames are written, so they don't depend on scheduling. It returns the
+// number of blocks written.
+func (e *Encoder) encodeBlocks(w io.Writer, samples []int32, firstBlock uint64) (int, error) {
+	blockLen := e.BlockSize * e.Channels
+	numBlocks := (len(samples) + blockLen - 1) / blockLen
+
+	block := func(i int) []int32 {
+		end := min((i+1)*blockLen, len(samples))
+		return samples[i*blockLen : end]
+	}
+
+	workers := min(e.workers(), numBlocks)
+	if workers <= 1 {
+		for i := 0; i < numBlocks; i++ {
+			frames, err := e.encodeBlock(block(i), firstBlock+uint64(i))
+			if err != nil {
+				return i, err
+			}
+			if err := e.writeFrames(w, frames); err != nil {
+				return i, err
+			}
+		}
+		return numBlocks, nil
+	}
+
+	type job struct {
+		index  int
+		result chan blockResult
+	}
+
+	jobs := make(chan job)
+	// Result channels in block order; the buffer bounds how far encoding
+	// can run ahead of writing
+	queue := make(chan chan blockResult, workers*2)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(jobs)
+		defer close(queue)
+		for i := 0; i < numBlocks; i++ {
+			result := make(chan blockResult, 1)
+			select {
+			case queue <- result:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- job{i, result}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			for j := range jobs {
+				frames, err := e.encodeBlock(block(j.index), firstBlock+uint64(j.index))
+				j.result <- blockResult{frames, err}
+			}
+		}()
+	}
+
+	written := 0
+	for result := range queue {
+		r := <-result
+		if r.err != nil {
+			return written, r.err
+		}
+		if err := e.writeFrames(w, r.frames); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+// writeFrames writes encoded frames and records their statistics
+func (e *Encoder) writeFrames(w io.Writer, frames []encodedFrame) error {
+	for _, f := range frames {
+		if _, err := w.Write(f.data); err != nil {
+			return err
+		}
+		e.recordFrame(len(f.data), f.blockSize)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package flacenc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncoder_ConcurrencyDeterministic(t *testing.T) {
+	samples := testSignal(100000, 2)
+
+	var want bytes.Buffer
+	enc := NewEncoder(44100, 2, 16)
+	enc.Concurrency = 1
+	if err := enc.Encode(&want, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{0, 2, 3, 8, 64} {
+		var got bytes.Buffer
+		enc := NewEncoder(44100, 2, 16)
+		enc.Concurrency = workers
+		if err := enc.Encode(&got, samples); err != nil {
+			t.Fatalf("Concurrency %d: %v", workers, err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("Concurrency %d: output differs from sequential encoding", workers)
+		}
+	}
+
+	_, decoded := decodeAll(t, want.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestStreamEncoder_Concurrency(t *testing.T) {
+	samples := testSignal(60000, 2)
+
+	var want bytes.Buffer
+	if err := NewEncoder(44100, 2, 16).Encode(&want, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		path := filepath.Join(t.TempDir(), "out.flac")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := NewStreamEncoder(f, 44100, 2, 16)
+		enc.Concurrency = workers
+		writeInChunks(t, enc, samples, 2)
+		if err := enc.Close(); err != nil {
+			t.Fatalf("Close error: %v", err)
+		}
+		f.Close()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want.Bytes()) {
+			t.Errorf("Concurrency %d: stream output differs from Encode output", workers)
+		}
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, os.ErrClosed
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestEncoder_ConcurrencyWriteError(t *testing.T) {
+	samples := testSignal(100000, 2)
+
+	enc := NewEncoder(44100, 2, 16)
+	enc.Concurrency = 4
+	if _, err := enc.encodeBlocks(&failingWriter{n: 3}, samples, 0); err == nil {
+		t.Error("expected write error")
+	}
+}
@@ -0,0 +1,146 @@
+package flacenc
+
+import (
+	"math/bits"
+)
+
+const (
+	// Residual coding methods
+	riceMethod  = 0 // 4-bit Rice parameters
+	rice2Method = 1 // 5-bit Rice parameters
+
+	// maxRicePartitionOrder is the largest partition order the 4-bit field allows
+	maxRicePartitionOrder = 15
+
+	// Largest usable parameter per method; the all-ones value is the escape code
+	maxRiceParam  = 14
+	maxRice2Param = 30
+
+	// maxEscapeBits is the largest raw sample size an escaped partition can declare
+	maxEscapeBits = 31
+)
+
+// riceCoding describes how a residual signal is partitioned and coded
+type riceCoding struct {
+	method int
+	order  int   // partition order: 2^order partitions
+	params []int // Rice parameter per partition
+	escape []int // raw bits per residual for escaped partitions, 0 if Rice coded
+	bits   int64 // estimated size, including method and order fields
+}
+
+// zigzag maps a signed residual to the unsigned value that gets Rice coded
+func zigzag(r int32) uint32 {
+	return uint32(r<<1) ^ uint32(r>>31)
+}
+
+// partitionSamples returns how many residuals partition p holds
+func partitionSamples(blockSize, predictorOrder, partOrder, p int) int {
+	n := blockSize >> partOrder
+	if p == 0 {
+		n -= predictorOrder
+	}
+	return n
+}
+
+// planRice finds the partition order, coding method and per-partition
+// parameters that minimize the coded size of residuals. Partitions whose
+// values are too spread out for Rice coding are escaped and stored raw.
+func planRice(residuals []int32, predictorOrder, maxPartOrder int) *riceCoding {
+	blockSize := len(residuals) + predictorOrder
+
+	// Partitions must divide the block evenly, and the first one must
+	// have room for the warmup samples
+	if maxPartOrder > maxRicePartitionOrder {
+		maxPartOrder = maxRicePartitionOrder
+	}
+	for maxPartOrder > 0 && (blockSize%(1<<maxPartOrder) != 0 || blockSize>>maxPartOrder <= predictorOrder) {
+		maxPartOrder--
+	}
+	if maxPartOrder < 0 {
+		maxPartOrder = 0
+	}
+
+	// Sum and max of the zigzagged residuals per finest partition; coarser
+	// orders are derived by merging neighbours
+	parts := 1 << maxPartOrder
+	sums := make([]uint64, parts)
+	maxes := make([]uint32, parts)
+	idx := 0
+	for p := 0; p < parts; p++ {
+		for j := partitionSamples(blockSize, predictorOrder, maxPartOrder, p); j > 0; j-- {
+			u := zigzag(residuals[idx])
+			sums[p] += uint64(u)
+			if u > maxes[p] {
+				maxes[p] = u
+			}
+			idx++
+		}
+	}
+
+	var best *riceCoding
+	for order := maxPartOrder; order >= 0; order-- {
+		for _, method := range []int{riceMethod, rice2Method} {
+			rc := evaluateRice(sums, maxes, blockSize, predictorOrder, order, method)
+			if best == nil || rc.bits < best.bits {
+				best = rc
+			}
+		}
+
+		if order > 0 {
+			for p := 0; p < len(sums)/2; p++ {
+				sums[p] = sums[2*p] + sums[2*p+1]
+				maxes[p] = max(maxes[2*p], maxes[2*p+1])
+			}
+			sums = sums[:len(sums)/2]
+			maxes = maxes[:len(maxes)/2]
+		}
+	}
+
+	return best
+}
+
+// evaluateRice picks the best parameter for every partition at one
+// partition order and coding method
+func evaluateRice(sums []uint64, maxes []uint32, blockSize, predictorOrder, order, method int) *riceCoding {
+	paramBits, maxParam := 4, maxRiceParam
+	if method == rice2Method {
+		paramBits, maxParam = 5, maxRice2Param
+	}
+
+	rc := &riceCoding{
+		method: method,
+		order:  order,
+		params: make([]int, len(sums)),
+		escape: make([]int, len(sums)),
+		bits:   2 + 4,
+	}
+
+	for p := range sums {
+		n := int64(partitionSamples(blockSize, predictorOrder, order, p))
+
+		// Rice cost is n*(k+1) unary/stop/remainder bits plus the quotients,
+		// approximated by sum>>k
+		bestK, bestCost := 0, int64(-1)
+		for k := 0; k <= maxParam; k++ {
+			cost := n*int64(k+1) + int64(sums[p]>>k)
+			if bestCost < 0 || cost < bestCost {
+				bestK, bestCost = k, cost
+			}
+		}
+		rc.params[p] = bestK
+
+		// An escaped partition stores each residual in raw two's complement
+		rawBits := max(bits.Len32(maxes[p]), 1)
+		if rawBits <= maxEscapeBits {
+			if escCost := 5 + n*int64(rawBits); escCost < bestCost {
+				rc.escape[p] = rawBits
+				bestCost = escCost
+			}
+		}
+
+		rc.bits += int64(paramBits) + bestCost
+	}
+
+	return rc
+}
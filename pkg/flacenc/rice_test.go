@@ -0,0 +1,147 @@
+package flacenc
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestZigzag(t *testing.T) {
+	tests := []struct {
+		in   int32
+		want uint32
+	}{
+		{0, 0}, {-1, 1}, {1, 2}, {-2, 3}, {2, 4},
+		{-2147483648, 4294967295},
+	}
+	for _, tt := range tests {
+		if got := zigzag(tt.in); got != tt.want {
+			t.Errorf("zigzag(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPlanRice_PartitionsNonStationary(t *testing.T) {
+	// Quiet first half, loud second half: one parameter can't fit both
+	residuals := make([]int32, 4096)
+	rng := rand.New(rand.NewSource(1))
+	for i := range residuals {
+		amp := int32(4)
+		if i >= 2048 {
+			amp = 4000
+		}
+		residuals[i] = rng.Int31n(2*amp) - amp
+	}
+
+	rc := planRice(residuals, 0, 8)
+	if rc.order == 0 {
+		t.Error("expected a partition order > 0 for non-stationary residuals")
+	}
+	if single := planRice(residuals, 0, 0); single.bits <= rc.bits {
+		t.Errorf("partitioned (%d bits) should beat single partition (%d bits)", rc.bits, single.bits)
+	}
+}
+
+func TestPlanRice_PartitionConstraints(t *testing.T) {
+	// 4000 = 2^5 * 125: partition order is limited to 5
+	rc := planRice(make([]int32, 4000-2), 2, 15)
+	if rc.order > 5 {
+		t.Errorf("partition order %d does not divide block size 4000", rc.order)
+	}
+
+	// First partition must be longer than the predictor order
+	rc = planRice(make([]int32, 64-32), 32, 15)
+	if rc.order > 0 && 64>>rc.order <= 32 {
+		t.Errorf("partition order %d leaves no room for 32 warmup samples", rc.order)
+	}
+}
+
+func TestPlanRice_Rice2ForWideResiduals(t *testing.T) {
+	// 24-bit content: residuals need parameters above 14
+	residuals := make([]int32, 1024)
+	rng := rand.New(rand.NewSource(2))
+	for i := range residuals {
+		residuals[i] = int32(rng.NormFloat64() * (1 << 20))
+	}
+
+	rc := planRice(residuals, 0, 0)
+	if rc.method != rice2Method && rc.escape[0] == 0 {
+		t.Errorf("method = %d, want RICE2 or escape for 24-bit residuals", rc.method)
+	}
+}
+
+func TestPlanRice_EscapesUniformNoise(t *testing.T) {
+	// Uniform full-range noise is cheaper stored raw than Rice coded
+	residuals := make([]int32, 1024)
+	rng := rand.New(rand.NewSource(3))
+	for i := range residuals {
+		residuals[i] = rng.Int31n(1<<16) - 1<<15
+	}
+
+	rc := planRice(residuals, 0, 0)
+	if rc.escape[0] == 0 {
+		t.Error("expected an escaped partition for uniform noise")
+	}
+	if rc.escape[0] != 16 {
+		t.Errorf("escape bits = %d, want 16", rc.escape[0])
+	}
+}
+
+func TestEncodeResidual_SizeMatchesEstimate(t *testing.T) {
+	residuals := make([]int32, 4096)
+	rng := rand.New(rand.NewSource(4))
+	for i := range residuals {
+		residuals[i] = int32(rng.NormFloat64() * float64(1+i/64))
+	}
+
+	rc := planRice(residuals, 0, 8)
+
+	var buf bytes.Buffer
+	bw := NewBitWriter(&buf)
+	if err := encodeResidual(bw, residuals, 0, rc); err != nil {
+		t.Fatal(err)
+	}
+	actual := bw.BytesWritten()*8 + int64(bw.bits)
+
+	// sum>>k over-estimates the quotients by less than one bit per residual
+	if actual > rc.bits || rc.bits-actual > int64(len(residuals)) {
+		t.Errorf("estimated %d bits, wrote %d", rc.bits, actual)
+	}
+}
+
+func TestEncoder_RiceRoundtrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+
+	tests := []struct {
+		name string
+		bps  int
+		gen  func(i int) int32
+	}{
+		{"noise burst", 16, func(i int) int32 {
+			if i > 3000 && i < 3500 {
+				return rng.Int31n(65536) - 32768
+			}
+			return int32(1000 * sin(float64(i)*0.05))
+		}},
+		{"24-bit", 24, func(i int) int32 {
+			return int32(4000000*sin(float64(i)*0.02)) + rng.Int31n(1<<12)
+		}},
+		{"24-bit noise", 24, func(i int) int32 { return rng.Int31n(1<<24) - 1<<23 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := make([]int32, 10000)
+			for i := range samples {
+				samples[i] = tt.gen(i)
+			}
+
+			var buf bytes.Buffer
+			if err := NewEncoder(48000, 1, tt.bps).Encode(&buf, samples); err != nil {
+				t.Fatalf("Encode error: %v", err)
+			}
+			_, decoded := decodeAll(t, buf.Bytes())
+			assertSamplesEqual(t, decoded, samples)
+		})
+	}
+}
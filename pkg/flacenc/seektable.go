@@ -0,0 +1,96 @@
+package flacenc
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	blockSeekTable = 3
+
+	// seekPointSize is the encoded size of one seek point
+	seekPointSize = 18
+
+	// seekTableOffset is the position of the SEEKTABLE body relative to the
+	// start of the stream; it directly follows STREAMINFO
+	seekTableOffset = streamInfoOffset + 34 + 4
+
+	// placeholderSample marks an unused seek point
+	placeholderSample = 0xFFFFFFFFFFFFFFFF
+
+	// DefaultStreamSeekPoints is how many seek points a StreamEncoder
+	// reserves when SeekPoints is zero
+	DefaultStreamSeekPoints = 1000
+)
+
+// seekPoint points at the first sample of a frame
+type seekPoint struct {
+	sample  uint64 // first sample in the frame
+	offset  uint64 // byte offset of the frame from the first frame header
+	samples uint16 // samples in the frame
+}
+
+// SetSeekInterval sets SeekPointInterval to the number of samples in d
+// at the encoder's sample rate
+func (e *Encoder) SetSeekInterval(d time.Duration) {
+	e.SeekPointInterval = int(d.Seconds() * float64(e.SampleRate))
+	if d > 0 && e.SeekPointInterval == 0 {
+		e.SeekPointInterval = 1
+	}
+}
+
+// recordSeekPoint adds a seek point if the frame starting at sample
+// first covers the next seek target. When seekLimit is set and the table
+// overflows, every other point is dropped and the interval doubled, so
+// the points keep spanning the whole stream.
+func (e *Encoder) recordSeekPoint(first uint64, blockSize int) {
+	if e.seekInterval <= 0 {
+		return
+	}
+	end := first + uint64(blockSize)
+	if e.nextSeekSample >= end {
+		return
+	}
+
+	e.seekPoints = append(e.seekPoints, seekPoint{
+		sample:  first,
+		offset:  e.frameBytes,
+		samples: uint16(blockSize),
+	})
+
+	if e.seekLimit > 0 && len(e.seekPoints) > e.seekLimit {
+		kept := e.seekPoints[:0]
+		for i := 0; i < len(e.seekPoints); i += 2 {
+			kept = append(kept, e.seekPoints[i])
+		}
+		e.seekPoints = kept
+		e.seekInterval *= 2
+	}
+
+	interval := uint64(e.seekInterval)
+	e.nextSeekSample = (end + interval - 1) / interval * interval
+}
+
+// hasSeekTable reports whether a SEEKTABLE is written: either points were
+// collected (buffered encoding) or space is reserved for them (streaming)
+func (e *Encoder) hasSeekTable() bool {
+	return e.SeekPointInterval > 0 && (len(e.seekPoints) > 0 || e.seekLimit > 0)
+}
+
+// marshalSeekTable encodes the seek points, padded with placeholders up
+// to seekLimit
+func (e *Encoder) marshalSeekTable() []byte {
+	n := max(len(e.seekPoints), e.seekLimit)
+	buf := make([]byte, 0, n*seekPointSize)
+	for _, p := range e.seekPoints {
+		buf = binary.BigEndian.AppendUint64(buf, p.sample)
+		buf = binary.BigEndian.AppendUint64(buf, p.offset)
+		buf = binary.BigEndian.AppendUint16(buf, p.samples)
+	}
+	for i := len(e.seekPoints); i < n; i++ {
+		buf = binary.BigEndian.AppendUint64(buf, placeholderSample)
+		buf = binary.BigEndian.AppendUint64(buf, 0)
+		buf = binary.BigEndian.AppendUint16(buf, 0)
+	}
+	return buf
+}
@@ -0,0 +1,162 @@
+package flacenc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// firstFrameOffset walks the metadata block headers to find the first frame
+func firstFrameOffset(data []byte) int {
+	pos := 4
+	for {
+		header := data[pos]
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4 + length
+		if header&0x80 != 0 {
+			return pos
+		}
+	}
+}
+
+// checkSeekTable verifies that every seek point addresses the frame it
+// claims to, and returns the table. Frames are numbered, so their first
+// sample is the frame number times the (fixed) block size.
+func checkSeekTable(t *testing.T, data []byte, blockSize uint64) *meta.SeekTable {
+	t.Helper()
+
+	stream := parseMetadata(t, data)
+	if len(stream.Blocks) == 0 || stream.Blocks[0].Type != meta.TypeSeekTable {
+		t.Fatal("SEEKTABLE should directly follow STREAMINFO")
+	}
+	table := stream.Blocks[0].Body.(*meta.SeekTable)
+
+	start := firstFrameOffset(data)
+	for i, p := range table.Points {
+		if p.SampleNum == placeholderSample {
+			continue
+		}
+		f, err := frame.New(bytes.NewReader(data[start+int(p.Offset):]))
+		if err != nil {
+			t.Fatalf("point %d: parse frame at offset %d: %v", i, p.Offset, err)
+		}
+		if f.Num*blockSize != p.SampleNum || f.BlockSize != p.NSamples {
+			t.Errorf("point %d = %+v, frame starts at sample %d with %d samples",
+				i, p, f.Num*blockSize, f.BlockSize)
+		}
+	}
+	return table
+}
+
+func TestEncoder_SeekTable(t *testing.T) {
+	samples := testSignal(44100*3+1000, 2)
+
+	enc := NewEncoder(44100, 2, 16)
+	enc.SetSeekInterval(time.Second)
+	enc.AddTag("TITLE", "seek")
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	table := checkSeekTable(t, buf.Bytes(), 4096)
+	// Frames containing samples 0, 44100, 88200 and 132300
+	want := []uint64{0, 40960, 86016, 131072}
+	if len(table.Points) != len(want) {
+		t.Fatalf("got %d seek points, want %d", len(table.Points), len(want))
+	}
+	for i, p := range table.Points {
+		if p.SampleNum != want[i] {
+			t.Errorf("point %d sample = %d, want %d", i, p.SampleNum, want[i])
+		}
+	}
+
+	_, decoded := decodeAll(t, buf.Bytes())
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestEncoder_SeekTableEveryFrame(t *testing.T) {
+	samples := testSignal(20000, 1)
+
+	enc := NewEncoder(44100, 1, 16)
+	enc.SeekPointInterval = 1000
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	// Intervals shorter than a block give one point per frame, no duplicates
+	table := checkSeekTable(t, buf.Bytes(), 4096)
+	if len(table.Points) != 5 {
+		t.Errorf("got %d seek points, want 5", len(table.Points))
+	}
+}
+
+func TestStreamEncoder_SeekTable(t *testing.T) {
+	samples := testSignal(100000, 2)
+
+	path := filepath.Join(t.TempDir(), "out.flac")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewStreamEncoder(f, 44100, 2, 16)
+	enc.SeekPointInterval = 4096
+	enc.SeekPoints = 8
+	writeInChunks(t, enc, samples, 2)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 25 frames overflow 8 points, so the table is thinned to every 4th frame
+	table := checkSeekTable(t, data, 4096)
+	if len(table.Points) != 8 {
+		t.Fatalf("got %d seek points, want 8 reserved", len(table.Points))
+	}
+	var used int
+	for i, p := range table.Points {
+		if p.SampleNum == placeholderSample {
+			continue
+		}
+		if want := uint64(i) * 4 * 4096; p.SampleNum != want {
+			t.Errorf("point %d sample = %d, want %d", i, p.SampleNum, want)
+		}
+		used++
+	}
+	if used != 7 {
+		t.Errorf("got %d used seek points, want 7", used)
+	}
+
+	_, decoded := decodeAll(t, data)
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestStreamEncoder_SeekTableNonSeekable(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, 44100, 1, 16)
+	enc.SeekPointInterval = 4096
+	if err := enc.Write(testSignal(10000, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without seeking there's no way to fill the table in, so it's omitted
+	if stream := parseMetadata(t, buf.Bytes()); len(stream.Blocks) != 0 {
+		t.Errorf("got %d metadata blocks after STREAMINFO, want 0", len(stream.Blocks))
+	}
+}
@@ -0,0 +1,62 @@
+package flacenc
+
+// Channel assignments for stereo frames. Values below 8 are the number of
+// independent channels minus one.
+const (
+	channelLeftSide  = 8
+	channelRightSide = 9
+	channelMidSide   = 10
+)
+
+// planChannels picks the channel assignment for a frame and plans its
+// subframes. Stereo frames try left/side, right/side and mid/side in
+// addition to independent channels and keep the smallest.
+func (e *Encoder) planChannels(block [][]int32) (int, []*subframePlan) {
+	bps := e.BitsPerSample
+
+	subframes := make([]*subframePlan, len(block))
+	for ch := range block {
+		subframes[ch] = e.analyzeSubframe(block[ch], bps)
+	}
+
+	// The side channel needs one extra bit, which wouldn't fit in int32
+	if !e.StereoDecorrelation || len(block) != 2 || bps >= 32 {
+		return len(block) - 1, subframes
+	}
+
+	left, right := subframes[0], subframes[1]
+	mid, side := midSide(block[0], block[1])
+	midPlan := e.analyzeSubframe(mid, bps)
+	sidePlan := e.analyzeSubframe(side, bps+1)
+
+	candidates := []struct {
+		code int
+		a, b *subframePlan
+	}{
+		{1, left, right},
+		{channelLeftSide, left, sidePlan},
+		{channelRightSide, sidePlan, right},
+		{channelMidSide, midPlan, sidePlan},
+	}
+
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.a.bits+c.b.bits < best.a.bits+best.b.bits {
+			best = c
+		}
+	}
+
+	return best.code, []*subframePlan{best.a, best.b}
+}
+
+// midSide computes mid = (L+R)>>1 and side = L-R. The bit dropped from mid
+// is recovered by the decoder from the side channel's LSB.
+func midSide(left, right []int32) (mid, side []int32) {
+	mid = make([]int32, len(left))
+	side = make([]int32, len(left))
+	for i := range left {
+		mid[i] = (left[i] + right[i]) >> 1
+		side[i] = left[i] - right[i]
+	}
+	return mid, side
+}
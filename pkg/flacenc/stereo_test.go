@@ -0,0 +1,96 @@
+package flacenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+)
+
+func TestMidSide(t *testing.T) {
+	mid, side := midSide([]int32{10, -3, 7}, []int32{4, 2, 7})
+
+	wantMid := []int32{7, -1, 7}
+	wantSide := []int32{6, -5, 0}
+	for i := range wantMid {
+		if mid[i] != wantMid[i] || side[i] != wantSide[i] {
+			t.Errorf("[%d] mid/side = %d/%d, want %d/%d", i, mid[i], side[i], wantMid[i], wantSide[i])
+		}
+	}
+}
+
+// stereoSignal builds interleaved stereo from a left channel and a
+// function deriving the right channel
+func stereoSignal(left []int32, right func(i int, l int32) int32) []int32 {
+	samples := make([]int32, len(left)*2)
+	for i, l := range left {
+		samples[i*2] = l
+		samples[i*2+1] = right(i, l)
+	}
+	return samples
+}
+
+func TestEncoder_StereoDecorrelation(t *testing.T) {
+	left := multiTone(20000)
+
+	tests := []struct {
+		name  string
+		right func(i int, l int32) int32
+	}{
+		{"identical", func(i int, l int32) int32 { return l }},
+		{"near-mono", func(i int, l int32) int32 { return l + int32(i%3) - 1 }},
+		{"inverted", func(i int, l int32) int32 { return -l }},
+		{"independent", func(i int, l int32) int32 { return int32(i*7919%20000) - 10000 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := stereoSignal(left, tt.right)
+
+			var buf bytes.Buffer
+			if err := NewEncoder(44100, 2, 16).Encode(&buf, samples); err != nil {
+				t.Fatalf("Encode error: %v", err)
+			}
+			_, decoded := decodeAll(t, buf.Bytes())
+			assertSamplesEqual(t, decoded, samples)
+		})
+	}
+}
+
+func TestEncoder_StereoPicksSideChannel(t *testing.T) {
+	left := multiTone(8192)
+	samples := stereoSignal(left, func(i int, l int32) int32 { return l + int32(i%3) - 1 })
+
+	var buf bytes.Buffer
+	if err := NewEncoder(44100, 2, 16).Encode(&buf, samples); err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+
+	stream, err := flac.New(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := stream.ParseNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Channels == frame.ChannelsLR {
+		t.Error("near-mono stereo should not be coded as independent channels")
+	}
+
+	// Compare against coding each channel separately as two mono streams
+	monoSize := 0
+	for ch := 0; ch < 2; ch++ {
+		mono := make([]int32, len(left))
+		for i := range mono {
+			mono[i] = samples[i*2+ch]
+		}
+		var m bytes.Buffer
+		NewEncoder(44100, 1, 16).Encode(&m, mono)
+		monoSize += m.Len()
+	}
+	if buf.Len() >= monoSize {
+		t.Errorf("decorrelated stereo (%d bytes) should beat independent channels (%d bytes)", buf.Len(), monoSize)
+	}
+}
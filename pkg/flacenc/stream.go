@@ -0,0 +1,181 @@
+package flacenc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// streamInfoOffset is the position of the STREAMINFO body relative to the
+// start of the stream: "fLaC" magic + 4-byte metadata block header
+const streamInfoOffset = 8
+
+// StreamEncoder encodes FLAC incrementally. Frames are written as soon as
+// a block fills, so memory use doesn't grow with the stream length.
+//
+// STREAMINFO is written before the first frame. If the underlying writer
+// implements io.WriteSeeker, Close seeks back and fills in the total sample
+// count, min/max frame size and MD5 signature; otherwise those fields are
+// left zeroed, which the FLAC spec defines as "unknown".
+//
+// Encoder settings (Level, BlockSize, VorbisComment, ...) may be changed
+// until the first Write.
+type StreamEncoder struct {
+	*Encoder
+
+	// SeekPoints is the number of seek points reserved in the SEEKTABLE
+	// when SeekPointInterval is set (0 = DefaultStreamSeekPoints). Long
+	// streams thin out the points to fit. The table is only written to
+	// seekable outputs, since it's filled in by Close.
+	SeekPoints int
+
+	w        io.Writer
+	start    int64
+	seekable bool
+	started  bool
+	closed   bool
+	md5h     hash.Hash
+	pending  []int32
+	blockNum uint64
+}
+
+// NewStreamEncoder creates a streaming FLAC encoder writing to w
+func NewStreamEncoder(w io.Writer, sampleRate, channels, bitsPerSample int) *StreamEncoder {
+	return &StreamEncoder{
+		Encoder: NewEncoder(sampleRate, channels, bitsPerSample),
+		w:       w,
+		md5h:    md5.New(),
+	}
+}
+
+// Write encodes interleaved samples. Samples are buffered until there is a
+// full block for every worker (see Concurrency); the rest is kept until the
+// next Write or Close.
+func (s *StreamEncoder) Write(samples []int32) error {
+	if s.closed {
+		return fmt.Errorf("write to closed encoder")
+	}
+	if len(samples)%s.Channels != 0 {
+		return fmt.Errorf("%d samples is not a multiple of %d channels", len(samples), s.Channels)
+	}
+	if !s.started {
+		if err := s.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	s.hashSamples(s.md5h, samples)
+	s.pending = append(s.pending, samples...)
+
+	// Wait for enough blocks to keep every worker busy
+	blockLen := s.BlockSize * s.Channels
+	if len(s.pending) < s.workers()*blockLen {
+		return nil
+	}
+
+	n := len(s.pending) / blockLen * blockLen
+	blocks, err := s.encodeBlocks(s.w, s.pending[:n], s.blockNum)
+	if err != nil {
+		return err
+	}
+	s.blockNum += uint64(blocks)
+	s.pending = s.pending[:copy(s.pending, s.pending[n:])]
+
+	return nil
+}
+
+// Close encodes any buffered samples as the final (short) block and, when
+// the writer is seekable, back-patches STREAMINFO and the SEEKTABLE. It
+// does not close the underlying writer.
+func (s *StreamEncoder) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if !s.started {
+		if err := s.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.pending) > 0 {
+		blocks, err := s.encodeBlocks(s.w, s.pending, s.blockNum)
+		if err != nil {
+			return err
+		}
+		s.blockNum += uint64(blocks)
+		s.pending = nil
+	}
+
+	if !s.seekable {
+		return nil
+	}
+
+	copy(s.md5sum[:], s.md5h.Sum(nil))
+
+	var info bytes.Buffer
+	if err := s.writeStreamInfoBody(&info); err != nil {
+		return err
+	}
+
+	ws := s.w.(io.WriteSeeker)
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := s.patch(ws, streamInfoOffset, info.Bytes()); err != nil {
+		return err
+	}
+	if s.hasSeekTable() {
+		if err := s.patch(ws, seekTableOffset, s.marshalSeekTable()); err != nil {
+			return err
+		}
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
+
+// patch overwrites data at offset from the start of the stream
+func (s *StreamEncoder) patch(ws io.WriteSeeker, offset int64, data []byte) error {
+	if _, err := ws.Seek(s.start+offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := ws.Write(data)
+	return err
+}
+
+// writeHeader writes the magic number, a STREAMINFO block whose
+// stream-dependent fields are still unknown and the other metadata blocks
+func (s *StreamEncoder) writeHeader() error {
+	if err := s.applyLevel(); err != nil {
+		return err
+	}
+	blocks, err := s.metadataBlocks()
+	if err != nil {
+		return err
+	}
+	s.started = true
+	s.reset()
+
+	if ws, ok := s.w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			s.start = pos
+			s.seekable = true
+		}
+	}
+
+	if s.seekable && s.SeekPointInterval > 0 {
+		s.seekLimit = s.SeekPoints
+		if s.seekLimit <= 0 {
+			s.seekLimit = DefaultStreamSeekPoints
+		}
+	}
+
+	if _, err := s.w.Write([]byte("fLaC")); err != nil {
+		return err
+	}
+	return s.writeMetadata(s.w, blocks)
+}
@@ -0,0 +1,115 @@
+package flacenc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSignal(frames, channels int) []int32 {
+	samples := make([]int32, frames*channels)
+	for i := range samples {
+		samples[i] = int32(12000*sin(float64(i/channels)*0.03)) + int32(i%5)
+	}
+	return samples
+}
+
+// writeInChunks feeds samples to the encoder in uneven pieces so blocks
+// straddle Write calls
+func writeInChunks(t *testing.T, enc *StreamEncoder, samples []int32, channels int) {
+	t.Helper()
+	sizes := []int{1, 1000, 4095, 4097, 7}
+	for i := 0; len(samples) > 0; i++ {
+		n := sizes[i%len(sizes)] * channels
+		if n > len(samples) {
+			n = len(samples)
+		}
+		if err := enc.Write(samples[:n]); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		samples = samples[n:]
+	}
+}
+
+func TestStreamEncoder_Seekable(t *testing.T) {
+	samples := testSignal(20000, 2)
+
+	path := filepath.Join(t.TempDir(), "out.flac")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewStreamEncoder(f, 44100, 2, 16)
+	writeInChunks(t, enc, samples, 2)
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Back-patched output must be identical to the buffered encoder's
+	var want bytes.Buffer
+	if err := NewEncoder(44100, 2, 16).Encode(&want, samples); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want.Bytes()) {
+		t.Error("seekable stream output differs from Encode output")
+	}
+
+	stream, decoded := decodeAll(t, data)
+	if stream.Info.NSamples != 20000 {
+		t.Errorf("NSamples = %d, want 20000", stream.Info.NSamples)
+	}
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestStreamEncoder_NonSeekable(t *testing.T) {
+	samples := testSignal(10000, 1)
+
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, 48000, 1, 16)
+	writeInChunks(t, enc, samples, 1)
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	info := buf.Bytes()[streamInfoOffset : streamInfoOffset+34]
+	// Min/max frame size must be zero ("unknown")
+	if !bytes.Equal(info[4:10], make([]byte, 6)) {
+		t.Errorf("frame sizes = %x, want zero", info[4:10])
+	}
+	// Total samples (low 36 bits of bytes 10..17) and MD5 must be zero
+	if info[13]&0x0F != 0 || !bytes.Equal(info[14:34], make([]byte, 20)) {
+		t.Errorf("total samples/MD5 not zeroed: %x", info[13:34])
+	}
+
+	stream, decoded := decodeAll(t, buf.Bytes())
+	if stream.Info.SampleRate != 48000 {
+		t.Errorf("SampleRate = %d, want 48000", stream.Info.SampleRate)
+	}
+	assertSamplesEqual(t, decoded, samples)
+}
+
+func TestStreamEncoder_WriteAfterClose(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, 44100, 2, 16)
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if err := enc.Write([]int32{1, 2}); err == nil {
+		t.Error("Write after Close should fail")
+	}
+}
+
+func TestStreamEncoder_PartialFrame(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf, 44100, 2, 16)
+	if err := enc.Write([]int32{1, 2, 3}); err == nil {
+		t.Error("Write should reject a partial sample frame")
+	}
+}